@@ -9,7 +9,7 @@ import (
 type webapi struct {
 	Mux         *http.ServeMux
 	domainRegex *regexp.Regexp
-	store       datastore
+	store       *datastore
 }
 
 type response struct {
@@ -36,7 +36,7 @@ func NewWebAPI(jsonFilename string) (*webapi, error) {
 		return nil, err
 	}
 
-	var store datastore
+	store := &datastore{}
 	err = store.Init(jsonFilename)
 	if err != nil {
 		return nil, err
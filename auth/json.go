@@ -9,6 +9,10 @@ import (
 	"time"
 )
 
+// Datastore is the datastore, exported so other packages can Init one
+// and check users against it.
+type Datastore = datastore
+
 type datastore struct {
 	mutex    sync.RWMutex
 	filename string
@@ -0,0 +1,672 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package client talks to an scs cache server over its text protocol.
+
+A Client keeps a pool of idle connections and is safe to use from many
+goroutines.  Connections that fail are closed and replaced by a new one
+on the next call, and a call made on a pooled connection the server has
+since closed is retried once on a fresh one.
+
+Values are sent with the memcached form of set, so they can hold any
+bytes.  Reading a value holding "\r\n" back needs the server to be
+started with -memcached, as the plain get reply has no length.
+*/
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultTimeout is how long a call can take when its context has no
+	// earlier deadline.
+	DefaultTimeout = time.Second
+	// DefaultMaxIdle is how many idle connections are kept open.
+	DefaultMaxIdle = 2
+
+	// maxKeySize matches the server's MAX_KEY_SIZE.
+	maxKeySize = 250
+	// maxGetKeys is the most keys sent in a single get, which keeps
+	// the line well under the server's line limit.
+	maxGetKeys = 100
+	// maxRelativeExptime is the largest exptime the server reads as a
+	// number of seconds rather than a unix time.
+	maxRelativeExptime = 60 * 60 * 24 * 30
+)
+
+var (
+	// ErrCacheMiss is returned when the key is not in the cache.
+	ErrCacheMiss = errors.New("client: cache miss")
+	// ErrMalformedKey is returned for keys that are empty, too long,
+	// or hold spaces or control characters.
+	ErrMalformedKey = errors.New("client: key is empty, too long or has invalid characters")
+	// ErrClosed is returned by calls made after Close.
+	ErrClosed = errors.New("client: client is closed")
+	// ErrNotStored is returned when add, replace, append or prepend
+	// did not store the value because of whether the key exists.
+	ErrNotStored = errors.New("client: item not stored")
+	// ErrCASConflict is returned by CompareAndSwap when the item was
+	// stored again since it was read.
+	ErrCASConflict = errors.New("client: compare-and-swap conflict")
+)
+
+// ServerError is an ERROR reply from the server.  The connection is
+// still usable after one.
+type ServerError struct {
+	Msg string
+}
+
+func (e *ServerError) Error() string {
+	return "client: server error: " + e.Msg
+}
+
+// protocolError is a reply the client did not expect.  The connection
+// can not be trusted after one, so it is closed.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "client: unexpected reply: " + strconv.Quote(string(e))
+}
+
+// Item is a value in the cache along with what memcached clients keep
+// with it.
+type Item struct {
+	Key   string
+	Value []byte
+	Flags uint32 // opaque to the server
+	// TTL is how long a stored item lives, rounded up to whole
+	// seconds.  0 never expires and negative has already expired.
+	// It is not filled in by GetItems.
+	TTL time.Duration
+	// Cas is the item's version, filled in by GetItems and checked by
+	// CompareAndSwap.
+	Cas uint64
+}
+
+// Option configures a Client when it is created by New.
+type Option func(*Client)
+
+// WithTimeout sets how long each call can take, including dialing,
+// when its context does not have an earlier deadline.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) { c.timeout = d }
+}
+
+// WithMaxIdle sets how many idle connections are kept for reuse.
+func WithMaxIdle(n int) Option {
+	return func(c *Client) { c.maxIdle = n }
+}
+
+// Client is a pool of connections to one scs server.
+type Client struct {
+	addr    string
+	timeout time.Duration
+	maxIdle int
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+// conn is a single connection to the server.  read counts the bytes
+// read from it, so a failed call can tell if the server replied at all.
+type conn struct {
+	nc   net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	read int
+}
+
+func (cn *conn) Read(p []byte) (int, error) {
+	n, err := cn.nc.Read(p)
+	cn.read += n
+	return n, err
+}
+
+// New returns a client for the server at addr.  No connection is made
+// until the first call.
+func New(addr string, opts ...Option) *Client {
+	c := &Client{addr: addr, timeout: DefaultTimeout, maxIdle: DefaultMaxIdle}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Close closes every idle connection.  Calls still running finish, but
+// their connections are closed rather than kept.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	for _, cn := range c.idle {
+		cn.nc.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+// Get returns the value stored at key, or ErrCacheMiss.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	values, err := c.GetMulti(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := values[key]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+	return v, nil
+}
+
+// GetMulti returns the values of every key that is in the cache.  Keys
+// that are missing are left out of the map rather than being an error.
+func (c *Client) GetMulti(ctx context.Context, keys ...string) (map[string][]byte, error) {
+	for _, k := range keys {
+		if !validKey(k) {
+			return nil, ErrMalformedKey
+		}
+	}
+
+	items, err := c.getItems(ctx, "get", keys)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(items))
+	for k, it := range items {
+		values[k] = it.Value
+	}
+	return values, nil
+}
+
+// GetItems returns the items of every key that is in the cache, with
+// their versions.  Keys that are missing are left out of the map.  The
+// flags are only sent back by servers started with -memcached.
+func (c *Client) GetItems(ctx context.Context, keys ...string) (map[string]*Item, error) {
+	for _, k := range keys {
+		if !validKey(k) {
+			return nil, ErrMalformedKey
+		}
+	}
+	return c.getItems(ctx, "gets", keys)
+}
+
+// getItems sends keys with cmd, get or gets, in batches of maxGetKeys.
+func (c *Client) getItems(ctx context.Context, cmd string, keys []string) (map[string]*Item, error) {
+	items := make(map[string]*Item, len(keys))
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > maxGetKeys {
+			batch = batch[:maxGetKeys]
+		}
+		keys = keys[len(batch):]
+
+		err := c.do(ctx, func(cn *conn) error {
+			fmt.Fprintf(cn.w, "%v %v\r\n", cmd, strings.Join(batch, " "))
+			if err := cn.w.Flush(); err != nil {
+				return err
+			}
+			return readItems(cn.r, cmd == "gets", items)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// Set stores value at key.  A ttl of 0 never expires, otherwise it is
+// rounded up to whole seconds.
+func (c *Client) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.SetItem(ctx, &Item{Key: key, Value: value, TTL: ttl})
+}
+
+// SetItem stores it, along with its flags.
+func (c *Client) SetItem(ctx context.Context, it *Item) error {
+	return c.store(ctx, "set", it)
+}
+
+// Add stores it only if its key is not in the cache, or returns
+// ErrNotStored.
+func (c *Client) Add(ctx context.Context, it *Item) error {
+	return c.store(ctx, "add", it)
+}
+
+// Replace stores it only if its key is already in the cache, or returns
+// ErrNotStored.
+func (c *Client) Replace(ctx context.Context, it *Item) error {
+	return c.store(ctx, "replace", it)
+}
+
+// Append adds the value of it to the end of the item already at its
+// key, or returns ErrNotStored.  The flags and TTL are left as they are.
+func (c *Client) Append(ctx context.Context, it *Item) error {
+	return c.store(ctx, "append", it)
+}
+
+// Prepend adds the value of it to the start of the item already at its
+// key, or returns ErrNotStored.  The flags and TTL are left as they are.
+func (c *Client) Prepend(ctx context.Context, it *Item) error {
+	return c.store(ctx, "prepend", it)
+}
+
+// CompareAndSwap stores it only if the item at its key still has the
+// version in it.Cas.  It returns ErrCASConflict if it was stored again
+// and ErrCacheMiss if it is gone.
+func (c *Client) CompareAndSwap(ctx context.Context, it *Item) error {
+	return c.store(ctx, "cas", it)
+}
+
+// store sends it with the memcached form of cmd, one of the set family.
+func (c *Client) store(ctx context.Context, cmd string, it *Item) error {
+	if !validKey(it.Key) {
+		return ErrMalformedKey
+	}
+	return c.do(ctx, func(cn *conn) error {
+		fmt.Fprintf(cn.w, "%v %v %v %v %v", cmd, it.Key, it.Flags, exptime(it.TTL, time.Now()), len(it.Value))
+		if cmd == "cas" {
+			fmt.Fprintf(cn.w, " %v", it.Cas)
+		}
+		cn.w.WriteString("\r\n")
+		cn.w.Write(it.Value)
+		cn.w.WriteString("\r\n")
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+		return expectLine(cn.r, "STORED")
+	})
+}
+
+// Incr adds delta to the decimal number stored at key and returns the
+// new number.  It wraps around at 64 bits.
+func (c *Client) Incr(ctx context.Context, key string, delta uint64) (uint64, error) {
+	return c.incr(ctx, "incr", key, delta)
+}
+
+// Decr subtracts delta from the decimal number stored at key and
+// returns the new number.  It stops at 0.
+func (c *Client) Decr(ctx context.Context, key string, delta uint64) (uint64, error) {
+	return c.incr(ctx, "decr", key, delta)
+}
+
+// incr sends cmd, incr or decr, and reads back the new number.
+func (c *Client) incr(ctx context.Context, cmd, key string, delta uint64) (uint64, error) {
+	if !validKey(key) {
+		return 0, ErrMalformedKey
+	}
+	var n uint64
+	err := c.do(ctx, func(cn *conn) error {
+		fmt.Fprintf(cn.w, "%v %v %v\r\n", cmd, key, delta)
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+		line, err := readLine(cn.r)
+		if err != nil {
+			return err
+		}
+		if line == "NOT_FOUND" {
+			return ErrCacheMiss
+		}
+		n, err = strconv.ParseUint(line, 10, 64)
+		if err != nil {
+			return protocolError(line)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Touch changes how long the item at key lives.  The ttl is rounded up
+// to whole seconds, and 0 makes it never expire.
+func (c *Client) Touch(ctx context.Context, key string, ttl time.Duration) error {
+	if !validKey(key) {
+		return ErrMalformedKey
+	}
+	return c.do(ctx, func(cn *conn) error {
+		want := "TOUCHED"
+		if ttl == 0 {
+			want = "PERSISTED"
+			fmt.Fprintf(cn.w, "persist %v\r\n", key)
+		} else {
+			fmt.Fprintf(cn.w, "expire %v %v\r\n", key, int64((ttl+time.Second-1)/time.Second))
+		}
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+		return expectLine(cn.r, want)
+	})
+}
+
+// TTL returns how long the item at key has left to live, in whole
+// seconds, or 0 if it never expires.
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	if !validKey(key) {
+		return 0, ErrMalformedKey
+	}
+	var ttl time.Duration
+	err := c.do(ctx, func(cn *conn) error {
+		fmt.Fprintf(cn.w, "ttl %v\r\n", key)
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+		line, err := readLine(cn.r)
+		if err != nil {
+			return err
+		}
+		if line == "NOT_FOUND" {
+			return ErrCacheMiss
+		}
+		if !strings.HasPrefix(line, "TTL ") {
+			return protocolError(line)
+		}
+		secs, err := strconv.ParseInt(line[len("TTL "):], 10, 64)
+		if err != nil {
+			return protocolError(line)
+		}
+		if secs > 0 {
+			ttl = time.Duration(secs) * time.Second
+		}
+		return nil
+	})
+	return ttl, err
+}
+
+// Delete removes key from the cache, or returns ErrCacheMiss if it was
+// not there.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	if !validKey(key) {
+		return ErrMalformedKey
+	}
+	return c.do(ctx, func(cn *conn) error {
+		fmt.Fprintf(cn.w, "delete %v\r\n", key)
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+		return expectLine(cn.r, "DELETED")
+	})
+}
+
+// Stats returns the server's statistics by name.
+func (c *Client) Stats(ctx context.Context) (map[string]string, error) {
+	stats := make(map[string]string)
+	err := c.do(ctx, func(cn *conn) error {
+		cn.w.WriteString("stats\r\n")
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+		for {
+			line, err := readLine(cn.r)
+			if err != nil {
+				return err
+			}
+			if line == "END" {
+				return nil
+			}
+			f := strings.SplitN(line, " ", 2)
+			if len(f) != 2 {
+				return protocolError(line)
+			}
+			stats[f[0]] = f[1]
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// do runs f on a connection from the pool, under the deadline of ctx or
+// the client's timeout, whichever is first.  A pooled connection that
+// fails before the server replies was most likely closed while idle,
+// so f is tried once more on a new one.
+func (c *Client) do(ctx context.Context, f func(cn *conn) error) error {
+	for retried := false; ; retried = true {
+		cn, reused, err := c.getConn(ctx)
+		if err != nil {
+			return err
+		}
+
+		cn.read = 0
+		err = c.run(ctx, cn, f)
+		replied := cn.read > 0
+		c.putConn(cn, err)
+		if err != nil && reused && !retried && !replied && stale(err) {
+			continue
+		}
+		return err
+	}
+}
+
+// run calls f with the connection's deadline set, and interrupts it if
+// ctx is cancelled part way.
+func (c *Client) run(ctx context.Context, cn *conn, f func(cn *conn) error) error {
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	cn.nc.SetDeadline(deadline)
+
+	if ctx.Done() == nil {
+		return ctxErr(ctx, f(cn))
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// Fail any read or write that is blocked right away
+			cn.nc.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	err := f(cn)
+	close(stop)
+	<-stopped
+	return ctxErr(ctx, err)
+}
+
+// ctxErr returns the context's error in place of err if the call failed
+// because ctx was cancelled or its deadline passed.  The connection's
+// deadline can pass before ctx notices its own.
+func ctxErr(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// getConn returns an idle connection, or dials a new one.  reused is
+// set for idle connections.
+func (c *Client) getConn(ctx context.Context) (cn *conn, reused bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, false, ErrClosed
+	}
+	if n := len(c.idle); n > 0 {
+		cn = c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return cn, true, nil
+	}
+	c.mu.Unlock()
+
+	d := net.Dialer{Timeout: c.timeout}
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, false, ctxErr(ctx, err)
+	}
+	cn = &conn{nc: nc, w: bufio.NewWriter(nc)}
+	cn.r = bufio.NewReader(cn)
+	return cn, false, nil
+}
+
+// putConn keeps cn for the next call if err left it usable and there is
+// room in the pool, and closes it otherwise.
+func (c *Client) putConn(cn *conn, err error) {
+	if err != nil && err != ErrCacheMiss && err != ErrNotStored && err != ErrCASConflict {
+		if _, ok := err.(*ServerError); !ok {
+			cn.nc.Close()
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.idle) >= c.maxIdle {
+		cn.nc.Close()
+		return
+	}
+	c.idle = append(c.idle, cn)
+}
+
+// stale reports if err is what writing to or reading from a connection
+// the server has closed gives.
+func stale(err error) bool {
+	return err == io.EOF || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// validKey reports if key can be sent to the server.
+func validKey(key string) bool {
+	if len(key) == 0 || len(key) >= maxKeySize {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// exptime converts ttl into a memcached exptime, which is a number of
+// seconds up to 30 days and a unix time past that.
+func exptime(ttl time.Duration, now time.Time) int64 {
+	if ttl < 0 {
+		return -1
+	}
+	secs := int64((ttl + time.Second - 1) / time.Second)
+	if secs > maxRelativeExptime {
+		return now.Add(ttl).Unix()
+	}
+	return secs
+}
+
+// readLine reads a line from the server without its \r\n, turning
+// ERROR replies into a ServerError.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if line == "ERROR" || strings.HasPrefix(line, "ERROR ") {
+		return "", &ServerError{strings.TrimSpace(line[len("ERROR"):])}
+	}
+	return line, nil
+}
+
+// expectLine reads a single line reply, which must be want.  NOT_FOUND,
+// NOT_STORED and EXISTS are returned as their errors.
+func expectLine(r *bufio.Reader, want string) error {
+	line, err := readLine(r)
+	if err != nil {
+		return err
+	}
+	switch line {
+	case want:
+		return nil
+	case "NOT_FOUND":
+		return ErrCacheMiss
+	case "NOT_STORED":
+		return ErrNotStored
+	case "EXISTS":
+		return ErrCASConflict
+	}
+	return protocolError(line)
+}
+
+// readItems reads the reply to get, or gets when cas is set, into
+// items.  Each item is either VALUE <key> followed by a line of data,
+// or VALUE <key> <flags> <bytes> followed by that many bytes when the
+// server runs with -memcached.  gets adds the version to the end.
+func readItems(r *bufio.Reader, cas bool, items map[string]*Item) error {
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+		if line == "END" {
+			return nil
+		}
+
+		f := strings.Fields(line)
+		if len(f) < 2 || f[0] != "VALUE" {
+			return protocolError(line)
+		}
+		it := &Item{Key: f[1]}
+		if cas {
+			it.Cas, err = strconv.ParseUint(f[len(f)-1], 10, 64)
+			if err != nil {
+				return protocolError(line)
+			}
+			f = f[:len(f)-1]
+		}
+
+		switch len(f) {
+		case 2:
+			data, err := r.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			it.Value = []byte(strings.TrimSuffix(strings.TrimSuffix(data, "\n"), "\r"))
+		case 4:
+			flags, err := strconv.ParseUint(f[2], 10, 32)
+			if err != nil {
+				return protocolError(line)
+			}
+			it.Flags = uint32(flags)
+			n, err := strconv.Atoi(f[3])
+			if err != nil || n < 0 {
+				return protocolError(line)
+			}
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			if string(data[n:]) != "\r\n" {
+				return protocolError(line)
+			}
+			it.Value = data[:n]
+		default:
+			return protocolError(line)
+		}
+		items[it.Key] = it
+	}
+}
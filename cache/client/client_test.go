@@ -0,0 +1,233 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"topcoder.com/kyrra/scs/scs"
+)
+
+// startServer creates a server on a random localhost port and returns a
+// client for it.
+func startServer(t *testing.T, opts ...scs.Option) (*scs.Server, *Client) {
+	t.Helper()
+
+	base := []scs.Option{scs.WithAddr("localhost"), scs.WithPort(0)}
+	s, err := scs.NewServer(append(base, opts...)...)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	go s.Serve()
+
+	return s, New(s.Addr().String(), WithTimeout(5*time.Second))
+}
+
+// TestClient runs every call against a server in both get formats.
+func TestClient(t *testing.T) {
+	for _, mc := range []bool{false, true} {
+		s, c := startServer(t, scs.WithMemcached(mc))
+		ctx := context.Background()
+
+		if err := c.Set(ctx, "sushi", []byte("delicious"), 0); err != nil {
+			t.Errorf("memcached %v: Set = %v", mc, err)
+		}
+		if err := c.Set(ctx, "empty", nil, time.Hour); err != nil {
+			t.Errorf("memcached %v: Set empty = %v", mc, err)
+		}
+		if v, err := c.Get(ctx, "sushi"); err != nil || string(v) != "delicious" {
+			t.Errorf("memcached %v: Get = %q, %v", mc, v, err)
+		}
+		if _, err := c.Get(ctx, "tofu"); err != ErrCacheMiss {
+			t.Errorf("memcached %v: Get missing = %v, wanted ErrCacheMiss", mc, err)
+		}
+		values, err := c.GetMulti(ctx, "sushi", "tofu", "empty")
+		if err != nil || len(values) != 2 || string(values["sushi"]) != "delicious" || len(values["empty"]) != 0 {
+			t.Errorf("memcached %v: GetMulti = %q, %v", mc, values, err)
+		}
+
+		if err := c.Delete(ctx, "sushi"); err != nil {
+			t.Errorf("memcached %v: Delete = %v", mc, err)
+		}
+		if err := c.Delete(ctx, "sushi"); err != ErrCacheMiss {
+			t.Errorf("memcached %v: Delete missing = %v, wanted ErrCacheMiss", mc, err)
+		}
+
+		stats, err := c.Stats(ctx)
+		if err != nil || stats["cmd_set"] != "2" || stats["delete_hits"] != "1" || stats["curr_items"] != "1" {
+			t.Errorf("memcached %v: Stats = %v, %v", mc, stats, err)
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+// TestClientBinaryValues verifies any bytes round trip when the server
+// replies in the memcached format.
+func TestClientBinaryValues(t *testing.T) {
+	s, c := startServer(t, scs.WithMemcached(true))
+	defer s.Close()
+	defer c.Close()
+	ctx := context.Background()
+
+	value := []byte("line\r\nbreak\x00\xff")
+	if err := c.Set(ctx, "bin", value, 0); err != nil {
+		t.Fatalf("Set = %v", err)
+	}
+	if v, err := c.Get(ctx, "bin"); err != nil || string(v) != string(value) {
+		t.Errorf("Get = %q, %v, wanted %q", v, err, value)
+	}
+}
+
+// TestClientItems runs the calls that take and return whole items.
+func TestClientItems(t *testing.T) {
+	s, c := startServer(t, scs.WithMemcached(true))
+	defer s.Close()
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.Add(ctx, &Item{Key: "sushi", Value: []byte("delicious"), Flags: 7}); err != nil {
+		t.Errorf("Add = %v", err)
+	}
+	if err := c.Add(ctx, &Item{Key: "sushi", Value: []byte("again")}); err != ErrNotStored {
+		t.Errorf("Add existing = %v, wanted ErrNotStored", err)
+	}
+	if err := c.Replace(ctx, &Item{Key: "tofu", Value: []byte("bland")}); err != ErrNotStored {
+		t.Errorf("Replace missing = %v, wanted ErrNotStored", err)
+	}
+	if err := c.Append(ctx, &Item{Key: "sushi", Value: []byte("!")}); err != nil {
+		t.Errorf("Append = %v", err)
+	}
+	if err := c.Prepend(ctx, &Item{Key: "sushi", Value: []byte("so ")}); err != nil {
+		t.Errorf("Prepend = %v", err)
+	}
+
+	items, err := c.GetItems(ctx, "sushi", "tofu")
+	if err != nil || len(items) != 1 {
+		t.Fatalf("GetItems = %v, %v", items, err)
+	}
+	it := items["sushi"]
+	if string(it.Value) != "so delicious!" || it.Flags != 7 || it.Cas == 0 {
+		t.Errorf("GetItems = %+v", it)
+	}
+	it.Value = []byte("tasty")
+	if err := c.CompareAndSwap(ctx, it); err != nil {
+		t.Errorf("CompareAndSwap = %v", err)
+	}
+	if err := c.CompareAndSwap(ctx, it); err != ErrCASConflict {
+		t.Errorf("CompareAndSwap again = %v, wanted ErrCASConflict", err)
+	}
+
+	c.Set(ctx, "counter", []byte("5"), 0)
+	if n, err := c.Incr(ctx, "counter", 10); err != nil || n != 15 {
+		t.Errorf("Incr = %v, %v", n, err)
+	}
+	if n, err := c.Decr(ctx, "counter", 20); err != nil || n != 0 {
+		t.Errorf("Decr = %v, %v", n, err)
+	}
+	if _, err := c.Incr(ctx, "tofu", 1); err != ErrCacheMiss {
+		t.Errorf("Incr missing = %v, wanted ErrCacheMiss", err)
+	}
+	if _, err := c.Incr(ctx, "sushi", 1); err == nil {
+		t.Errorf("Incr of a word succeeded")
+	}
+
+	if err := c.Touch(ctx, "counter", 90*time.Second); err != nil {
+		t.Errorf("Touch = %v", err)
+	}
+	if ttl, err := c.TTL(ctx, "counter"); err != nil || ttl != 90*time.Second {
+		t.Errorf("TTL = %v, %v", ttl, err)
+	}
+	if err := c.Touch(ctx, "counter", 0); err != nil {
+		t.Errorf("Touch 0 = %v", err)
+	}
+	if ttl, err := c.TTL(ctx, "counter"); err != nil || ttl != 0 {
+		t.Errorf("TTL after Touch 0 = %v, %v", ttl, err)
+	}
+	if _, err := c.TTL(ctx, "tofu"); err != ErrCacheMiss {
+		t.Errorf("TTL missing = %v, wanted ErrCacheMiss", err)
+	}
+}
+
+// TestClientErrors verifies bad keys are refused before they are sent
+// and ERROR replies become a ServerError on a connection that still
+// works.
+func TestClientErrors(t *testing.T) {
+	s, c := startServer(t)
+	defer s.Close()
+	defer c.Close()
+	ctx := context.Background()
+
+	for _, k := range []string{"", "has space", "new\r\nline", string(make([]byte, 250))} {
+		if err := c.Set(ctx, k, []byte("v"), 0); err != ErrMalformedKey {
+			t.Errorf("Set(%q) = %v, wanted ErrMalformedKey", k, err)
+		}
+	}
+
+	err := c.Set(ctx, "big", make([]byte, 9000), 0)
+	if se, ok := err.(*ServerError); !ok || se.Msg != "data can only be 8192 characters long" {
+		t.Errorf("Set too large = %v, wanted a ServerError", err)
+	}
+	if err := c.Set(ctx, "small", []byte("v"), 0); err != nil {
+		t.Errorf("Set after a ServerError = %v", err)
+	}
+
+	c.Close()
+	if _, err := c.Get(ctx, "small"); err != ErrClosed {
+		t.Errorf("Get after Close = %v, wanted ErrClosed", err)
+	}
+}
+
+// TestClientReconnect verifies a pooled connection the server closed is
+// replaced without the caller seeing an error.
+func TestClientReconnect(t *testing.T) {
+	s, c := startServer(t)
+	defer s.Close()
+	defer c.Close()
+	ctx := context.Background()
+
+	if err := c.Set(ctx, "sushi", []byte("delicious"), 0); err != nil {
+		t.Fatalf("Set = %v", err)
+	}
+
+	// Have the server close the pooled connection, as a restart would
+	c.mu.Lock()
+	cn := c.idle[0]
+	c.mu.Unlock()
+	cn.w.WriteString("quit\r\n")
+	cn.w.Flush()
+	cn.r.ReadByte()
+
+	if v, err := c.Get(ctx, "sushi"); err != nil || string(v) != "delicious" {
+		t.Errorf("Get after the server closed the connection = %q, %v", v, err)
+	}
+}
+
+// TestClientContext verifies calls stop at the context's deadline.
+func TestClientContext(t *testing.T) {
+	s, c := startServer(t)
+	defer s.Close()
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.Set(ctx, "sushi", []byte("delicious"), 0); err != context.Canceled {
+		t.Errorf("Set with a cancelled context = %v, wanted context.Canceled", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := c.do(ctx, func(cn *conn) error {
+		// Nothing was sent, so this blocks until the deadline
+		_, err := cn.r.ReadByte()
+		return err
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("blocked call = %v, wanted context.DeadlineExceeded", err)
+	}
+}
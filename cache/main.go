@@ -12,56 +12,122 @@ command handlers to further work on the input.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"topcoder.com/kyrra/scs/scs"
 )
 
 // main Entrypoint to the application.  Defines command line flags,
-// creates cache server, registers handlers, and starts serving.
+// creates cache server, and starts serving.  The server itself is the
+// scs package, so it can also be embedded in other programs.
 func main() {
 	a := flag.String("addr", "", "IP address the server binds to")
 	p := flag.Int("port", 11212, "Port the server listens on")
-	i := flag.Int("items", 65535, "Maximum number of items to cache")
+	bp := flag.Int("binaryport", 0, "Port the memcached binary protocol listens on, 0 to disable")
+	rp := flag.Int("respport", 0, "Port the Redis RESP protocol listens on, 0 to disable")
+	mp := flag.Int("metricsport", 0, "Port Prometheus metrics are served over HTTP at /metrics on, 0 to disable")
+	i := flag.Int("items", 65535, "Maximum number of items to cache in each database")
+	m := flag.Int("memory", 64*1024*1024, "Maximum number of bytes of keys and values to cache in each database, 0 for no limit")
+	snap := flag.String("snapshot", "", "File the cache is saved to and loaded from, blank to disable")
+	save := flag.String("save", "900 1 300 10 60 10000", "Pairs of '<seconds> <changes>' that trigger a background save once both are reached")
+	wal := flag.String("log", "", "File every change to the cache is appended to and replayed from, blank to disable")
+	fsync := flag.String("fsync", "everysec", "How often the log is flushed to disk: always, everysec or never")
+	mc := flag.Bool("memcached", false, "Reply to get with memcached style 'VALUE <key> <flags> <bytes>' lines")
+	sh := flag.Int("shards", 16, "Number of independently locked shards each database is split into")
+	dbs := flag.Int("databases", 1, "Number of isolated databases clients switch between with select")
+	ro := flag.String("replicaof", "", "host:port of a primary to replicate from, blank to disable")
+	cert := flag.String("tls-cert", "", "PEM certificate to serve TLS with, blank to disable")
+	key := flag.String("tls-key", "", "PEM private key of -tls-cert")
+	ca := flag.String("tls-ca", "", "PEM CA certificates that clients must present a certificate from, blank to not ask for one")
+	au := flag.String("auth", "", "JSON file of domains and users that must auth before running commands, blank to disable")
+	e := flag.String("evict", "lru", "Policy used to make room when the cache is full: lru, lfu, random or reject")
+	mx := flag.Int("maxconns", 0, "Maximum number of client connections open at once, 0 for no limit")
+	it := flag.Duration("idletimeout", 0, "How long a client can wait between commands before it is disconnected, 0 for no limit")
+	rt := flag.Duration("readtimeout", 0, "How long the rest of a command can take to arrive once its first line has, 0 for no limit")
+	wt := flag.Duration("writetimeout", 0, "How long each write to a client can take, 0 for no limit")
+	rl := flag.Float64("ratelimit", 0, "Commands a second each client IP can run, 0 for no limit")
+	rb := flag.Int("ratelimitburst", 100, "Commands each client IP can run at once before -ratelimit applies")
+	st := flag.Duration("shutdowntimeout", 30*time.Second, "How long SIGINT and SIGTERM wait for running commands to finish before closing their connections")
 	flag.Parse()
 
-	s, err := NewServer(*a, *p, *i)
-	if err != nil {
-		fmt.Println("failed to create server: ", err)
-		return
+	opts := []scs.Option{
+		scs.WithAddr(*a),
+		scs.WithPort(*p),
+		scs.WithMaxItems(*i),
+		scs.WithMaxBytes(*m),
+		scs.WithShards(*sh),
+		scs.WithDatabases(*dbs),
+		scs.WithEvictionPolicy(*e),
+		scs.WithMemcached(*mc),
+		scs.WithMaxConns(*mx),
+		scs.WithTimeouts(*it, *rt, *wt),
+		scs.WithRateLimit(*rl, *rb),
+	}
+	if *bp != 0 {
+		opts = append(opts, scs.WithBinaryPort(*bp))
+	}
+	if *rp != 0 {
+		opts = append(opts, scs.WithRESPPort(*rp))
+	}
+	if *mp != 0 {
+		opts = append(opts, scs.WithMetricsPort(*mp))
+	}
+	if *snap != "" {
+		opts = append(opts, scs.WithSnapshot(*snap), scs.WithSaveRules(*save))
+	}
+	if *wal != "" {
+		opts = append(opts, scs.WithLog(*wal, *fsync))
+	}
+	if *ro != "" {
+		opts = append(opts, scs.WithReplicaOf(*ro))
+	}
+	if *au != "" {
+		opts = append(opts, scs.WithAuth(*au))
+	}
+	if *cert != "" || *key != "" || *ca != "" {
+		opts = append(opts, scs.WithTLS(*cert, *key, *ca))
 	}
 
-	err = registerHandlers(s)
+	s, err := scs.NewServer(opts...)
 	if err != nil {
-		fmt.Println("failed to register handlers: ", err)
+		fmt.Println("failed to create server: ", err)
 		return
 	}
 
+	handleSignals(s, *st)
 	fmt.Println("ready to accept cache requests")
-	s.Serve()
+	err = s.Serve()
+	if err != scs.ErrServerClosed {
+		fmt.Println("server stopped: ", err)
+	}
 }
 
-// registerHandlers will associate command handlers to their
-// given command available via the server.
-func registerHandlers(s *server) error {
-	err := s.AddHandler("set", cmdSet)
-	if err != nil {
-		return err
-	}
-	err = s.AddHandler("get", cmdGet)
-	if err != nil {
-		return err
-	}
-	err = s.AddHandler("delete", cmdDelete)
-	if err != nil {
-		return err
-	}
-	err = s.AddHandler("stats", cmdStats)
-	if err != nil {
-		return err
-	}
-	err = s.AddHandler("quit", cmdQuit)
-	if err != nil {
-		return err
-	}
-	return nil
+// handleSignals starts a goroutine that waits for SIGINT or SIGTERM and
+// shuts s down, giving running commands timeout to finish.  A second
+// signal exits straight away.
+func handleSignals(s *scs.Server, timeout time.Duration) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-c
+		fmt.Println("shutting down server")
+		go func() {
+			<-c
+			fmt.Println("forcing shutdown")
+			os.Exit(1)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err := s.Shutdown(ctx)
+		if err != nil {
+			fmt.Println("closed connections still running commands: ", err)
+		}
+	}()
 }
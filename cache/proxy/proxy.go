@@ -0,0 +1,514 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package proxy spreads a cache over several scs servers.
+
+A Proxy is an scs.Storage, so a server created with scs.WithStorage
+speaks every protocol scs does while each key lives on one of the
+backends, picked with a consistent hash ring.  A get of many keys asks
+every backend holding some of them at once.  stats adds up the numbers
+of every backend.
+
+A backend that fails EjectAfter calls in a row is taken off the ring,
+moving its keys to the other backends, and is tried again every
+CheckInterval until it answers and is put back.
+*/
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"topcoder.com/kyrra/scs/client"
+	"topcoder.com/kyrra/scs/scs"
+)
+
+const (
+	// DefaultVirtualNodes is how many points each backend has on the
+	// ring.  More spreads keys more evenly.
+	DefaultVirtualNodes = 160
+	// DefaultTimeout is how long a call to a backend can take.
+	DefaultTimeout = time.Second
+	// DefaultEjectAfter is how many calls to a backend must fail in a
+	// row before it is taken off the ring.
+	DefaultEjectAfter = 2
+	// DefaultCheckInterval is how often ejected backends are tried.
+	DefaultCheckInterval = time.Second
+)
+
+// Option configures a Proxy when it is created by New.
+type Option func(*Proxy)
+
+// WithVirtualNodes sets how many points each backend has on the ring.
+func WithVirtualNodes(n int) Option {
+	return func(p *Proxy) { p.vnodes = n }
+}
+
+// WithTimeout sets how long each call to a backend can take.
+func WithTimeout(d time.Duration) Option {
+	return func(p *Proxy) { p.timeout = d }
+}
+
+// WithEjectAfter sets how many calls to a backend must fail in a row
+// before it is taken off the ring.
+func WithEjectAfter(n int) Option {
+	return func(p *Proxy) { p.ejectAfter = n }
+}
+
+// WithCheckInterval sets how often ejected backends are tried.
+func WithCheckInterval(d time.Duration) Option {
+	return func(p *Proxy) { p.interval = d }
+}
+
+// Proxy is an scs.Storage that keeps each key on one of its backends.
+type Proxy struct {
+	vnodes     int
+	timeout    time.Duration
+	ejectAfter int
+	interval   time.Duration
+	backends   []*backend
+	done       chan struct{}
+
+	mu   sync.RWMutex
+	ring *ring // only the backends that are not ejected
+}
+
+// backend is a single scs server behind the proxy.
+type backend struct {
+	addr    string
+	c       *client.Client
+	fails   int32 // calls failed in a row, updated atomically
+	ejected bool  // guarded by Proxy.mu
+}
+
+// New returns a proxy for the servers at addrs and starts checking on
+// the ones it ejects.  No connection is made until the first call.
+func New(addrs []string, opts ...Option) (*Proxy, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("proxy needs at least one backend")
+	}
+	p := &Proxy{
+		vnodes:     DefaultVirtualNodes,
+		timeout:    DefaultTimeout,
+		ejectAfter: DefaultEjectAfter,
+		interval:   DefaultCheckInterval,
+		done:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.vnodes < 1 {
+		return nil, fmt.Errorf("virtual nodes must be at least 1")
+	}
+	if p.ejectAfter < 1 {
+		return nil, fmt.Errorf("eject after must be at least 1")
+	}
+
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if seen[addr] {
+			return nil, fmt.Errorf("backend %v is listed twice", addr)
+		}
+		seen[addr] = true
+		p.backends = append(p.backends, &backend{addr: addr, c: client.New(addr, client.WithTimeout(p.timeout))})
+	}
+	p.rebuild()
+
+	go p.check()
+	return p, nil
+}
+
+// Close stops checking on ejected backends and closes every idle
+// connection.
+func (p *Proxy) Close() {
+	close(p.done)
+	for _, b := range p.backends {
+		b.c.Close()
+	}
+}
+
+// rebuild places every backend that is not ejected on a new ring.  The
+// caller must hold mu, or be New.
+func (p *Proxy) rebuild() {
+	var live []*backend
+	for _, b := range p.backends {
+		if !b.ejected {
+			live = append(live, b)
+		}
+	}
+	p.ring = newRing(live, p.vnodes)
+}
+
+// pick returns the backend key belongs to, or nil if every backend is
+// ejected.
+func (p *Proxy) pick(key string) *backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.ring.lookup(key)
+}
+
+// call runs f on the client of b under the proxy's timeout, and keeps
+// count of the calls that fail.
+func (p *Proxy) call(b *backend, f func(ctx context.Context, c *client.Client) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	err := f(ctx, b.c)
+	if failed(err) {
+		p.fail(b)
+	} else {
+		atomic.StoreInt32(&b.fails, 0)
+	}
+	return err
+}
+
+// failed reports if err means the backend could not be used, rather
+// than being the backend's answer.
+func failed(err error) bool {
+	switch err {
+	case nil, client.ErrCacheMiss, client.ErrNotStored, client.ErrCASConflict, client.ErrMalformedKey:
+		return false
+	}
+	_, ok := err.(*client.ServerError)
+	return !ok
+}
+
+// fail counts a failed call to b, and ejects it once ejectAfter have
+// failed in a row.
+func (p *Proxy) fail(b *backend) {
+	if atomic.AddInt32(&b.fails, 1) < int32(p.ejectAfter) {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b.ejected {
+		return
+	}
+	fmt.Printf("ejecting backend %v\n", b.addr)
+	b.ejected = true
+	p.rebuild()
+}
+
+// check tries the ejected backends every interval, and puts back the
+// ones that answer.
+func (p *Proxy) check() {
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+		}
+
+		p.mu.RLock()
+		var ejected []*backend
+		for _, b := range p.backends {
+			if b.ejected {
+				ejected = append(ejected, b)
+			}
+		}
+		p.mu.RUnlock()
+
+		for _, b := range ejected {
+			ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+			_, err := b.c.Stats(ctx)
+			cancel()
+			if err == nil {
+				p.readmit(b)
+			}
+		}
+	}
+}
+
+// readmit puts b back on the ring.
+func (p *Proxy) readmit(b *backend) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fmt.Printf("readmitting backend %v\n", b.addr)
+	b.ejected = false
+	atomic.StoreInt32(&b.fails, 0)
+	p.rebuild()
+}
+
+// result turns the error of a call into the scs.Result it stands for.
+// A backend that could not be used is Unavailable.
+func result(err error) scs.Result {
+	switch err {
+	case nil:
+		return scs.OK
+	case client.ErrCacheMiss:
+		return scs.NotFound
+	case client.ErrNotStored:
+		return scs.NotStored
+	case client.ErrCASConflict:
+		return scs.Exists
+	}
+
+	se, ok := err.(*client.ServerError)
+	if !ok {
+		return scs.Unavailable
+	}
+	switch {
+	case strings.HasPrefix(se.Msg, scs.MsgTooLarge):
+		return scs.TooLarge
+	case se.Msg == scs.MsgOverMemory:
+		return scs.OverMemory
+	case se.Msg == scs.MsgCacheFull:
+		return scs.CacheFull
+	case se.Msg == scs.MsgNonNumeric:
+		return scs.NonNumeric
+	case se.Msg == scs.MsgReadOnly:
+		return scs.ReadOnly
+	}
+	return scs.Unavailable
+}
+
+// Get implements scs.Storage.
+func (p *Proxy) Get(key string) (scs.Item, bool) {
+	items := p.GetMulti([]string{key})
+	i, ok := items[key]
+	return i, ok
+}
+
+// GetMulti implements scs.MultiGetter.  Keys are sent to every backend
+// holding some of them at once, and keys on a backend that fails are
+// missing.
+func (p *Proxy) GetMulti(keys []string) map[string]scs.Item {
+	byBackend := make(map[*backend][]string)
+	p.mu.RLock()
+	for _, k := range keys {
+		if b := p.ring.lookup(k); b != nil {
+			byBackend[b] = append(byBackend[b], k)
+		}
+	}
+	p.mu.RUnlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	items := make(map[string]scs.Item, len(keys))
+	for b, keys := range byBackend {
+		wg.Add(1)
+		go func(b *backend, keys []string) {
+			defer wg.Done()
+			var found map[string]*client.Item
+			err := p.call(b, func(ctx context.Context, c *client.Client) (err error) {
+				found, err = c.GetItems(ctx, keys...)
+				return err
+			})
+			if err != nil {
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for k, it := range found {
+				items[k] = scs.Item{Key: k, Value: it.Value, Flags: it.Flags, Cas: it.Cas}
+			}
+		}(b, keys)
+	}
+	wg.Wait()
+	return items
+}
+
+// Peek implements scs.Storage.  Backends can not be read without
+// counting it, so only the key and expiration are filled in, which is
+// all the ttl command needs.
+func (p *Proxy) Peek(key string) (scs.Item, bool) {
+	b := p.pick(key)
+	if b == nil {
+		return scs.Item{}, false
+	}
+
+	var ttl time.Duration
+	err := p.call(b, func(ctx context.Context, c *client.Client) (err error) {
+		ttl, err = c.TTL(ctx, key)
+		return err
+	})
+	if err != nil {
+		return scs.Item{}, false
+	}
+
+	i := scs.Item{Key: key}
+	if ttl > 0 {
+		// The backend rounded up to whole seconds, so aim for the middle
+		// of the last one for ttl to round up to the same number
+		i.Expires = time.Now().Add(ttl - time.Second/2)
+	}
+	return i, true
+}
+
+// Store implements scs.Storage.  The backends do not say what version
+// they give a new item, so it is always 0.  A cas other than 0 is sent
+// as a cas command, whatever the mode.
+func (p *Proxy) Store(mode scs.StoreMode, key string, value []byte, flags uint32, ttl time.Duration, cas uint64) (uint64, scs.Result) {
+	b := p.pick(key)
+	if b == nil {
+		return 0, scs.Unavailable
+	}
+
+	it := &client.Item{Key: key, Value: value, Flags: flags, TTL: ttl, Cas: cas}
+	err := p.call(b, func(ctx context.Context, c *client.Client) error {
+		if cas != 0 {
+			return c.CompareAndSwap(ctx, it)
+		}
+		switch mode {
+		case scs.StoreAdd:
+			return c.Add(ctx, it)
+		case scs.StoreReplace:
+			return c.Replace(ctx, it)
+		case scs.StoreAppend:
+			return c.Append(ctx, it)
+		case scs.StorePrepend:
+			return c.Prepend(ctx, it)
+		}
+		return c.SetItem(ctx, it)
+	})
+	return 0, result(err)
+}
+
+// Delete implements scs.Storage.  The version can not be checked on the
+// backend at the same time, so deletes with a cas are refused as
+// Exists.
+func (p *Proxy) Delete(key string, cas uint64) scs.Result {
+	if cas != 0 {
+		return scs.Exists
+	}
+	b := p.pick(key)
+	if b == nil {
+		return scs.Unavailable
+	}
+
+	return result(p.call(b, func(ctx context.Context, c *client.Client) error {
+		return c.Delete(ctx, key)
+	}))
+}
+
+// Incr implements scs.Storage.  Like Delete, a cas other than 0 is
+// refused as Exists, and like Store, the version is always 0.
+func (p *Proxy) Incr(key string, delta uint64, decr bool, cas uint64) (uint64, uint64, scs.Result) {
+	if cas != 0 {
+		return 0, 0, scs.Exists
+	}
+	b := p.pick(key)
+	if b == nil {
+		return 0, 0, scs.Unavailable
+	}
+
+	var n uint64
+	err := p.call(b, func(ctx context.Context, c *client.Client) (err error) {
+		if decr {
+			n, err = c.Decr(ctx, key, delta)
+		} else {
+			n, err = c.Incr(ctx, key, delta)
+		}
+		return err
+	})
+	return n, 0, result(err)
+}
+
+// Touch implements scs.Storage.
+func (p *Proxy) Touch(key string, ttl time.Duration) scs.Result {
+	b := p.pick(key)
+	if b == nil {
+		return scs.Unavailable
+	}
+
+	return result(p.call(b, func(ctx context.Context, c *client.Client) error {
+		return c.Touch(ctx, key, ttl)
+	}))
+}
+
+// processStats are the stats every scs server adds about its own
+// process and connections.  The proxy's server adds its own, so the
+// backends' are left out.
+var processStats = map[string]bool{
+	"pid":                  true,
+	"uptime":               true,
+	"time":                 true,
+	"version":              true,
+	"rusage_user":          true,
+	"rusage_system":        true,
+	"curr_connections":     true,
+	"total_connections":    true,
+	"bytes_read":           true,
+	"bytes_written":        true,
+	"rejected_connections": true,
+	"throttled_commands":   true,
+}
+
+// Stats implements scs.Storage.  Every backend on the ring is asked at
+// once.  Stats that are numbers on every backend that answered are
+// added up, and the rest are taken from the first one, leaving out the
+// processStats.  They are sorted by name, followed by how many backends
+// there are and how many are ejected.
+func (p *Proxy) Stats() []scs.Stat {
+	p.mu.RLock()
+	var live []*backend
+	for _, b := range p.backends {
+		if !b.ejected {
+			live = append(live, b)
+		}
+	}
+	p.mu.RUnlock()
+
+	replies := make([]map[string]string, len(live))
+	var wg sync.WaitGroup
+	for i, b := range live {
+		wg.Add(1)
+		go func(i int, b *backend) {
+			defer wg.Done()
+			p.call(b, func(ctx context.Context, c *client.Client) (err error) {
+				replies[i], err = c.Stats(ctx)
+				return err
+			})
+		}(i, b)
+	}
+	wg.Wait()
+
+	var names []string
+	values := make(map[string]string)
+	sums := make(map[string]int64)
+	for _, r := range replies {
+		for name, v := range r {
+			if processStats[name] {
+				continue
+			}
+			n, err := strconv.ParseInt(v, 10, 64)
+			sum, summing := sums[name]
+			if _, ok := values[name]; !ok {
+				names = append(names, name)
+				values[name] = v
+				sum, summing = 0, err == nil
+			}
+			if summing && err == nil {
+				sums[name] = sum + n
+			} else {
+				delete(sums, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	st := make([]scs.Stat, 0, len(names)+2)
+	for _, name := range names {
+		v := values[name]
+		if sum, ok := sums[name]; ok {
+			v = strconv.FormatInt(sum, 10)
+		}
+		st = append(st, scs.Stat{Name: name, Value: v})
+	}
+	return append(st,
+		scs.Stat{Name: "backends", Value: strconv.Itoa(len(p.backends))},
+		scs.Stat{Name: "ejected_backends", Value: strconv.Itoa(len(p.backends) - len(live))})
+}
@@ -0,0 +1,185 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"topcoder.com/kyrra/scs/client"
+	"topcoder.com/kyrra/scs/scs"
+)
+
+// startBackend creates an scs server on port of localhost, 0 for any.
+func startBackend(t *testing.T, port int) *scs.Server {
+	t.Helper()
+
+	s, err := scs.NewServer(scs.WithAddr("localhost"), scs.WithPort(port), scs.WithMemcached(true))
+	if err != nil {
+		t.Fatalf("failed to create backend: %v", err)
+	}
+	go s.Serve()
+	return s
+}
+
+// startProxy creates a proxy for addrs served on a random localhost
+// port, and returns a connection to it.
+func startProxy(t *testing.T, addrs []string, opts ...Option) (*Proxy, *scs.Server, net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	p, err := New(addrs, opts...)
+	if err != nil {
+		t.Fatalf("failed to create proxy: %v", err)
+	}
+	s, err := scs.NewServer(scs.WithAddr("localhost"), scs.WithPort(0), scs.WithMemcached(true), scs.WithStorage(p))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	go s.Serve()
+
+	n, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect to proxy: %v", err)
+	}
+	n.SetDeadline(time.Now().Add(5 * time.Second))
+	return p, s, n, bufio.NewReader(n)
+}
+
+// expect writes cmd to the connection and verifies each line
+// read back matches the lines in want.
+func expect(t *testing.T, n net.Conn, b *bufio.Reader, cmd string, want ...string) {
+	t.Helper()
+
+	n.Write([]byte(cmd))
+	for _, w := range want {
+		r, err := b.ReadString('\n')
+		if err != nil {
+			t.Errorf("%q read error: %v", cmd, err)
+			return
+		}
+		if r != w+"\r\n" {
+			t.Errorf("%q expected '%v', got '%v'", cmd, w, r)
+		}
+	}
+}
+
+// TestProxy verifies each key is kept on the backend the ring picks,
+// that a get across backends replies in order, and that stats are
+// added up.
+func TestProxy(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		s := startBackend(t, 0)
+		defer s.Close()
+		addrs = append(addrs, s.Addr().String())
+	}
+	p, s, n, b := startProxy(t, addrs)
+	defer p.Close()
+	defer s.Close()
+
+	get := "get"
+	var want []string
+	for i := 0; i < 20; i++ {
+		k := "k" + strconv.Itoa(i)
+		v := strconv.Itoa(i)
+		expect(t, n, b, "set "+k+" 7 0 "+strconv.Itoa(len(v))+"\r\n"+v+"\r\n", "STORED")
+		get += " " + k + " missing" + k
+		want = append(want, "VALUE "+k+" 7 "+strconv.Itoa(len(v)), v)
+	}
+	expect(t, n, b, get+"\r\n", append(want, "END")...)
+
+	// Every key is on the backend it hashes to and no other
+	ctx := context.Background()
+	for _, addr := range addrs {
+		c := client.New(addr)
+		for i := 0; i < 20; i++ {
+			k := "k" + strconv.Itoa(i)
+			_, err := c.Get(ctx, k)
+			if home := p.pick(k).addr == addr; home != (err == nil) {
+				t.Errorf("%v on %v = %v, but the ring picked %v", k, addr, err, p.pick(k).addr)
+			}
+		}
+		c.Close()
+	}
+
+	expect(t, n, b, "add k1 0 0 1\r\nx\r\n", "NOT_STORED")
+	expect(t, n, b, "incr k5 10\r\n", "15")
+	expect(t, n, b, "incr k5 1 noreply\r\ndecr k5 6\r\n", "10")
+	expect(t, n, b, "incr missing 1\r\n", "NOT_FOUND")
+	expect(t, n, b, "expire k2 100\r\nttl k2\r\n", "TOUCHED", "TTL 100")
+	expect(t, n, b, "persist k2\r\nttl k2\r\n", "PERSISTED", "TTL -1")
+	expect(t, n, b, "delete k3\r\ndelete k3\r\n", "DELETED", "NOT_FOUND")
+	expect(t, n, b, "set big 0 0 9000\r\n"+string(make([]byte, 9000))+"\r\n", "ERROR data can only be 8192 characters long")
+
+	cas := strconv.FormatUint(p.GetMulti([]string{"k4"})["k4"].Cas, 10)
+	expect(t, n, b, "cas k4 0 0 1 "+cas+"\r\nx\r\ncas k4 0 0 1 "+cas+"\r\ny\r\n", "STORED", "EXISTS")
+
+	stats := make(map[string]string)
+	for _, st := range p.Stats() {
+		stats[st.Name] = st.Value
+	}
+	if stats["cmd_set"] != "21" || stats["curr_items"] != "19" || stats["limit_items"] != "196605" ||
+		stats["role"] != "primary" || stats["backends"] != "3" || stats["ejected_backends"] != "0" ||
+		stats["pid"] != "" {
+		t.Errorf("stats = %v", stats)
+	}
+}
+
+// TestProxyEject verifies a backend that stops answering is taken off
+// the ring, its keys go to the others, and it is put back once it
+// answers again.
+func TestProxyEject(t *testing.T) {
+	live := startBackend(t, 0)
+	defer live.Close()
+
+	// Find a free port for the backend that starts out down
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	p, s, n, b := startProxy(t, []string{live.Addr().String(), down},
+		WithEjectAfter(2), WithCheckInterval(10*time.Millisecond), WithTimeout(time.Second))
+	defer p.Close()
+	defer s.Close()
+
+	key := ""
+	for i := 0; key == ""; i++ {
+		if k := "k" + strconv.Itoa(i); p.pick(k).addr == down {
+			key = k
+		}
+	}
+
+	expect(t, n, b, "set "+key+"\r\nv\r\n", "ERROR storage unavailable")
+	expect(t, n, b, "get "+key+"\r\n", "END")
+	expect(t, n, b, "set "+key+"\r\nv\r\n", "STORED")
+	if p.pick(key).addr == down {
+		t.Errorf("%v is still picked after it failed twice", down)
+	}
+	stats := make(map[string]string)
+	for _, st := range p.Stats() {
+		stats[st.Name] = st.Value
+	}
+	if stats["backends"] != "2" || stats["ejected_backends"] != "1" || stats["curr_items"] != "1" {
+		t.Errorf("stats with a backend down = %v", stats)
+	}
+
+	back := startBackend(t, port)
+	defer back.Close()
+	for end := time.Now().Add(5 * time.Second); p.pick(key).addr != down; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(end) {
+			t.Fatalf("%v was never readmitted", down)
+		}
+	}
+	// The key is home again, where it was never stored
+	expect(t, n, b, "get "+key+"\r\n", "END")
+}
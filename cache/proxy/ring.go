@@ -0,0 +1,59 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// ring is a consistent hash ring.  Every backend is placed on it at
+// vnodes points, and a key belongs to the backend of the first point at
+// or after its hash.  Taking a backend off the ring only moves the keys
+// that were on it, spread over the others, and putting it back moves
+// the same keys home again.
+type ring struct {
+	points []point
+}
+
+// point is a single virtual node of a backend.
+type point struct {
+	hash uint32
+	b    *backend
+}
+
+// newRing places each of backends on a ring at vnodes points.
+func newRing(backends []*backend, vnodes int) *ring {
+	r := &ring{points: make([]point, 0, len(backends)*vnodes)}
+	for _, b := range backends {
+		for i := 0; i < vnodes; i++ {
+			h := crc32.ChecksumIEEE([]byte(b.addr + "-" + strconv.Itoa(i)))
+			r.points = append(r.points, point{h, b})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		// Break ties by address so every proxy builds the same ring
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].b.addr < r.points[j].b.addr
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+// lookup returns the backend key belongs to, or nil if the ring is
+// empty.
+func (r *ring) lookup(key string) *backend {
+	if len(r.points) == 0 {
+		return nil
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].b
+}
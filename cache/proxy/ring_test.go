@@ -0,0 +1,50 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"strconv"
+	"testing"
+)
+
+// TestRing verifies keys are spread evenly, and that taking a backend
+// off the ring only moves the keys that were on it.
+func TestRing(t *testing.T) {
+	backends := []*backend{{addr: "10.0.0.1:11212"}, {addr: "10.0.0.2:11212"}, {addr: "10.0.0.3:11212"}}
+	r := newRing(backends, DefaultVirtualNodes)
+	if len(r.points) != 3*DefaultVirtualNodes {
+		t.Errorf("got %v points, wanted %v", len(r.points), 3*DefaultVirtualNodes)
+	}
+
+	const keys = 30000
+	counts := make(map[*backend]int)
+	before := make(map[string]*backend)
+	for i := 0; i < keys; i++ {
+		k := "key" + strconv.Itoa(i)
+		b := r.lookup(k)
+		counts[b]++
+		before[k] = b
+	}
+	for _, b := range backends {
+		if counts[b] < keys/5 || counts[b] > keys/2 {
+			t.Errorf("%v got %v of %v keys", b.addr, counts[b], keys)
+		}
+	}
+
+	r = newRing(backends[:2], DefaultVirtualNodes)
+	for k, old := range before {
+		b := r.lookup(k)
+		if old != backends[2] && b != old {
+			t.Errorf("%v moved from %v to %v", k, old.addr, b.addr)
+		}
+		if b == backends[2] {
+			t.Errorf("%v is still on the removed backend", k)
+		}
+	}
+
+	if b := newRing(nil, DefaultVirtualNodes).lookup("sushi"); b != nil {
+		t.Errorf("empty ring returned %v", b.addr)
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import "bitbucket.org/kyrra/sandbox/auth"
+
+// loadUsers reads the users allowed to use the cache from path, a JSON
+// file of domains and their users as the auth package reads them.  The
+// auth package keeps watching the file for changes.
+func loadUsers(path string) (*auth.Datastore, error) {
+	users := &auth.Datastore{}
+	err := users.Init(path)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// validUser reports if the plain text password is right for username in
+// domain.  It is always hashed first, so the stored hash itself never
+// works as a password.
+func validUser(users *auth.Datastore, domain, username, password string) bool {
+	return users.UserPasswordValid(domain, username, auth.EncryptPassword(password))
+}
+
+// cmdAuth takes a domain, a username and a password, and lets the
+// connection run every other command once they are valid.  Until then
+// only auth and quit are allowed.
+func cmdAuth(c *Request) {
+	if len(c.Subcmd) != 3 {
+		c.WriteStr("ERROR auth command requires a domain, a username and a password")
+		return
+	}
+	if c.users == nil {
+		c.WriteStr("ERROR authentication is not enabled")
+		return
+	}
+
+	if !validUser(c.users, c.Subcmd[0], c.Subcmd[1], c.Subcmd[2]) {
+		c.authed = false
+		c.WriteStr("ERROR authentication failed")
+		return
+	}
+	c.authed = true
+	c.WriteStr("AUTHENTICATED")
+}
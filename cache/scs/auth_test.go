@@ -0,0 +1,79 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testUsers = `[
+  {"domain": "topcoder.com", "users": [{"username": "takumi", "password": "ilovego"}]},
+  {"domain": "appirio.com", "users": [{"username": "jun", "password": "ilovetopcoder"}]}
+]`
+
+// TestAuth verifies only auth and quit are allowed until a connection
+// gives a valid domain, username and password, and that the user file
+// is read again when it changes.
+func TestAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.json")
+	ioutil.WriteFile(path, []byte(testUsers), 0600)
+
+	if _, err := NewServer(testOptions(WithAuth(path), WithBinaryPort(0))...); err == nil {
+		t.Errorf("NewServer with auth and the binary protocol succeeded")
+	}
+	if _, err := NewServer(testOptions(WithAuth(filepath.Join(dir, "missing.json")))...); err == nil {
+		t.Errorf("NewServer with a missing user file succeeded")
+	}
+	dup := filepath.Join(dir, "dup.json")
+	ioutil.WriteFile(dup, []byte(`[{"domain": "a", "users": [{"username": "u"}, {"username": "u"}]}]`), 0600)
+	if _, err := NewServer(testOptions(WithAuth(dup))...); err == nil {
+		t.Errorf("NewServer with a duplicate user succeeded")
+	}
+
+	s, err := NewServer(testOptions(WithAuth(path))...)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer s.Close()
+	go s.Serve()
+	n, b := dial(t, s)
+
+	expect(t, n, b, "get sushi\r\n", "ERROR authentication required")
+	expect(t, n, b, "auth topcoder.com takumi\r\n", "ERROR auth command requires a domain, a username and a password")
+	expect(t, n, b, "auth topcoder.com takumi ilovejava\r\n", "ERROR authentication failed")
+	expect(t, n, b, "auth appirio.com takumi ilovego\r\n", "ERROR authentication failed")
+	expect(t, n, b, "auth topcoder.com takumi ilovego\r\n", "AUTHENTICATED")
+	expect(t, n, b, "set sushi\r\ndelicious\r\nget sushi\r\n", "STORED", "VALUE sushi", "delicious", "END")
+
+	// The stored hash is not a password
+	n2, b2 := dial(t, s)
+	expect(t, n2, b2, "auth topcoder.com takumi {SHA256}2QJwb00iyNaZbsEbjYHUTTLyvRwkJZTt8yrj4qHWBTU=\r\n", "ERROR authentication failed")
+	expect(t, n2, b2, "get sushi\r\n", "ERROR authentication required")
+
+	ioutil.WriteFile(path, []byte(`[{"domain": "topcoder.com", "users": [{"username": "teru", "password": "ilovejava"}]}]`), 0600)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(path, future, future)
+	for end := time.Now().Add(5 * time.Second); !validUser(s.auth, "topcoder.com", "teru", "ilovejava"); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(end) {
+			t.Fatalf("changed user file was never loaded")
+		}
+	}
+	n3, b3 := dial(t, s)
+	expect(t, n3, b3, "auth topcoder.com takumi ilovego\r\n", "ERROR authentication failed")
+	expect(t, n3, b3, "auth topcoder.com teru ilovejava\r\n", "AUTHENTICATED")
+	expect(t, n3, b3, "quit\r\n")
+	if _, err := b3.ReadByte(); err == nil {
+		t.Errorf("quit fail, expected connection to close")
+	}
+}
@@ -0,0 +1,484 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Magic bytes and header size of the memcached binary protocol.
+const (
+	binRequest   = 0x80
+	binResponse  = 0x81
+	binHeaderLen = 24
+	// binMaxBody is the largest packet body read from a client, which
+	// leaves room to tell clients their value is too large rather than
+	// disconnecting them.
+	binMaxBody = 1024 * 1024
+)
+
+// Opcodes of the memcached binary protocol.  The quiet (Q) versions
+// only reply on errors, or for get on hits.
+const (
+	binGet      = 0x00
+	binSet      = 0x01
+	binAdd      = 0x02
+	binReplace  = 0x03
+	binDelete   = 0x04
+	binIncr     = 0x05
+	binDecr     = 0x06
+	binQuit     = 0x07
+	binGetQ     = 0x09
+	binNoop     = 0x0a
+	binVersion  = 0x0b
+	binGetK     = 0x0c
+	binGetKQ    = 0x0d
+	binAppend   = 0x0e
+	binPrepend  = 0x0f
+	binStat     = 0x10
+	binSetQ     = 0x11
+	binAddQ     = 0x12
+	binReplaceQ = 0x13
+	binDeleteQ  = 0x14
+	binIncrQ    = 0x15
+	binDecrQ    = 0x16
+	binQuitQ    = 0x17
+	binAppendQ  = 0x19
+	binPrependQ = 0x1a
+)
+
+// Response statuses of the memcached binary protocol.
+const (
+	binOK         = 0x0000
+	binNotFound   = 0x0001
+	binExists     = 0x0002
+	binTooLarge   = 0x0003
+	binInvalid    = 0x0004
+	binNotStored  = 0x0005
+	binNonNumeric = 0x0006
+	binUnknown    = 0x0081
+	binNoMemory   = 0x0082
+	binTempFail   = 0x0086
+)
+
+// binNoCreate is the incr/decr expiration that means a missing key
+// should not be created.
+const binNoCreate = 0xffffffff
+
+// binHeader is the header at the start of every binary protocol packet.
+// status is the vbucket id in requests, which is ignored.
+type binHeader struct {
+	magic    byte
+	opcode   byte
+	keyLen   uint16
+	extLen   uint8
+	dataType uint8
+	status   uint16
+	bodyLen  uint32
+	opaque   uint32
+	cas      uint64
+}
+
+// binRequestPacket is a request read from a binary protocol client.
+type binRequestPacket struct {
+	binHeader
+	extras []byte
+	key    string
+	value  []byte
+}
+
+// binConn is a single client connection speaking the binary protocol.
+// Replies are buffered and only flushed once every request the client
+// has sent so far is handled, so quiet requests batch together.
+type binConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	st   Storage
+	m    *metrics
+	ss   *serverStats
+	cs   *connStats
+	t    timeouts
+}
+
+// listenBinary opens a second listener that speaks the memcached binary
+// protocol on port.  Both listeners share the same cache and stats.  It
+// must be called before Serve.
+func (s *Server) listenBinary(addr string, port int) error {
+	l, err := s.listen("binary", addr, port)
+	if err != nil {
+		return err
+	}
+	s.bl = l
+	for _, cmd := range binCmdNames {
+		s.metrics.track("binary", cmd)
+	}
+	return nil
+}
+
+// serveBinary accepts connections on the binary protocol listener and
+// passes each one to its own goroutine.
+func (s *Server) serveBinary() {
+	for {
+		conn, err := s.bl.Accept()
+		if err != nil {
+			return
+		}
+		b := &binConn{conn, bufio.NewReader(conn), bufio.NewWriter(conn), s.st, s.metrics, s.stats, nil, s.timeouts}
+		go b.handle()
+	}
+}
+
+// handle reads requests from the client and replies to them until
+// the client quits or sends something that is not a request.
+func (b *binConn) handle() {
+	defer b.conn.Close()
+	var err error
+	b.cs, err = b.ss.open("binary", b.conn)
+	if err != nil {
+		return
+	}
+	defer b.ss.close(b.cs)
+
+	_, err = identify(b.conn)
+	if err != nil {
+		return
+	}
+
+	for {
+		if b.r.Buffered() == 0 {
+			if b.w.Flush() != nil {
+				return
+			}
+		}
+
+		b.t.waiting(b.conn, false)
+		p, err := b.read()
+		if err != nil || !b.cs.begin() {
+			return
+		}
+		if !b.ss.allow(b.cs) {
+			b.replyError(p, binTempFail, "rate limited")
+		} else if !b.dispatch(p) {
+			b.w.Flush()
+			return
+		}
+		if !b.cs.end() {
+			b.w.Flush()
+			return
+		}
+	}
+}
+
+// read reads a single request packet.
+func (b *binConn) read() (*binRequestPacket, error) {
+	var hdr [binHeaderLen]byte
+	_, err := io.ReadFull(b.r, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	// The rest of the packet is under the read timeout, not the idle one
+	b.t.running(b.conn)
+
+	p := &binRequestPacket{}
+	p.magic = hdr[0]
+	p.opcode = hdr[1]
+	p.keyLen = binary.BigEndian.Uint16(hdr[2:])
+	p.extLen = hdr[4]
+	p.dataType = hdr[5]
+	p.status = binary.BigEndian.Uint16(hdr[6:])
+	p.bodyLen = binary.BigEndian.Uint32(hdr[8:])
+	p.opaque = binary.BigEndian.Uint32(hdr[12:])
+	p.cas = binary.BigEndian.Uint64(hdr[16:])
+
+	if p.magic != binRequest {
+		return nil, fmt.Errorf("bad magic %#x", p.magic)
+	}
+	if p.bodyLen > binMaxBody || uint32(p.keyLen)+uint32(p.extLen) > p.bodyLen {
+		return nil, fmt.Errorf("bad body length %v", p.bodyLen)
+	}
+
+	body := make([]byte, p.bodyLen)
+	_, err = io.ReadFull(b.r, body)
+	if err != nil {
+		return nil, err
+	}
+	p.extras = body[:p.extLen]
+	p.key = string(body[p.extLen : uint32(p.extLen)+uint32(p.keyLen)])
+	p.value = body[uint32(p.extLen)+uint32(p.keyLen):]
+	return p, nil
+}
+
+// reply writes a response packet to p back to the client.  cas is the
+// version of the item the request read or stored, if any.
+func (b *binConn) reply(p *binRequestPacket, status uint16, cas uint64, extras []byte, key string, value []byte) {
+	var hdr [binHeaderLen]byte
+	hdr[0] = binResponse
+	hdr[1] = p.opcode
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(key)))
+	hdr[4] = uint8(len(extras))
+	binary.BigEndian.PutUint16(hdr[6:], status)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(hdr[12:], p.opaque)
+	binary.BigEndian.PutUint64(hdr[16:], cas)
+
+	b.w.Write(hdr[:])
+	b.w.Write(extras)
+	b.w.WriteString(key)
+	b.w.Write(value)
+}
+
+// replyError writes a response with an error status and a message
+// describing it.
+func (b *binConn) replyError(p *binRequestPacket, status uint16, msg string) {
+	b.reply(p, status, 0, nil, "", []byte(msg))
+}
+
+// dispatch handles a single request.  Returns false once the
+// connection should be closed.
+func (b *binConn) dispatch(p *binRequestPacket) bool {
+	defer b.m.observe("binary", binCmdNames[p.opcode], time.Now())
+	b.cs.command(binCmdNames[p.opcode])
+	switch p.opcode {
+	case binGet, binGetQ, binGetK, binGetKQ:
+		b.get(p)
+	case binSet, binSetQ:
+		b.store(p, StoreSet)
+	case binAdd, binAddQ:
+		b.store(p, StoreAdd)
+	case binReplace, binReplaceQ:
+		b.store(p, StoreReplace)
+	case binAppend, binAppendQ:
+		b.store(p, StoreAppend)
+	case binPrepend, binPrependQ:
+		b.store(p, StorePrepend)
+	case binDelete, binDeleteQ:
+		b.delete(p)
+	case binIncr, binIncrQ, binDecr, binDecrQ:
+		b.incr(p)
+	case binStat:
+		b.stat(p)
+	case binNoop:
+		b.reply(p, binOK, 0, nil, "", nil)
+	case binVersion:
+		b.reply(p, binOK, 0, nil, "", []byte("scs"))
+	case binQuit:
+		b.reply(p, binOK, 0, nil, "", nil)
+		return false
+	case binQuitQ:
+		return false
+	default:
+		b.replyError(p, binUnknown, "Unknown command")
+	}
+	return true
+}
+
+// quiet reports if the request only wants a reply on errors.
+func (p *binRequestPacket) quiet() bool {
+	switch p.opcode {
+	case binGetQ, binGetKQ, binSetQ, binAddQ, binReplaceQ, binAppendQ,
+		binPrependQ, binDeleteQ, binIncrQ, binDecrQ, binQuitQ:
+		return true
+	}
+	return false
+}
+
+// validKey checks the request has a key short enough to be stored.
+func (b *binConn) validKey(p *binRequestPacket) bool {
+	if len(p.key) == 0 || len(p.key) >= MAX_KEY_SIZE {
+		b.replyError(p, binInvalid, "Invalid arguments")
+		return false
+	}
+	return true
+}
+
+// get handles the get family of requests, which reply with the item's
+// flags as extras and, for GetK, its key.
+func (b *binConn) get(p *binRequestPacket) {
+	if len(p.extras) != 0 || len(p.value) != 0 {
+		b.replyError(p, binInvalid, "Invalid arguments")
+		return
+	}
+	if !b.validKey(p) {
+		return
+	}
+
+	key := ""
+	if p.opcode == binGetK || p.opcode == binGetKQ {
+		key = p.key
+	}
+
+	i, ok := b.st.Get(p.key)
+	if !ok {
+		if !p.quiet() {
+			b.reply(p, binNotFound, 0, nil, key, []byte("Not found"))
+		}
+		return
+	}
+
+	var flags [4]byte
+	binary.BigEndian.PutUint32(flags[:], i.Flags)
+	b.reply(p, binOK, i.Cas, flags[:], key, i.Value)
+}
+
+// store handles the set family of requests.  Set, add and replace take
+// the flags and expiration as extras, append and prepend take none.
+func (b *binConn) store(p *binRequestPacket, mode StoreMode) {
+	var flags uint32
+	var ttl time.Duration
+	if mode == StoreAppend || mode == StorePrepend {
+		if len(p.extras) != 0 {
+			b.replyError(p, binInvalid, "Invalid arguments")
+			return
+		}
+	} else {
+		if len(p.extras) != 8 {
+			b.replyError(p, binInvalid, "Invalid arguments")
+			return
+		}
+		flags = binary.BigEndian.Uint32(p.extras)
+		exptime := binary.BigEndian.Uint32(p.extras[4:])
+		ttl = exptimeTTL(int64(exptime), time.Now())
+	}
+	if !b.validKey(p) {
+		return
+	}
+	if len(p.value) >= MAX_DATA_SIZE {
+		b.replyError(p, binTooLarge, "Too large")
+		return
+	}
+
+	cas, res := b.st.Store(mode, p.key, p.value, flags, ttl, p.cas)
+	switch res {
+	case OK:
+		if !p.quiet() {
+			b.reply(p, binOK, cas, nil, "", nil)
+		}
+	case NotFound:
+		b.replyError(p, binNotFound, "Not found")
+	case Exists:
+		b.replyError(p, binExists, "Data exists for key")
+	case NotStored:
+		if mode == StoreAdd {
+			b.replyError(p, binExists, "Data exists for key")
+		} else {
+			b.replyError(p, binNotStored, "Not stored")
+		}
+	case TooLarge:
+		b.replyError(p, binTooLarge, "Too large")
+	case OverMemory, CacheFull:
+		b.replyError(p, binNoMemory, "Out of memory")
+	case ReadOnly:
+		b.replyError(p, binNotStored, "Read only replica")
+	case Unavailable:
+		b.replyError(p, binTempFail, "Temporary failure")
+	}
+}
+
+// delete handles delete requests, which only delete an item with the
+// version in cas if it is not 0.
+func (b *binConn) delete(p *binRequestPacket) {
+	if len(p.extras) != 0 || len(p.value) != 0 {
+		b.replyError(p, binInvalid, "Invalid arguments")
+		return
+	}
+	if !b.validKey(p) {
+		return
+	}
+
+	switch b.st.Delete(p.key, p.cas) {
+	case NotFound:
+		b.replyError(p, binNotFound, "Not found")
+		return
+	case Exists:
+		b.replyError(p, binExists, "Data exists for key")
+		return
+	case ReadOnly:
+		b.replyError(p, binNotStored, "Read only replica")
+		return
+	case Unavailable:
+		b.replyError(p, binTempFail, "Temporary failure")
+		return
+	}
+
+	if !p.quiet() {
+		b.reply(p, binOK, 0, nil, "", nil)
+	}
+}
+
+// incr handles incr and decr requests.  The extras hold the delta, the
+// initial value to create a missing key with, and its expiration, or
+// binNoCreate to leave a missing key missing.  The new value is sent
+// back as a 64 bit number.  A cas other than 0 must match the version
+// of the item.
+func (b *binConn) incr(p *binRequestPacket) {
+	if len(p.extras) != 20 || len(p.value) != 0 {
+		b.replyError(p, binInvalid, "Invalid arguments")
+		return
+	}
+	if !b.validKey(p) {
+		return
+	}
+	delta := binary.BigEndian.Uint64(p.extras)
+	initial := binary.BigEndian.Uint64(p.extras[8:])
+	exptime := binary.BigEndian.Uint32(p.extras[16:])
+	decr := p.opcode == binDecr || p.opcode == binDecrQ
+
+	n, cas, res := b.st.Incr(p.key, delta, decr, p.cas)
+	if res == NotFound && p.cas == 0 && exptime != binNoCreate {
+		data := []byte(strconv.FormatUint(initial, 10))
+		ttl := exptimeTTL(int64(exptime), time.Now())
+		cas, res = b.st.Store(StoreAdd, p.key, data, 0, ttl, 0)
+		if res == NotStored {
+			// Another client created it first, so change theirs
+			n, cas, res = b.st.Incr(p.key, delta, decr, 0)
+		} else {
+			n = initial
+		}
+	}
+
+	switch res {
+	case OK:
+		if !p.quiet() {
+			var v [8]byte
+			binary.BigEndian.PutUint64(v[:], n)
+			b.reply(p, binOK, cas, nil, "", v[:])
+		}
+	case NotFound:
+		b.replyError(p, binNotFound, "Not found")
+	case Exists:
+		b.replyError(p, binExists, "Data exists for key")
+	case NonNumeric:
+		b.replyError(p, binNonNumeric, "Non-numeric server-side value for incr or decr")
+	case CacheFull:
+		b.replyError(p, binNoMemory, "Out of memory")
+	case ReadOnly:
+		b.replyError(p, binNotStored, "Read only replica")
+	case Unavailable:
+		b.replyError(p, binTempFail, "Temporary failure")
+	default:
+		b.replyError(p, binNoMemory, "Out of memory")
+	}
+}
+
+// stat handles stat requests, which reply with a packet per statistic
+// and end with a packet that has no key.
+func (b *binConn) stat(p *binRequestPacket) {
+	if len(p.key) != 0 {
+		b.replyError(p, binNotFound, "Unknown stats group")
+		return
+	}
+
+	for _, st := range b.st.Stats() {
+		b.reply(p, binOK, 0, nil, st.Name, []byte(st.Value))
+	}
+	b.reply(p, binOK, 0, nil, "", nil)
+}
@@ -0,0 +1,208 @@
+package scs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// binPacket builds a binary protocol request.
+func binPacket(op byte, opaque uint32, extras []byte, key, value string) []byte {
+	p := make([]byte, binHeaderLen)
+	p[0] = binRequest
+	p[1] = op
+	binary.BigEndian.PutUint16(p[2:], uint16(len(key)))
+	p[4] = uint8(len(extras))
+	binary.BigEndian.PutUint32(p[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(p[12:], opaque)
+	p = append(p, extras...)
+	p = append(p, key...)
+	return append(p, value...)
+}
+
+// binResp is a response read back from the server.
+type binResp struct {
+	op     byte
+	status uint16
+	opaque uint32
+	cas    uint64
+	extras []byte
+	key    string
+	value  string
+}
+
+// readBin reads a single binary protocol response.
+func readBin(t *testing.T, r *bufio.Reader) binResp {
+	t.Helper()
+
+	hdr := make([]byte, binHeaderLen)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		t.Fatalf("reading response header: %v", err)
+	}
+	if hdr[0] != binResponse {
+		t.Fatalf("response magic = %#x", hdr[0])
+	}
+	keyLen := int(binary.BigEndian.Uint16(hdr[2:]))
+	extLen := int(hdr[4])
+	body := make([]byte, binary.BigEndian.Uint32(hdr[8:]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		t.Fatalf("reading response body: %v", err)
+	}
+	return binResp{
+		op:     hdr[1],
+		status: binary.BigEndian.Uint16(hdr[6:]),
+		opaque: binary.BigEndian.Uint32(hdr[12:]),
+		cas:    binary.BigEndian.Uint64(hdr[16:]),
+		extras: body[:extLen],
+		key:    string(body[extLen : extLen+keyLen]),
+		value:  string(body[extLen+keyLen:]),
+	}
+}
+
+// setExtras builds the extras for a set request.
+func setExtras(flags, exptime uint32) []byte {
+	e := make([]byte, 8)
+	binary.BigEndian.PutUint32(e, flags)
+	binary.BigEndian.PutUint32(e[4:], exptime)
+	return e
+}
+
+// incrExtras builds the extras for an incr or decr request.
+func incrExtras(delta, initial uint64, exptime uint32) []byte {
+	e := make([]byte, 20)
+	binary.BigEndian.PutUint64(e, delta)
+	binary.BigEndian.PutUint64(e[8:], initial)
+	binary.BigEndian.PutUint32(e[16:], exptime)
+	return e
+}
+
+// TestBinaryProtocol runs requests over the binary protocol and
+// verifies they share the cache with the text protocol.
+func TestBinaryProtocol(t *testing.T) {
+	s, err := NewServer(testOptions(WithBinaryPort(0))...)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	bn, err := net.Dial("tcp", s.bl.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect to server: %v", err)
+	}
+	bn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(bn)
+
+	bn.Write(binPacket(binSet, 1, setExtras(7, 0), "sushi", "deli\r\ncious"))
+	if r := readBin(t, br); r.op != binSet || r.status != binOK || r.opaque != 1 {
+		t.Errorf("set = %+v", r)
+	}
+
+	// the text protocol sees the same data
+	n, b := dial(t, s)
+	expect(t, n, b, "get sushi\r\n", "VALUE sushi", "deli", "cious", "END")
+	expect(t, n, b, "set topcoder\r\nfun\r\n", "STORED")
+
+	bn.Write(binPacket(binGetK, 2, nil, "topcoder", ""))
+	if r := readBin(t, br); r.status != binOK || r.key != "topcoder" || r.value != "fun" || r.opaque != 2 {
+		t.Errorf("getk = %+v", r)
+	}
+	bn.Write(binPacket(binGet, 3, nil, "sushi", ""))
+	r := readBin(t, br)
+	if r.status != binOK || r.key != "" || r.value != "deli\r\ncious" || binary.BigEndian.Uint32(r.extras) != 7 {
+		t.Errorf("get = %+v", r)
+	}
+	// cas only stores while the version is unchanged
+	set := binPacket(binSet, 30, setExtras(0, 0), "sushi", "deli\r\ncious")
+	binary.BigEndian.PutUint64(set[16:], r.cas)
+	bn.Write(set)
+	r = readBin(t, br)
+	if r.status != binOK || r.cas == 0 {
+		t.Errorf("set cas = %+v", r)
+	}
+	bn.Write(set)
+	if r := readBin(t, br); r.status != binExists {
+		t.Errorf("set old cas = %+v", r)
+	}
+
+	bn.Write(binPacket(binGet, 4, nil, "missing", ""))
+	if r := readBin(t, br); r.status != binNotFound || r.opaque != 4 {
+		t.Errorf("get missing = %+v", r)
+	}
+
+	// quiet requests only reply on hits and errors, noop flushes them
+	bn.Write(binPacket(binGetQ, 5, nil, "missing", ""))
+	bn.Write(binPacket(binSetQ, 6, setExtras(0, 0), "quiet", "1"))
+	bn.Write(binPacket(binAddQ, 7, setExtras(0, 0), "quiet", "2"))
+	bn.Write(binPacket(binGetKQ, 8, nil, "quiet", ""))
+	bn.Write(binPacket(binNoop, 9, nil, "", ""))
+	if r := readBin(t, br); r.status != binExists || r.opaque != 7 {
+		t.Errorf("addq existing = %+v", r)
+	}
+	if r := readBin(t, br); r.status != binOK || r.opaque != 8 || r.value != "1" {
+		t.Errorf("getkq = %+v", r)
+	}
+	if r := readBin(t, br); r.op != binNoop || r.opaque != 9 {
+		t.Errorf("noop = %+v", r)
+	}
+
+	bn.Write(binPacket(binIncr, 10, incrExtras(5, 0, 0), "quiet", ""))
+	if r := readBin(t, br); r.status != binOK || binary.BigEndian.Uint64([]byte(r.value)) != 6 {
+		t.Errorf("incr = %+v", r)
+	}
+	bn.Write(binPacket(binDecr, 11, incrExtras(10, 0, 0), "quiet", ""))
+	if r := readBin(t, br); r.status != binOK || binary.BigEndian.Uint64([]byte(r.value)) != 0 {
+		t.Errorf("decr = %+v", r)
+	}
+	bn.Write(binPacket(binIncr, 12, incrExtras(1, 42, 0), "counter", ""))
+	if r := readBin(t, br); r.status != binOK || binary.BigEndian.Uint64([]byte(r.value)) != 42 {
+		t.Errorf("incr create = %+v", r)
+	}
+	bn.Write(binPacket(binIncr, 13, incrExtras(1, 0, binNoCreate), "nocounter", ""))
+	if r := readBin(t, br); r.status != binNotFound {
+		t.Errorf("incr no create = %+v", r)
+	}
+	bn.Write(binPacket(binIncr, 14, incrExtras(1, 0, 0), "sushi", ""))
+	if r := readBin(t, br); r.status != binNonNumeric {
+		t.Errorf("incr non-numeric = %+v", r)
+	}
+
+	bn.Write(binPacket(binDelete, 15, nil, "sushi", ""))
+	if r := readBin(t, br); r.status != binOK {
+		t.Errorf("delete = %+v", r)
+	}
+	bn.Write(binPacket(binDelete, 16, nil, "sushi", ""))
+	if r := readBin(t, br); r.status != binNotFound {
+		t.Errorf("delete missing = %+v", r)
+	}
+	bn.Write(binPacket(0x50, 17, nil, "", ""))
+	if r := readBin(t, br); r.status != binUnknown {
+		t.Errorf("unknown = %+v", r)
+	}
+
+	bn.Write(binPacket(binStat, 18, nil, "", ""))
+	stats := make(map[string]string)
+	for {
+		r := readBin(t, br)
+		if r.key == "" {
+			break
+		}
+		stats[r.key] = r.value
+	}
+	if stats["cmd_get"] != "6" || stats["get_hits"] != "4" || stats["delete_hits"] != "1" {
+		t.Errorf("stats = %v", stats)
+	}
+
+	bn.Write(binPacket(binQuit, 19, nil, "", ""))
+	if r := readBin(t, br); r.op != binQuit {
+		t.Errorf("quit = %+v", r)
+	}
+	if _, err := br.ReadByte(); err == nil {
+		t.Errorf("quit fail, expected connection to close")
+	}
+}
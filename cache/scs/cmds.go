@@ -0,0 +1,547 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// The messages of the ERROR replies for each Result that is an error,
+// so programs reading the replies, like the proxy, can tell them apart.
+// MsgTooLarge is only the start of its message, which goes on to give
+// MAX_DATA_SIZE.
+const (
+	MsgTooLarge    = "data can only be"
+	MsgOverMemory  = "data is larger than the memory limit"
+	MsgCacheFull   = "cache is full"
+	MsgNonNumeric  = "cannot increment or decrement non-numeric value"
+	MsgReadOnly    = "replica is read only"
+	MsgUnavailable = "storage unavailable"
+)
+
+// The ERROR replies for each Result that is an error.
+const (
+	errOverMemory  = "ERROR " + MsgOverMemory
+	errCacheFull   = "ERROR " + MsgCacheFull
+	errNonNumeric  = "ERROR " + MsgNonNumeric
+	errReadOnly    = "ERROR " + MsgReadOnly
+	errUnavailable = "ERROR " + MsgUnavailable
+)
+
+var errTooLarge = fmt.Sprintf("ERROR %v %v characters long", MsgTooLarge, MAX_DATA_SIZE)
+
+// maxRelativeExptime is the largest memcached exptime that is a number
+// of seconds, anything larger is a unix timestamp.
+const maxRelativeExptime = 60 * 60 * 24 * 30
+
+// storageRequest is a parsed set family command and its data.
+type storageRequest struct {
+	key     string
+	flags   uint32
+	ttl     time.Duration // negative for a memcached exptime in the past
+	data    []byte
+	noreply bool
+}
+
+// cmdSet stores data at a key.
+func cmdSet(c *Request) {
+	storeCmd(c, StoreSet, 0)
+}
+
+// cmdAdd stores data at a key only if the key is not in the cache.
+func cmdAdd(c *Request) {
+	storeCmd(c, StoreAdd, 0)
+}
+
+// cmdReplace stores data at a key only if the key is already in the cache.
+func cmdReplace(c *Request) {
+	storeCmd(c, StoreReplace, 0)
+}
+
+// cmdAppend adds data to the end of a key already in the cache.
+func cmdAppend(c *Request) {
+	storeCmd(c, StoreAppend, 0)
+}
+
+// cmdPrepend adds data to the start of a key already in the cache.
+func cmdPrepend(c *Request) {
+	storeCmd(c, StorePrepend, 0)
+}
+
+// cmdCas stores data at a key only if it has not been stored again
+// since the client read its version with gets.  It takes a key, the
+// version and an optional ttl, or the memcached form of
+// <key> <flags> <exptime> <bytes> <version> [noreply].
+func cmdCas(c *Request) {
+	n := len(c.Subcmd)
+	v := 1
+	switch {
+	case n == 2 || n == 3:
+	case n == 5 || (n == 6 && c.Subcmd[5] == "noreply"):
+		v = 4
+	default:
+		c.WriteStr("ERROR cas command requires a key, a version and an optional ttl, or <key> <flags> <exptime> <bytes> <version> [noreply]")
+		return
+	}
+
+	version, err := strconv.ParseUint(c.Subcmd[v], 10, 64)
+	if err != nil || version == 0 {
+		c.WriteStr("ERROR version must be a positive 64 bit number")
+		return
+	}
+
+	// Without the version the rest is the same as set
+	c.Subcmd = append(c.Subcmd[:v:v], c.Subcmd[v+1:]...)
+	storeCmd(c, StoreSet, version)
+}
+
+// storeCmd handles the set family of commands.  They take either a
+// single key and an optional ttl in seconds, or the memcached form of
+// <key> <flags> <exptime> <bytes> [noreply], then will read one more
+// line from the connection and store the data in the cache.  A cas other
+// than 0 is the version the item must still have for it to be stored.
+func storeCmd(c *Request, mode StoreMode, cas uint64) {
+	r, ok := parseStorage(c)
+	if !ok {
+		return
+	}
+	reply := func(s string) {
+		if !r.noreply {
+			c.WriteStr(s)
+		}
+	}
+
+	_, res := c.Storage.Store(mode, r.key, r.data, r.flags, r.ttl, cas)
+	switch res {
+	case OK:
+		reply("STORED")
+	case NotStored:
+		reply("NOT_STORED")
+	case NotFound:
+		reply("NOT_FOUND")
+	case Exists:
+		reply("EXISTS")
+	case TooLarge:
+		reply(errTooLarge)
+	case OverMemory:
+		reply(errOverMemory)
+	case CacheFull:
+		reply(errCacheFull)
+	case ReadOnly:
+		reply(errReadOnly)
+	case Unavailable:
+		reply(errUnavailable)
+	}
+}
+
+// parseStorage parses the parameters of a set family command and reads
+// its data from the connection.  Any error is written to the client
+// and false returned.
+func parseStorage(c *Request) (storageRequest, bool) {
+	var r storageRequest
+	n := len(c.Subcmd)
+	memcached := n == 4 || (n == 5 && c.Subcmd[4] == "noreply")
+	if n != 1 && n != 2 && !memcached {
+		c.WriteStr(fmt.Sprintf("ERROR %v command requires a key and an optional ttl, or <key> <flags> <exptime> <bytes> [noreply]", c.Cmd))
+		return r, false
+	}
+
+	r.key = c.Subcmd[0]
+	if len(r.key) >= MAX_KEY_SIZE {
+		c.WriteStr(fmt.Sprintf("ERROR key can only be %v characters long", MAX_KEY_SIZE))
+		return r, false
+	}
+
+	size := -1
+	if memcached {
+		flags, err := strconv.ParseUint(c.Subcmd[1], 10, 32)
+		if err != nil {
+			c.WriteStr("ERROR flags must be a 32 bit unsigned number")
+			return r, false
+		}
+		exptime, err := strconv.ParseInt(c.Subcmd[2], 10, 64)
+		if err != nil {
+			c.WriteStr("ERROR exptime must be a number")
+			return r, false
+		}
+		size, err = strconv.Atoi(c.Subcmd[3])
+		if err != nil || size < 0 {
+			c.WriteStr("ERROR bytes must be a positive number")
+			return r, false
+		}
+		r.flags = uint32(flags)
+		r.ttl = exptimeTTL(exptime, time.Now())
+		r.noreply = n == 5
+	} else if n == 2 {
+		var err error
+		r.ttl, err = parseTTL(c.Subcmd[1])
+		if err != nil {
+			c.WriteStr(err.Error())
+			return r, false
+		}
+	}
+
+	if size >= MAX_DATA_SIZE {
+		if c.SkipData(size) == nil {
+			c.WriteStr(errTooLarge)
+		}
+		return r, false
+	}
+
+	if size >= 0 {
+		// The memcached form declares its length, so the data can be
+		// any bytes at all
+		var err error
+		r.data, err = c.ReadData(size)
+		if err != nil {
+			c.WriteStr(err.Error())
+			return r, false
+		}
+		return r, true
+	}
+
+	d, err := c.Readln()
+	if err != nil {
+		c.WriteStr(fmt.Sprintf("ERROR invalid data for %v", c.Cmd))
+		return r, false
+	}
+
+	input, err := c.ValidateInput(d)
+	if err != nil {
+		c.WriteStr(err.Error())
+		return r, false
+	}
+	r.data = []byte(input)
+
+	if len(r.data) == 0 {
+		c.WriteStr(fmt.Sprintf("ERROR data must have at least 1 character in it"))
+		return r, false
+	}
+
+	if len(r.data) >= MAX_DATA_SIZE {
+		c.WriteStr(errTooLarge)
+		return r, false
+	}
+
+	return r, true
+}
+
+// exptimeTTL converts a memcached exptime into a ttl.  An exptime of up
+// to 30 days is a number of seconds, and anything larger a unix time.
+// Negative exptimes and unix times in the past are already expired,
+// which is returned as a negative ttl the way Store takes it.
+func exptimeTTL(exptime int64, now time.Time) time.Duration {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return -1
+	case exptime <= maxRelativeExptime:
+		return time.Duration(exptime) * time.Second
+	}
+
+	ttl := time.Unix(exptime, 0).Sub(now)
+	if ttl <= 0 {
+		return -1
+	}
+	return ttl
+}
+
+// cmdGet takes 1 or more keys and will return the data
+// for each key found in the cache.
+func cmdGet(c *Request) {
+	getCmd(c, false)
+}
+
+// cmdGets is get, but also returns the version of each item for
+// use with cas.
+func cmdGets(c *Request) {
+	getCmd(c, true)
+}
+
+// getCmd handles get and gets.  Each item found is printed as
+// VALUE <key>, or VALUE <key> <flags> <bytes> in the memcached format,
+// followed by its version for gets, then its data.
+func getCmd(c *Request, cas bool) {
+	if len(c.Subcmd) == 0 {
+		c.WriteStr(fmt.Sprintf("ERROR key required with %v command", c.Cmd))
+		return
+	}
+
+	var items map[string]Item
+	if mg, ok := c.Storage.(MultiGetter); ok {
+		items = mg.GetMulti(c.Subcmd)
+	}
+
+	for _, v := range c.Subcmd {
+		var d Item
+		var ok bool
+		if items != nil {
+			d, ok = items[v]
+		} else {
+			d, ok = c.Storage.Get(v)
+		}
+		if !ok {
+			continue
+		}
+
+		line := "VALUE " + v
+		if c.Memcached {
+			line += fmt.Sprintf(" %v %v", d.Flags, len(d.Value))
+		}
+		if cas {
+			line += fmt.Sprintf(" %v", d.Cas)
+		}
+		c.WriteStr(line)
+		c.WriteBytes(d.Value)
+
+	}
+	c.WriteStr("END")
+
+}
+
+// cmdDelete takes a single key and will attempt to remove
+// the key from the cache.
+func cmdDelete(c *Request) {
+	if len(c.Subcmd) != 1 {
+		c.WriteStr("ERROR delete command requires a single key to be specified")
+		return
+	}
+
+	switch c.Storage.Delete(c.Subcmd[0], 0) {
+	case OK:
+		c.WriteStr("DELETED")
+	case ReadOnly:
+		c.WriteStr(errReadOnly)
+	case Unavailable:
+		c.WriteStr(errUnavailable)
+	default:
+		c.WriteStr("NOT_FOUND")
+	}
+}
+
+// cmdIncr adds a delta to the decimal number stored at a key.
+func cmdIncr(c *Request) {
+	incrCmd(c, false)
+}
+
+// cmdDecr subtracts a delta from the decimal number stored at a key.
+func cmdDecr(c *Request) {
+	incrCmd(c, true)
+}
+
+// incrCmd handles incr and decr, which take a key, a delta and an
+// optional noreply, and reply with the new value.
+func incrCmd(c *Request, decr bool) {
+	n := len(c.Subcmd)
+	if n != 2 && !(n == 3 && c.Subcmd[2] == "noreply") {
+		c.WriteStr(fmt.Sprintf("ERROR %v command requires a key and a delta", c.Cmd))
+		return
+	}
+
+	delta, err := strconv.ParseUint(c.Subcmd[1], 10, 64)
+	if err != nil {
+		c.WriteStr("ERROR delta must be a 64 bit unsigned number")
+		return
+	}
+	reply := func(s string) {
+		if n == 2 {
+			c.WriteStr(s)
+		}
+	}
+
+	v, _, res := c.Storage.Incr(c.Subcmd[0], delta, decr, 0)
+	switch res {
+	case OK:
+		reply(strconv.FormatUint(v, 10))
+	case NotFound:
+		reply("NOT_FOUND")
+	case NonNumeric:
+		reply(errNonNumeric)
+	case CacheFull:
+		reply(errCacheFull)
+	case ReadOnly:
+		reply(errReadOnly)
+	case Unavailable:
+		reply(errUnavailable)
+	}
+}
+
+// cmdExpire takes a key and a ttl in seconds and sets the key
+// to expire once the ttl has passed.
+func cmdExpire(c *Request) {
+	if len(c.Subcmd) != 2 {
+		c.WriteStr("ERROR expire command requires a key and a ttl to be specified")
+		return
+	}
+
+	ttl, err := parseTTL(c.Subcmd[1])
+	if err != nil {
+		c.WriteStr(err.Error())
+		return
+	}
+	if ttl == 0 {
+		c.WriteStr("ERROR ttl must be greater than 0")
+		return
+	}
+
+	switch c.Storage.Touch(c.Subcmd[0], ttl) {
+	case OK:
+		c.WriteStr("TOUCHED")
+	case ReadOnly:
+		c.WriteStr(errReadOnly)
+	case Unavailable:
+		c.WriteStr(errUnavailable)
+	default:
+		c.WriteStr("NOT_FOUND")
+	}
+}
+
+// cmdTTL takes a single key and prints the number of seconds left
+// before it expires, or -1 if it never expires.
+func cmdTTL(c *Request) {
+	if len(c.Subcmd) != 1 {
+		c.WriteStr("ERROR ttl command requires a single key to be specified")
+		return
+	}
+
+	now := time.Now()
+	i, ok := c.Storage.Peek(c.Subcmd[0])
+	if !ok {
+		c.WriteStr("NOT_FOUND")
+		return
+	}
+
+	if i.Expires.IsZero() {
+		c.WriteStr("TTL -1")
+		return
+	}
+
+	// Round up so a key with any time left never reports 0
+	left := (i.Expires.Sub(now) + time.Second - 1) / time.Second
+	c.WriteStr(fmt.Sprintf("TTL %v", int64(left)))
+}
+
+// cmdPersist takes a single key and removes its ttl so it
+// will never expire.
+func cmdPersist(c *Request) {
+	if len(c.Subcmd) != 1 {
+		c.WriteStr("ERROR persist command requires a single key to be specified")
+		return
+	}
+
+	switch c.Storage.Touch(c.Subcmd[0], 0) {
+	case OK:
+		c.WriteStr("PERSISTED")
+	case ReadOnly:
+		c.WriteStr(errReadOnly)
+	case Unavailable:
+		c.WriteStr(errUnavailable)
+	default:
+		c.WriteStr("NOT_FOUND")
+	}
+}
+
+// parseTTL converts a ttl given in seconds by the client into a
+// duration.  0 means no ttl.
+func parseTTL(s string) (time.Duration, error) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("ERROR ttl must be a number of seconds")
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// cmdSave writes the cache to the snapshot file, blocking
+// every other command until it is done.
+func cmdSave(c *Request) {
+	if len(c.Subcmd) != 0 {
+		c.WriteStr("ERROR save does not take any parameters")
+		return
+	}
+
+	if c.c == nil || c.c.snapshot == "" {
+		c.WriteStr("ERROR no snapshot file configured")
+		return
+	}
+
+	c.c.saveMutex.Lock()
+	defer c.c.saveMutex.Unlock()
+	c.c.lockAll()
+	defer c.c.unlockAll()
+
+	err := c.c.save()
+	if err == errSaveInProgress {
+		c.WriteStr(err.Error())
+		return
+	}
+	if err != nil {
+		c.WriteStr(fmt.Sprintf("ERROR save failed: %v", err))
+		return
+	}
+	c.WriteStr("OK")
+}
+
+// cmdBgsave copies the cache and writes it to the snapshot
+// file in the background.
+func cmdBgsave(c *Request) {
+	if len(c.Subcmd) != 0 {
+		c.WriteStr("ERROR bgsave does not take any parameters")
+		return
+	}
+
+	if c.c == nil || c.c.snapshot == "" {
+		c.WriteStr("ERROR no snapshot file configured")
+		return
+	}
+
+	c.c.saveMutex.Lock()
+	defer c.c.saveMutex.Unlock()
+	c.c.lockAll()
+	defer c.c.unlockAll()
+
+	err := c.c.bgsave()
+	if err != nil {
+		c.WriteStr(err.Error())
+		return
+	}
+	c.WriteStr("BACKGROUND_SAVE_STARTED")
+}
+
+// cmdRewriteLog compacts the mutation log in the background
+// from what is currently in the cache.
+func cmdRewriteLog(c *Request) {
+	if len(c.Subcmd) != 0 {
+		c.WriteStr("ERROR rewritelog does not take any parameters")
+		return
+	}
+
+	if c.c == nil || c.c.log == nil {
+		c.WriteStr("ERROR no mutation log configured")
+		return
+	}
+
+	c.c.lockAll()
+	defer c.c.unlockAll()
+
+	err := c.c.log.rewrite(c.c)
+	if err != nil {
+		c.WriteStr(err.Error())
+		return
+	}
+	c.WriteStr("BACKGROUND_REWRITE_STARTED")
+}
+
+// cmdQuit closes the connection with the client.
+func cmdQuit(c *Request) {
+	if len(c.Subcmd) != 0 {
+		c.WriteStr("ERROR quit does not take any parameters")
+		return
+	}
+
+	c.Conn.Close()
+}
@@ -0,0 +1,153 @@
+package scs
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestMemcachedStorage runs the memcached forms of the set family
+// of commands.
+func TestMemcachedStorage(t *testing.T) {
+	s, err := NewServer(testOptions(WithMemcached(true))...)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer s.Close()
+	go s.Serve()
+	n, b := dial(t, s)
+
+	expect(t, n, b, "set sushi 5 0 9\r\ndelicious\r\n", "STORED")
+	expect(t, n, b, "get sushi\r\n", "VALUE sushi 5 9", "delicious", "END")
+	expect(t, n, b, "gets sushi\r\n", "VALUE sushi 5 9 1", "delicious", "END")
+
+	expect(t, n, b, "set empty 0 0 0\r\n\r\n", "STORED")
+	expect(t, n, b, "get empty\r\n", "VALUE empty 0 0", "", "END")
+	expect(t, n, b, "set short 0 0 9\r\ndelicious and more\r\n", "ERROR bad data chunk")
+	expect(t, n, b, "set bad x 0 9\r\n", "ERROR flags must be a 32 bit unsigned number")
+	expect(t, n, b, "set bad 0 0 9 maybe\r\n", "ERROR set command requires a key and an optional ttl, or <key> <flags> <exptime> <bytes> [noreply]")
+
+	expect(t, n, b, "add sushi 0 0 3\r\nfun\r\n", "NOT_STORED")
+	expect(t, n, b, "add topcoder 1 0 3\r\nfun\r\n", "STORED")
+	expect(t, n, b, "replace missing 0 0 3\r\nfun\r\n", "NOT_STORED")
+	expect(t, n, b, "replace topcoder 2 0 4\r\nfun!\r\n", "STORED")
+	expect(t, n, b, "append missing 0 0 3\r\nfun\r\n", "NOT_STORED")
+	expect(t, n, b, "append topcoder 9 0 2\r\n!!\r\n", "STORED")
+	expect(t, n, b, "prepend topcoder 9 0 3\r\nso \r\n", "STORED")
+	expect(t, n, b, "get topcoder\r\n", "VALUE topcoder 2 9", "so fun!!!", "END")
+
+	// the legacy forms work for every command
+	expect(t, n, b, "add legacy\r\nvalue\r\n", "STORED")
+	expect(t, n, b, "append legacy 100\r\n!\r\n", "STORED")
+	expect(t, n, b, "get legacy\r\n", "VALUE legacy 0 6", "value!", "END")
+
+	// noreply only suppresses the reply
+	expect(t, n, b, "set quiet 0 0 2 noreply\r\nhi\r\nadd quiet 0 0 2 noreply\r\nno\r\nget quiet\r\n", "VALUE quiet 0 2", "hi", "END")
+
+	// exptimes are seconds, unix times, or already expired if negative
+	expect(t, n, b, "set rel 0 100 1\r\na\r\n", "STORED")
+	expect(t, n, b, "ttl rel\r\n", "TTL 100")
+	abs := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	expect(t, n, b, "set abs 0 "+abs+" 1\r\na\r\n", "STORED")
+	expect(t, n, b, "ttl abs\r\n", "TTL 3600")
+	expect(t, n, b, "set sushi 0 -1 1\r\na\r\n", "STORED")
+	expect(t, n, b, "get sushi\r\n", "END")
+}
+
+// TestIncrDecr verifies incr and decr change counters in place and
+// never lose an update when many connections share a counter.
+func TestIncrDecr(t *testing.T) {
+	s, n, b := startServer(t, 65535)
+	defer s.Close()
+
+	expect(t, n, b, "incr missing 1\r\n", "NOT_FOUND")
+	expect(t, n, b, "decr missing 1\r\n", "NOT_FOUND")
+	expect(t, n, b, "set text\r\nabc\r\n", "STORED")
+	expect(t, n, b, "incr text 1\r\n", "ERROR cannot increment or decrement non-numeric value")
+	expect(t, n, b, "incr text\r\n", "ERROR incr command requires a key and a delta")
+	expect(t, n, b, "set count 100\r\n10\r\n", "STORED")
+	expect(t, n, b, "incr count -1\r\n", "ERROR delta must be a 64 bit unsigned number")
+	expect(t, n, b, "incr count 5\r\n", "15")
+	expect(t, n, b, "decr count 3\r\n", "12")
+	expect(t, n, b, "decr count 20\r\n", "0")
+	expect(t, n, b, "ttl count\r\n", "TTL 100")
+
+	// incr wraps around at 64 bits like memcached
+	expect(t, n, b, "set count\r\n18446744073709551615\r\n", "STORED")
+	expect(t, n, b, "incr count 2\r\n", "1")
+	expect(t, n, b, "incr count 1 noreply\r\nget count\r\n", "VALUE count", "2", "END")
+
+	const conns, incrs = 8, 100
+	done := make(chan bool)
+	for i := 0; i < conns; i++ {
+		go func() {
+			cn, cb := dial(t, s)
+			defer cn.Close()
+			for j := 0; j < incrs; j++ {
+				expect(t, cn, cb, "incr count 1 noreply\r\n")
+			}
+			expect(t, cn, cb, "get missing\r\n", "END")
+			done <- true
+		}()
+	}
+	for i := 0; i < conns; i++ {
+		<-done
+	}
+	expect(t, n, b, "get count\r\n", "VALUE count", strconv.Itoa(2+conns*incrs), "END")
+
+	stats := map[string]string{}
+	n.Write([]byte("stats\r\n"))
+	for {
+		line, err := b.ReadString('\n')
+		if err != nil || line == "END\r\n" {
+			break
+		}
+		var k, v string
+		fmt.Sscan(line, &k, &v)
+		stats[k] = v
+	}
+	want := map[string]string{
+		"incr_hits":   strconv.Itoa(3 + conns*incrs),
+		"incr_misses": "1",
+		"decr_hits":   "2",
+		"decr_misses": "1",
+	}
+	for k, v := range want {
+		if stats[k] != v {
+			t.Errorf("stats %v = %v, want %v", k, stats[k], v)
+		}
+	}
+}
+
+// TestCas verifies gets returns versions that cas only accepts while
+// the item is unchanged.
+func TestCas(t *testing.T) {
+	s, n, b := startServer(t, 65535)
+	defer s.Close()
+
+	expect(t, n, b, "set sushi\r\ndelicious\r\n", "STORED")
+	expect(t, n, b, "set topcoder\r\nfun\r\n", "STORED")
+	expect(t, n, b, "gets sushi topcoder missing\r\n", "VALUE sushi 1", "delicious", "VALUE topcoder 2", "fun", "END")
+	expect(t, n, b, "gets\r\n", "ERROR key required with gets command")
+
+	// another connection changes sushi after it was read
+	n1, b1 := dial(t, s)
+	expect(t, n1, b1, "cas sushi 1\r\nyummy\r\n", "STORED")
+	expect(t, n, b, "cas sushi 1\r\nsoggy\r\n", "EXISTS")
+	expect(t, n, b, "gets sushi\r\n", "VALUE sushi 3", "yummy", "END")
+	expect(t, n, b, "cas missing 1\r\nfun\r\n", "NOT_FOUND")
+	expect(t, n, b, "cas sushi 0\r\n", "ERROR version must be a positive 64 bit number")
+	expect(t, n, b, "cas sushi\r\n", "ERROR cas command requires a key, a version and an optional ttl, or <key> <flags> <exptime> <bytes> <version> [noreply]")
+
+	// every change to an item gives it a new version
+	expect(t, n, b, "append sushi\r\n!\r\n", "STORED")
+	expect(t, n, b, "cas sushi 3 100\r\nfun\r\n", "EXISTS")
+	expect(t, n, b, "cas sushi 4 100\r\nfun\r\n", "STORED")
+	expect(t, n, b, "ttl sushi\r\n", "TTL 100")
+
+	// the memcached form
+	expect(t, n, b, "cas sushi 7 0 5 5\r\nsushi\r\n", "STORED")
+	expect(t, n, b, "cas sushi 7 0 5 5 noreply\r\nsushi\r\ncas sushi 7 0 4 6\r\nmaki\r\n", "STORED")
+	expect(t, n, b, "gets sushi\r\n", "VALUE sushi 7", "maki", "END")
+}
@@ -0,0 +1,248 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// database is one of the isolated keyspaces of the cache that select
+// switches between.  Each has its own shards, item and memory limits
+// and usage stats, and implements Storage for the connections that
+// have it selected.  The mutation log, snapshot and replication are
+// shared by every database of the cache.
+type database struct {
+	// items and bytes are the totals of every shard of the database,
+	// which makeRoom keeps within maxItems and maxBytes.
+	items int64
+	bytes int64
+
+	c      *dataCache
+	idx    int
+	shards []*cacheShard
+	stats  atomic.Pointer[dataStats] // swapped for a new one by ResetStats
+}
+
+// dbRangeError is returned when a snapshot, mutation log or primary has
+// items in a database the server does not have.  Unlike a damaged
+// record, it means the server was started with too few databases.
+type dbRangeError struct {
+	db, dbs int
+}
+
+func (e dbRangeError) Error() string {
+	return fmt.Sprintf("there are items in database %v, but the server only has %v databases", e.db, e.dbs)
+}
+
+// setDatabases splits the cache into n databases, numbered from 0, each
+// with a single shard until setShards is called.  Connections start in
+// database 0, which is also what the binary protocol and /metrics use.
+// It must be called before anything else is set up.
+func (s *Server) setDatabases(n int) error {
+	if n < 1 {
+		return fmt.Errorf("databases must be at least 1")
+	}
+
+	s.c.dbs = make([]*database, n)
+	s.c.shards = nil
+	for idx := range s.c.dbs {
+		db := &database{c: s.c, idx: idx}
+		db.stats.Store(&dataStats{})
+		var err error
+		db.shards, err = newShards(db, 1)
+		if err != nil {
+			return err
+		}
+		s.c.dbs[idx] = db
+		s.c.shards = append(s.c.shards, db.shards...)
+	}
+	s.st = s.c.dbs[0]
+	return nil
+}
+
+// database returns the database numbered n, or a dbRangeError if the
+// cache does not have it.
+func (c *dataCache) database(n int) (*database, error) {
+	if n < 0 || n >= len(c.dbs) {
+		return nil, dbRangeError{n, len(c.dbs)}
+	}
+	return c.dbs[n], nil
+}
+
+// flush removes every item in the database.  Its shards are all locked
+// at once, in order, so no command sees it half emptied.
+func (db *database) flush() {
+	for _, sh := range db.shards {
+		sh.Lock()
+		defer sh.Unlock()
+	}
+	db.clear()
+}
+
+// clear removes every item in the database, and records it in the
+// mutation log and replication stream as a single opFlush record rather
+// than one per key.  The caller must hold every shard lock of db.
+func (db *database) clear() {
+	for _, sh := range db.shards {
+		for k := range sh.Cache {
+			sh.drop(k)
+		}
+	}
+	if db.c.log != nil {
+		db.c.log.flushed(db.idx)
+	}
+	db.c.feed.flushed(db.idx)
+}
+
+// move moves the item at key from one database to another, keeping its
+// flags and expiration, unless the other database already has key.
+// The shard of key in each database is locked, in the order lockAll
+// uses, so the item is never in both databases or in neither.
+func (c *dataCache) move(key string, from, to *database) Result {
+	if c.link != nil {
+		return ReadOnly
+	}
+	src, dst := from.shard(key), to.shard(key)
+	if from.idx < to.idx {
+		src.Lock()
+		dst.Lock()
+	} else {
+		dst.Lock()
+		src.Lock()
+	}
+	defer src.Unlock()
+	defer dst.Unlock()
+
+	now := time.Now()
+	i, ok := src.lookup(key, now)
+	if !ok {
+		return NotFound
+	}
+	if _, ok := dst.lookup(key, now); ok {
+		return Exists
+	}
+	if max := c.maxBytes; max > 0 && i.size() > max {
+		return OverMemory
+	}
+	if !dst.makeRoom(key, i.size()) {
+		return CacheFull
+	}
+
+	var ttl time.Duration
+	if !i.expires.IsZero() {
+		ttl = i.expires.Sub(now)
+	}
+	src.remove(key)
+	dst.store(key, i.value, i.flags, ttl)
+	return OK
+}
+
+// selectDatabase parses the database number given to a command, writing
+// an error to the client if the cache does not have it.
+func selectDatabase(c *Request, n string) (*database, bool) {
+	idx, err := strconv.Atoi(n)
+	if err != nil || idx < 0 || idx >= len(c.c.dbs) {
+		c.WriteStr(fmt.Sprintf("ERROR database must be a number from 0 to %v", len(c.c.dbs)-1))
+		return nil, false
+	}
+	return c.c.dbs[idx], true
+}
+
+// cmdSelect switches the connection to another database.  Every
+// connection starts in database 0.
+func cmdSelect(c *Request) {
+	if len(c.Subcmd) != 1 {
+		c.WriteStr("ERROR select command requires a single database to be specified")
+		return
+	}
+	if c.c == nil {
+		c.WriteStr("ERROR select needs the built in storage")
+		return
+	}
+
+	db, ok := selectDatabase(c, c.Subcmd[0])
+	if !ok {
+		return
+	}
+	c.db = db
+	c.Storage = db
+	c.WriteStr("OK")
+}
+
+// cmdFlushDB removes every item in the connection's database.
+func cmdFlushDB(c *Request) {
+	if len(c.Subcmd) != 0 {
+		c.WriteStr("ERROR flushdb does not take any parameters")
+		return
+	}
+	if c.c == nil {
+		c.WriteStr("ERROR flushdb needs the built in storage")
+		return
+	}
+	if c.c.link != nil {
+		c.WriteStr(errReadOnly)
+		return
+	}
+
+	c.db.flush()
+	c.WriteStr("OK")
+}
+
+// cmdDBSize replies with the number of items in the connection's
+// database, which includes expired items that have not been removed
+// yet.
+func cmdDBSize(c *Request) {
+	if len(c.Subcmd) != 0 {
+		c.WriteStr("ERROR dbsize does not take any parameters")
+		return
+	}
+	if c.c == nil {
+		c.WriteStr("ERROR dbsize needs the built in storage")
+		return
+	}
+
+	c.WriteStr(fmt.Sprintf("DBSIZE %v", atomic.LoadInt64(&c.db.items)))
+}
+
+// cmdMove moves a key from the connection's database to another one,
+// replying MOVED, NOT_FOUND if it is not in this database or EXISTS if
+// it is already in the other.
+func cmdMove(c *Request) {
+	if len(c.Subcmd) != 2 {
+		c.WriteStr("ERROR move command requires a key and a database to be specified")
+		return
+	}
+	if c.c == nil {
+		c.WriteStr("ERROR move needs the built in storage")
+		return
+	}
+
+	to, ok := selectDatabase(c, c.Subcmd[1])
+	if !ok {
+		return
+	}
+	if to == c.db {
+		c.WriteStr("ERROR source and destination databases are the same")
+		return
+	}
+
+	switch c.c.move(c.Subcmd[0], c.db, to) {
+	case OK:
+		c.WriteStr("MOVED")
+	case NotFound:
+		c.WriteStr("NOT_FOUND")
+	case Exists:
+		c.WriteStr("EXISTS")
+	case OverMemory:
+		c.WriteStr(errOverMemory)
+	case CacheFull:
+		c.WriteStr(errCacheFull)
+	case ReadOnly:
+		c.WriteStr(errReadOnly)
+	}
+}
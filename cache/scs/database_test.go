@@ -0,0 +1,195 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestDatabases verifies each database keeps its own keys, stats and
+// item limit, and the select, dbsize, move and flushdb commands.
+func TestDatabases(t *testing.T) {
+	s := startLimited(t, WithDatabases(3), WithMaxItems(2))
+	defer s.Close()
+
+	n0, b0 := dial(t, s)
+	n1, b1 := dial(t, s)
+	expect(t, n1, b1, "select 1\r\n", "OK")
+	expect(t, n0, b0, "set sushi\r\ndelicious\r\n", "STORED")
+	expect(t, n1, b1, "get sushi\r\n", "END")
+	expect(t, n1, b1, "set sushi\r\nraw\r\n", "STORED")
+	expect(t, n0, b0, "get sushi\r\n", "VALUE sushi", "delicious", "END")
+	expect(t, n1, b1, "get sushi\r\n", "VALUE sushi", "raw", "END")
+
+	expect(t, n0, b0, "select 3\r\n", "ERROR database must be a number from 0 to 2")
+	expect(t, n0, b0, "select one\r\n", "ERROR database must be a number from 0 to 2")
+	expect(t, n0, b0, "select\r\n", "ERROR select command requires a single database to be specified")
+
+	// Filling database 1 evicts from it alone
+	expect(t, n1, b1, "set tuna\r\nfresh\r\nset eel\r\ngrilled\r\n", "STORED", "STORED")
+	expect(t, n1, b1, "get sushi\r\n", "END")
+	expect(t, n1, b1, "dbsize\r\n", "DBSIZE 2")
+	expect(t, n0, b0, "dbsize\r\n", "DBSIZE 1")
+	stats := readStats(t, n1, b1, "stats\r\n")
+	if stats["curr_items"] != "2" || stats["evictions"] != "1" || stats["cmd_set"] != "3" {
+		t.Errorf("database 1 stats = %v", stats)
+	}
+	stats = readStats(t, n0, b0, "stats\r\n")
+	if stats["curr_items"] != "1" || stats["evictions"] != "0" || stats["cmd_set"] != "1" {
+		t.Errorf("database 0 stats = %v", stats)
+	}
+
+	// stats reset zeroes every database, not only the selected one
+	expect(t, n0, b0, "stats reset\r\n", "RESET")
+	stats = readStats(t, n1, b1, "stats\r\n")
+	if stats["curr_items"] != "2" || stats["evictions"] != "0" || stats["cmd_set"] != "0" {
+		t.Errorf("database 1 stats after reset = %v", stats)
+	}
+
+	expect(t, n0, b0, "expire sushi 100\r\n", "TOUCHED")
+	expect(t, n0, b0, "move sushi 2\r\n", "MOVED")
+	expect(t, n0, b0, "move sushi 2\r\n", "NOT_FOUND")
+	expect(t, n1, b1, "set sushi\r\nraw\r\n", "STORED")
+	expect(t, n1, b1, "move sushi 2\r\n", "EXISTS")
+	expect(t, n1, b1, "move sushi 1\r\n", "ERROR source and destination databases are the same")
+	expect(t, n1, b1, "move sushi 5\r\n", "ERROR database must be a number from 0 to 2")
+	expect(t, n0, b0, "select 2\r\n", "OK")
+	expect(t, n0, b0, "get sushi\r\n", "VALUE sushi", "delicious", "END")
+	expect(t, n0, b0, "ttl sushi\r\n", "TTL 100")
+
+	expect(t, n1, b1, "flushdb\r\n", "OK")
+	expect(t, n1, b1, "dbsize\r\n", "DBSIZE 0")
+	expect(t, n0, b0, "dbsize\r\n", "DBSIZE 1")
+	expect(t, n1, b1, "flushdb now\r\n", "ERROR flushdb does not take any parameters")
+}
+
+// TestDatabasesStorage verifies the database commands need the built in
+// storage.
+func TestDatabasesStorage(t *testing.T) {
+	s := startLimited(t, WithStorage(&mapStorage{m: make(map[string]Item)}))
+	defer s.Close()
+
+	n, b := dial(t, s)
+	expect(t, n, b, "select 1\r\n", "ERROR select needs the built in storage")
+	expect(t, n, b, "flushdb\r\n", "ERROR flushdb needs the built in storage")
+	expect(t, n, b, "dbsize\r\n", "ERROR dbsize needs the built in storage")
+	expect(t, n, b, "move sushi 1\r\n", "ERROR move needs the built in storage")
+
+	if _, err := NewServer(testOptions(WithDatabases(0))...); err == nil {
+		t.Errorf("NewServer with 0 databases succeeded")
+	}
+}
+
+// TestDatabasesPersist verifies the snapshot and mutation log keep every
+// item in its database, and that a server with too few databases
+// refuses to load them.
+func TestDatabasesPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snap, log := filepath.Join(dir, "dump.scs"), filepath.Join(dir, "log.scs")
+
+	for _, opt := range []Option{WithSnapshot(snap), WithLog(log, "always")} {
+		s := startLimited(t, WithDatabases(2), opt)
+		n, b := dial(t, s)
+		expect(t, n, b, "set sushi\r\ndelicious\r\nset tuna\r\nfresh\r\n", "STORED", "STORED")
+		expect(t, n, b, "select 1\r\n", "OK")
+		expect(t, n, b, "set sushi\r\nraw\r\nset eel\r\ngrilled\r\n", "STORED", "STORED")
+		expect(t, n, b, "select 0\r\n", "OK")
+		expect(t, n, b, "move tuna 1\r\n", "MOVED")
+		expect(t, n, b, "set tuna\r\nseared\r\n", "STORED")
+		expect(t, n, b, "select 1\r\n", "OK")
+		expect(t, n, b, "set tofu\r\nsilken\r\nflushdb\r\nset tofu\r\nfried\r\n", "STORED", "OK", "STORED")
+		n.Close()
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Shutdown = %v", err)
+		}
+
+		s = startLimited(t, WithDatabases(2), opt)
+		n, b = dial(t, s)
+		expect(t, n, b, "get sushi tuna eel\r\n", "VALUE sushi", "delicious", "VALUE tuna", "seared", "END")
+		expect(t, n, b, "select 1\r\n", "OK")
+		expect(t, n, b, "get sushi tuna eel tofu\r\n", "VALUE tofu", "fried", "END")
+		n.Close()
+		s.Shutdown(context.Background())
+
+		if _, err := NewServer(testOptions(opt)...); err == nil {
+			t.Errorf("NewServer with 1 database loaded 2")
+		}
+	}
+}
+
+// TestDatabasesReplication verifies a replica keeps every item in its
+// database, both in the copy it starts from and the changes after it.
+func TestDatabasesReplication(t *testing.T) {
+	p := startLimited(t, WithDatabases(2))
+	defer p.Close()
+	pn, pb := dial(t, p)
+	expect(t, pn, pb, "set sushi\r\ndelicious\r\n", "STORED")
+	expect(t, pn, pb, "select 1\r\n", "OK")
+	expect(t, pn, pb, "set sushi\r\nraw\r\n", "STORED")
+
+	r := startLimited(t, WithDatabases(2), WithReplicaOf(p.Addr().String()))
+	defer r.Close()
+	waitFor(t, r, "sushi", "delicious")
+
+	expect(t, pn, pb, "set tuna\r\nfresh\r\n", "STORED")
+	expect(t, pn, pb, "select 0\r\n", "OK")
+	expect(t, pn, pb, "set eel\r\ngrilled\r\n", "STORED")
+	waitFor(t, r, "eel", "grilled")
+
+	rn, rb := dial(t, r)
+	expect(t, rn, rb, "get sushi tuna\r\n", "VALUE sushi", "delicious", "END")
+	expect(t, rn, rb, "select 1\r\n", "OK")
+	expect(t, rn, rb, "get sushi tuna eel\r\n", "VALUE sushi", "raw", "VALUE tuna", "fresh", "END")
+
+	// A flush of database 1 leaves database 0 alone
+	expect(t, pn, pb, "select 1\r\n", "OK")
+	expect(t, pn, pb, "flushdb\r\nset tofu\r\nfried\r\n", "OK", "STORED")
+	expect(t, pn, pb, "select 0\r\n", "OK")
+	expect(t, pn, pb, "set done\r\nyes\r\n", "STORED")
+	waitFor(t, r, "done", "yes")
+	expect(t, rn, rb, "get sushi tuna eel tofu\r\n", "VALUE tofu", "fried", "END")
+	expect(t, rn, rb, "dbsize\r\n", "DBSIZE 1")
+	expect(t, rn, rb, "flushdb\r\n", "ERROR replica is read only")
+	expect(t, rn, rb, "move sushi 0\r\n", "ERROR replica is read only")
+}
+
+// TestDatabasesRESP verifies SELECT is kept by a RESP connection and
+// DBSIZE, MOVE and FLUSHDB reply with Redis types.
+func TestDatabasesRESP(t *testing.T) {
+	s := startLimited(t, WithDatabases(2), WithRESPPort(0))
+	defer s.Close()
+
+	n, err := net.Dial("tcp", s.rl.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect to RESP: %v", err)
+	}
+	defer n.Close()
+	n.SetDeadline(time.Now().Add(5 * time.Second))
+	b := bufio.NewReader(n)
+
+	expect(t, n, b, respCmd("SET", "sushi", "delicious"), "+OK")
+	expect(t, n, b, respCmd("SELECT", "1"), "+OK")
+	expect(t, n, b, respCmd("GET", "sushi"), "$-1")
+	expect(t, n, b, respCmd("DBSIZE"), ":0")
+	expect(t, n, b, respCmd("SELECT", "0"), "+OK")
+	expect(t, n, b, respCmd("MOVE", "sushi", "1"), ":1")
+	expect(t, n, b, respCmd("MOVE", "sushi", "1"), ":0")
+	expect(t, n, b, respCmd("SELECT", "2"), "-ERR database must be a number from 0 to 1")
+	expect(t, n, b, respCmd("SELECT", "1"), "+OK")
+	expect(t, n, b, respCmd("DBSIZE"), ":1")
+	expect(t, n, b, respCmd("FLUSHDB"), "+OK")
+	expect(t, n, b, respCmd("DBSIZE"), ":0")
+}
@@ -0,0 +1,215 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"container/list"
+	"fmt"
+	"math/rand"
+)
+
+// evictionPolicy decides which item is removed when a database of the
+// cache is full and a new key is set.  Every shard has its own policy,
+// whose methods are called with the shard locked and must run in
+// constant time.  The database compares the victims of its shards with
+// before to follow the policy across all of them.
+type evictionPolicy interface {
+	// added is called when a new item is stored in the cache.
+	added(i *item)
+	// accessed is called when an item is fetched by a client.
+	accessed(i *item)
+	// removed is called when an item leaves the cache for any reason.
+	removed(i *item)
+	// victim returns the item of the shard that should be evicted, or
+	// false if nothing can be evicted.
+	victim() (*item, bool)
+	// before reports if a, the victim of one shard, should be evicted
+	// before b, the victim of another.
+	before(a, b *item) bool
+}
+
+// newEvictionPolicy returns the policy matching name.
+func newEvictionPolicy(name string) (evictionPolicy, error) {
+	switch name {
+	case "lru":
+		return &lruPolicy{l: list.New()}, nil
+	case "lfu":
+		return &lfuPolicy{freqs: list.New()}, nil
+	case "random":
+		return &randomPolicy{}, nil
+	case "reject":
+		return rejectPolicy{}, nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy '%v', must be one of lru, lfu, random or reject", name)
+}
+
+// setEvictionPolicy changes how the server makes room for new keys once
+// it holds the maximum number of items.  It must be called before Serve.
+func (s *Server) setEvictionPolicy(name string) error {
+	_, err := newEvictionPolicy(name)
+	if err != nil {
+		return err
+	}
+
+	s.c.lockAll()
+	defer s.c.unlockAll()
+
+	s.c.policy = name
+	for _, sh := range s.c.shards {
+		sh.policy, _ = newEvictionPolicy(name)
+		for _, i := range sh.Cache {
+			sh.policy.added(i)
+		}
+	}
+	return nil
+}
+
+// setMemoryLimit caps the number of bytes of keys and values the
+// server will hold.  0 means no limit.  It must be called before Serve.
+func (s *Server) setMemoryLimit(n int) {
+	s.c.lockAll()
+	defer s.c.unlockAll()
+
+	s.c.maxBytes = n
+}
+
+// rejectPolicy never evicts, so sets of new keys fail when
+// the cache is full.
+type rejectPolicy struct{}
+
+func (rejectPolicy) added(i *item)          {}
+func (rejectPolicy) accessed(i *item)       {}
+func (rejectPolicy) removed(i *item)        {}
+func (rejectPolicy) victim() (*item, bool)  { return nil, false }
+func (rejectPolicy) before(a, b *item) bool { return false }
+
+// lruPolicy evicts the least recently used item.  Items are kept in a
+// list with the most recently used at the front.
+type lruPolicy struct {
+	l *list.List
+}
+
+func (p *lruPolicy) added(i *item) {
+	i.elem = p.l.PushFront(i)
+}
+
+func (p *lruPolicy) accessed(i *item) {
+	p.l.MoveToFront(i.elem)
+}
+
+func (p *lruPolicy) removed(i *item) {
+	p.l.Remove(i.elem)
+	i.elem = nil
+}
+
+func (p *lruPolicy) victim() (*item, bool) {
+	e := p.l.Back()
+	if e == nil {
+		return nil, false
+	}
+	return e.Value.(*item), true
+}
+
+func (p *lruPolicy) before(a, b *item) bool {
+	return a.used < b.used
+}
+
+// lfuPolicy evicts the least frequently used item, breaking ties by
+// evicting the least recently used of them.  freqs holds one
+// frequency bucket per distinct use count in ascending order, and each
+// bucket lists its items most recently used first.
+type lfuPolicy struct {
+	freqs *list.List
+}
+
+// lfuBucket is all of the items that have been used count times.
+type lfuBucket struct {
+	count int
+	items *list.List
+}
+
+func (p *lfuPolicy) added(i *item) {
+	f := p.freqs.Front()
+	if f == nil || f.Value.(*lfuBucket).count != 1 {
+		f = p.freqs.PushFront(&lfuBucket{count: 1, items: list.New()})
+	}
+	i.freq = f
+	i.elem = f.Value.(*lfuBucket).items.PushFront(i)
+}
+
+func (p *lfuPolicy) accessed(i *item) {
+	cur := i.freq
+	b := cur.Value.(*lfuBucket)
+
+	next := cur.Next()
+	if next == nil || next.Value.(*lfuBucket).count != b.count+1 {
+		next = p.freqs.InsertAfter(&lfuBucket{count: b.count + 1, items: list.New()}, cur)
+	}
+
+	b.items.Remove(i.elem)
+	if b.items.Len() == 0 {
+		p.freqs.Remove(cur)
+	}
+	i.freq = next
+	i.elem = next.Value.(*lfuBucket).items.PushFront(i)
+}
+
+func (p *lfuPolicy) removed(i *item) {
+	b := i.freq.Value.(*lfuBucket)
+	b.items.Remove(i.elem)
+	if b.items.Len() == 0 {
+		p.freqs.Remove(i.freq)
+	}
+	i.freq = nil
+	i.elem = nil
+}
+
+func (p *lfuPolicy) victim() (*item, bool) {
+	f := p.freqs.Front()
+	if f == nil {
+		return nil, false
+	}
+	return f.Value.(*lfuBucket).items.Back().Value.(*item), true
+}
+
+func (p *lfuPolicy) before(a, b *item) bool {
+	ac, bc := a.freq.Value.(*lfuBucket).count, b.freq.Value.(*lfuBucket).count
+	return ac < bc || (ac == bc && a.used < b.used)
+}
+
+// randomPolicy evicts an item picked at random.  items lets a random
+// item be picked in constant time, and every item knows its index
+// in it so removal can swap the last item into its place.
+type randomPolicy struct {
+	items []*item
+}
+
+func (p *randomPolicy) added(i *item) {
+	i.idx = len(p.items)
+	p.items = append(p.items, i)
+}
+
+func (p *randomPolicy) accessed(i *item) {}
+
+func (p *randomPolicy) removed(i *item) {
+	last := p.items[len(p.items)-1]
+	p.items[i.idx] = last
+	last.idx = i.idx
+	p.items[len(p.items)-1] = nil
+	p.items = p.items[:len(p.items)-1]
+}
+
+func (p *randomPolicy) victim() (*item, bool) {
+	if len(p.items) == 0 {
+		return nil, false
+	}
+	return p.items[rand.Intn(len(p.items))], true
+}
+
+// before keeps the first victim found, as the shards are searched from
+// a random one.
+func (p *randomPolicy) before(a, b *item) bool {
+	return false
+}
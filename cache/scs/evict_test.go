@@ -0,0 +1,138 @@
+package scs
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// TestEvictLRU verifies the least recently fetched key is evicted.
+func TestEvictLRU(t *testing.T) {
+	s, n, b := startServer(t, 3)
+	defer s.Close()
+
+	expect(t, n, b, "set a\r\n1\r\n", "STORED")
+	expect(t, n, b, "set b\r\n2\r\n", "STORED")
+	expect(t, n, b, "set c\r\n3\r\n", "STORED")
+	expect(t, n, b, "get a\r\n", "VALUE a", "1", "END")
+	expect(t, n, b, "set d\r\n4\r\n", "STORED")
+	expect(t, n, b, "get b\r\n", "END")
+	expect(t, n, b, "get a c d\r\n", "VALUE a", "1", "VALUE c", "3", "VALUE d", "4", "END")
+
+	// replacing an existing key never evicts
+	expect(t, n, b, "set a\r\n5\r\n", "STORED")
+	expect(t, n, b, "get c d\r\n", "VALUE c", "3", "VALUE d", "4", "END")
+
+	if e := atomic.LoadInt64(&s.c.dbs[0].stats.Load().evictions); e != 1 {
+		t.Errorf("evictions = %v, wanted 1", e)
+	}
+}
+
+// TestEvictLFU verifies the least frequently fetched key is evicted,
+// with ties going to the least recently used.
+func TestEvictLFU(t *testing.T) {
+	s, n, b := startServer(t, 3)
+	defer s.Close()
+	if err := s.setEvictionPolicy("lfu"); err != nil {
+		t.Fatalf("setEvictionPolicy(lfu) = %v", err)
+	}
+
+	expect(t, n, b, "set a\r\n1\r\n", "STORED")
+	expect(t, n, b, "set b\r\n2\r\n", "STORED")
+	expect(t, n, b, "set c\r\n3\r\n", "STORED")
+	expect(t, n, b, "get a a c\r\n", "VALUE a", "1", "VALUE a", "1", "VALUE c", "3", "END")
+	expect(t, n, b, "set d\r\n4\r\n", "STORED")
+	expect(t, n, b, "get b\r\n", "END")
+	expect(t, n, b, "set e\r\n5\r\n", "STORED")
+	expect(t, n, b, "get d\r\n", "END")
+	expect(t, n, b, "delete e\r\n", "DELETED")
+	expect(t, n, b, "set f\r\n6\r\n", "STORED")
+	expect(t, n, b, "set g\r\n7\r\n", "STORED")
+	expect(t, n, b, "get a c g\r\n", "VALUE a", "1", "VALUE c", "3", "VALUE g", "7", "END")
+}
+
+// TestEvictRandom verifies a random policy keeps the cache at its limit.
+func TestEvictRandom(t *testing.T) {
+	s, n, b := startServer(t, 3)
+	defer s.Close()
+	if err := s.setEvictionPolicy("random"); err != nil {
+		t.Fatalf("setEvictionPolicy(random) = %v", err)
+	}
+
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		expect(t, n, b, "set "+k+"\r\ndata\r\n", "STORED")
+	}
+	expect(t, n, b, "delete e\r\n", "DELETED")
+	expect(t, n, b, "set f\r\ndata\r\n", "STORED")
+
+	s.c.lockAll()
+	defer s.c.unlockAll()
+	items := 0
+	for _, sh := range s.c.shards {
+		items += len(sh.Cache)
+		p := sh.policy.(*randomPolicy)
+		for idx, i := range p.items {
+			if i.idx != idx || sh.Cache[i.key] != i {
+				t.Errorf("random policy of shard %v out of sync with the cache at %v", sh.idx, idx)
+			}
+		}
+	}
+	if e := atomic.LoadInt64(&s.c.dbs[0].stats.Load().evictions); items != 3 || e != 2 {
+		t.Errorf("got %v items and %v evictions, wanted 3 and 2", items, e)
+	}
+}
+
+// TestEvictReject verifies the reject policy refuses new keys when full.
+func TestEvictReject(t *testing.T) {
+	s, n, b := startServer(t, 2)
+	defer s.Close()
+	if err := s.setEvictionPolicy("reject"); err != nil {
+		t.Fatalf("setEvictionPolicy(reject) = %v", err)
+	}
+	if err := s.setEvictionPolicy("fifo"); err == nil {
+		t.Errorf("setEvictionPolicy(fifo) succeeded, wanted an error")
+	}
+
+	expect(t, n, b, "set a\r\n1\r\n", "STORED")
+	expect(t, n, b, "set b\r\n2\r\n", "STORED")
+	expect(t, n, b, "set c\r\n3\r\n", "ERROR cache is full")
+	expect(t, n, b, "set a\r\n4\r\n", "STORED")
+}
+
+// TestMemoryLimit verifies keys are evicted to stay under the memory
+// limit and that bytes are tracked as keys are replaced and deleted.
+func TestMemoryLimit(t *testing.T) {
+	s, n, b := startServer(t, 65535)
+	defer s.Close()
+	s.setMemoryLimit(20)
+
+	expect(t, n, b, "set a\r\n123456789\r\n", "STORED")
+	expect(t, n, b, "set b\r\n123456789\r\n", "STORED")
+	expect(t, n, b, "set c\r\n123\r\n", "STORED")
+	expect(t, n, b, "get a\r\n", "END")
+	expect(t, n, b, "set b\r\n1\r\n", "STORED")
+	expect(t, n, b, "set big\r\n123456789012345678\r\n", "ERROR data is larger than the memory limit")
+	expect(t, n, b, "get b c\r\n", "VALUE b", "1", "VALUE c", "123", "END")
+
+	bytes, evictions := atomic.LoadInt64(&s.c.dbs[0].bytes), atomic.LoadInt64(&s.c.dbs[0].stats.Load().evictions)
+	if bytes != 6 || evictions != 1 {
+		t.Errorf("got %v bytes and %v evictions, wanted 6 and 1", bytes, evictions)
+	}
+
+	expect(t, n, b, "delete c\r\n", "DELETED")
+	if bytes := atomic.LoadInt64(&s.c.dbs[0].bytes); bytes != 2 {
+		t.Errorf("got %v bytes after delete, wanted 2", bytes)
+	}
+
+	if err := s.setEvictionPolicy("reject"); err != nil {
+		t.Fatalf("setEvictionPolicy(reject) = %v", err)
+	}
+	expect(t, n, b, "set d\r\n12345678901234567\r\n", "STORED")
+	expect(t, n, b, "set e\r\n12\r\n", "ERROR cache is full")
+
+	// so is an incr that needs another digit
+	expect(t, n, b, "incr b 9\r\n", "ERROR cache is full")
+	expect(t, n, b, "incr b 8\r\n", "9")
+	if bytes := atomic.LoadInt64(&s.c.dbs[0].bytes); bytes != 20 {
+		t.Errorf("got %v bytes after incr, wanted 20", bytes)
+	}
+}
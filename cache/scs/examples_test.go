@@ -1,4 +1,4 @@
-package main
+package scs
 
 import (
 	"bufio"
@@ -12,18 +12,13 @@ import (
 // TestExamples runs the examples outlined in the topcoder challenge
 func TestExamples(t *testing.T) {
 
-	s, err := NewServer("localhost", 0, 65535)
+	s, err := NewServer(testOptions()...)
 	if err != nil {
 		t.Errorf("failed to create server: %v", err)
 		return
 	}
 	addr := s.l.Addr().String()
 
-	err = registerHandlers(s)
-	if err != nil {
-		t.Errorf("failed to register handlers: %v", err)
-		return
-	}
 	go s.Serve()
 
 	n, err := net.Dial("tcp", addr)
@@ -212,6 +207,63 @@ func TestExamples(t *testing.T) {
 		t.Errorf("stats fail, expected 'limit_items 65535', got '%v'", r)
 	}
 	r, err = b.ReadString('\n')
+	if r != "expired_unfetched 0\r\n" {
+		t.Errorf("stats fail, expected 'expired_unfetched 0', got '%v'", r)
+	}
+	r, err = b.ReadString('\n')
+	if r != "reclaimed 0\r\n" {
+		t.Errorf("stats fail, expected 'reclaimed 0', got '%v'", r)
+	}
+	r, err = b.ReadString('\n')
+	if r != "evictions 0\r\n" {
+		t.Errorf("stats fail, expected 'evictions 0', got '%v'", r)
+	}
+	r, err = b.ReadString('\n')
+	if r != "bytes 11\r\n" {
+		t.Errorf("stats fail, expected 'bytes 11', got '%v'", r)
+	}
+	r, err = b.ReadString('\n')
+	if r != "limit_maxbytes 67108864\r\n" {
+		t.Errorf("stats fail, expected 'limit_maxbytes 67108864', got '%v'", r)
+	}
+	r, err = b.ReadString('\n')
+	if r != "incr_hits 0\r\n" {
+		t.Errorf("stats fail, expected 'incr_hits 0', got '%v'", r)
+	}
+	r, err = b.ReadString('\n')
+	if r != "incr_misses 0\r\n" {
+		t.Errorf("stats fail, expected 'incr_misses 0', got '%v'", r)
+	}
+	r, err = b.ReadString('\n')
+	if r != "decr_hits 0\r\n" {
+		t.Errorf("stats fail, expected 'decr_hits 0', got '%v'", r)
+	}
+	r, err = b.ReadString('\n')
+	if r != "decr_misses 0\r\n" {
+		t.Errorf("stats fail, expected 'decr_misses 0', got '%v'", r)
+	}
+	r, err = b.ReadString('\n')
+	if r != "role primary\r\n" {
+		t.Errorf("stats fail, expected 'role primary', got '%v'", r)
+	}
+	r, err = b.ReadString('\n')
+	if r != "connected_replicas 0\r\n" {
+		t.Errorf("stats fail, expected 'connected_replicas 0', got '%v'", r)
+	}
+	r, err = b.ReadString('\n')
+	if r != "repl_offset 0\r\n" {
+		t.Errorf("stats fail, expected 'repl_offset 0', got '%v'", r)
+	}
+	r, err = b.ReadString('\n')
+	if r != "repl_lag_bytes 0\r\n" {
+		t.Errorf("stats fail, expected 'repl_lag_bytes 0', got '%v'", r)
+	}
+	r, err = b.ReadString('\n')
+	if r != "repl_lag_seconds 0\r\n" {
+		t.Errorf("stats fail, expected 'repl_lag_seconds 0', got '%v'", r)
+	}
+	skipServerStats(t, b, " ")
+	r, err = b.ReadString('\n')
 	if r != "END\r\n" {
 		t.Errorf("stats fail, expected 'END', got '%v'", r)
 	}
@@ -230,7 +282,7 @@ func TestExamples(t *testing.T) {
 // TestRegex makes sure the regex passes all the characters expected
 func TestRegex(t *testing.T) {
 
-	s, err := NewServer("localhost", 0, 5)
+	s, err := NewServer(testOptions(WithMaxItems(5))...)
 	if err != nil {
 		t.Errorf("failed to create server: %v", err)
 		return
@@ -253,18 +305,13 @@ func TestRegex(t *testing.T) {
 // and runs 'set' calls from all 3 in goroutines.
 func TestMultiConnect(t *testing.T) {
 	// Server setup
-	s, err := NewServer("localhost", 0, 65535)
+	s, err := NewServer(testOptions()...)
 	if err != nil {
 		t.Errorf("failed to create server: %v", err)
 		return
 	}
 	addr := s.l.Addr().String()
 
-	err = registerHandlers(s)
-	if err != nil {
-		t.Errorf("failed to register handlers: %v", err)
-		return
-	}
 	go s.Serve()
 
 	// connection setup
@@ -375,6 +422,63 @@ func TestMultiConnect(t *testing.T) {
 		t.Errorf("multi-connect stat error, got '%v'", r)
 	}
 	r, err = b1.ReadString('\n')
+	if r != "expired_unfetched 0\r\n" {
+		t.Errorf("multi-connect stat error, got '%v'", r)
+	}
+	r, err = b1.ReadString('\n')
+	if r != "reclaimed 0\r\n" {
+		t.Errorf("multi-connect stat error, got '%v'", r)
+	}
+	r, err = b1.ReadString('\n')
+	if r != "evictions 0\r\n" {
+		t.Errorf("multi-connect stat error, got '%v'", r)
+	}
+	r, err = b1.ReadString('\n')
+	if r != "bytes 65670\r\n" {
+		t.Errorf("multi-connect stat error, got '%v'", r)
+	}
+	r, err = b1.ReadString('\n')
+	if r != "limit_maxbytes 67108864\r\n" {
+		t.Errorf("multi-connect stat error, got '%v'", r)
+	}
+	r, err = b1.ReadString('\n')
+	if r != "incr_hits 0\r\n" {
+		t.Errorf("multi-connect stat error, got '%v'", r)
+	}
+	r, err = b1.ReadString('\n')
+	if r != "incr_misses 0\r\n" {
+		t.Errorf("multi-connect stat error, got '%v'", r)
+	}
+	r, err = b1.ReadString('\n')
+	if r != "decr_hits 0\r\n" {
+		t.Errorf("multi-connect stat error, got '%v'", r)
+	}
+	r, err = b1.ReadString('\n')
+	if r != "decr_misses 0\r\n" {
+		t.Errorf("multi-connect stat error, got '%v'", r)
+	}
+	r, err = b1.ReadString('\n')
+	if r != "role primary\r\n" {
+		t.Errorf("multi-connect stat error, got '%v'", r)
+	}
+	r, err = b1.ReadString('\n')
+	if r != "connected_replicas 0\r\n" {
+		t.Errorf("multi-connect stat error, got '%v'", r)
+	}
+	r, err = b1.ReadString('\n')
+	if r != "repl_offset 0\r\n" {
+		t.Errorf("multi-connect stat error, got '%v'", r)
+	}
+	r, err = b1.ReadString('\n')
+	if r != "repl_lag_bytes 0\r\n" {
+		t.Errorf("multi-connect stat error, got '%v'", r)
+	}
+	r, err = b1.ReadString('\n')
+	if r != "repl_lag_seconds 0\r\n" {
+		t.Errorf("multi-connect stat error, got '%v'", r)
+	}
+	skipServerStats(t, b1, " ")
+	r, err = b1.ReadString('\n')
 	if r != "END\r\n" {
 		t.Errorf("multi-connect stat error, got '%v'", r)
 	}
@@ -385,18 +489,13 @@ func TestMultiConnect(t *testing.T) {
 // TestSizes verifies the max key and data sizes behave properly.
 func TestSizes(t *testing.T) {
 	// Server setup
-	s, err := NewServer("localhost", 0, 65535)
+	s, err := NewServer(testOptions()...)
 	if err != nil {
 		t.Errorf("failed to create server: %v", err)
 		return
 	}
 	addr := s.l.Addr().String()
 
-	err = registerHandlers(s)
-	if err != nil {
-		t.Errorf("failed to register handlers: %v", err)
-		return
-	}
 	go s.Serve()
 
 	// connection setup
@@ -466,3 +565,56 @@ func TestSizes(t *testing.T) {
 
 	s.Close()
 }
+
+// testOptions returns opts after the options every test server starts
+// with, which is a random localhost port.
+func testOptions(opts ...Option) []Option {
+	base := []Option{WithAddr("localhost"), WithPort(0)}
+	return append(base, opts...)
+}
+
+// startServer creates a server on a random localhost port with all of
+// the handlers registered and returns it along with a connection to it.
+func startServer(t *testing.T, maxItems int) (*Server, net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	s, err := NewServer(testOptions(WithMaxItems(maxItems))...)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	go s.Serve()
+
+	n, b := dial(t, s)
+	return s, n, b
+}
+
+// dial opens a new connection to the server.
+func dial(t *testing.T, s *Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	n, err := net.Dial("tcp", s.l.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect to server: %v", err)
+	}
+	n.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return n, bufio.NewReader(n)
+}
+
+// expect writes cmd to the connection and verifies each line
+// read back matches the lines in want.
+func expect(t *testing.T, n net.Conn, b *bufio.Reader, cmd string, want ...string) {
+	t.Helper()
+
+	n.Write([]byte(cmd))
+	for _, w := range want {
+		r, err := b.ReadString('\n')
+		if err != nil {
+			t.Errorf("%q read error: %v", cmd, err)
+			return
+		}
+		if r != w+"\r\n" {
+			t.Errorf("%q expected '%v', got '%v'", cmd, w, r)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"time"
+)
+
+const (
+	// reapInterval is how often the reaper wakes up to look for
+	// expired keys.
+	reapInterval = 100 * time.Millisecond
+	// reapSample is the number of keys with a ttl looked at while
+	// holding the lock once.
+	reapSample = 20
+	// reapBudget caps how long a single wake up of the reaper can keep
+	// sampling before it goes back to sleep.
+	reapBudget = 25 * time.Millisecond
+)
+
+// reaper removes expired keys that are never fetched again.  Keys are
+// only expired lazily on lookup otherwise, so without it they would sit
+// in memory forever.  Each pass takes each shard's lock in turn for a
+// small random sample of keys with a ttl, and keeps sampling the shard
+// while more than a quarter of the sample turned out to be expired.
+func (s *Server) reaper() {
+	t := time.NewTicker(reapInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			deadline := time.Now().Add(reapBudget)
+			for _, sh := range s.c.shards {
+				for sh.reapSample(reapSample) > reapSample/4 {
+					if time.Now().After(deadline) {
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+// reapSample looks at up to n keys in the shard that have a ttl and
+// removes any that have expired.  Go randomizes map iteration order,
+// which is what makes the sample random.  Returns the number of keys
+// removed.
+func (sh *cacheShard) reapSample(n int) int {
+	sh.Lock()
+	defer sh.Unlock()
+
+	now := time.Now()
+	seen, removed := 0, 0
+	for k := range sh.expiring {
+		if seen == n {
+			break
+		}
+		seen++
+
+		i := sh.Cache[k]
+		if i.expired(now) {
+			sh.reclaim(k, i)
+			removed++
+		}
+	}
+	return removed
+}
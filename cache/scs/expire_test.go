@@ -0,0 +1,67 @@
+package scs
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestTTL verifies keys set with a ttl expire lazily on get and that
+// expire, ttl and persist change the ttl of existing keys.
+func TestTTL(t *testing.T) {
+	s, n, b := startServer(t, 65535)
+	defer s.Close()
+
+	expect(t, n, b, "set short 1\r\ngone soon\r\n", "STORED")
+	expect(t, n, b, "set long\r\nhere forever\r\n", "STORED")
+	expect(t, n, b, "set bad -1\r\n", "ERROR ttl must be a number of seconds")
+
+	expect(t, n, b, "ttl short\r\n", "TTL 1")
+	expect(t, n, b, "ttl long\r\n", "TTL -1")
+	expect(t, n, b, "ttl missing\r\n", "NOT_FOUND")
+
+	expect(t, n, b, "expire long 100\r\n", "TOUCHED")
+	expect(t, n, b, "ttl long\r\n", "TTL 100")
+	expect(t, n, b, "persist long\r\n", "PERSISTED")
+	expect(t, n, b, "ttl long\r\n", "TTL -1")
+	expect(t, n, b, "expire long 0\r\n", "ERROR ttl must be greater than 0")
+	expect(t, n, b, "expire missing 10\r\n", "NOT_FOUND")
+	expect(t, n, b, "persist missing\r\n", "NOT_FOUND")
+
+	expect(t, n, b, "get short\r\n", "VALUE short", "gone soon", "END")
+	time.Sleep(1100 * time.Millisecond)
+	expect(t, n, b, "get short long\r\n", "VALUE long", "here forever", "END")
+	expect(t, n, b, "ttl short\r\n", "NOT_FOUND")
+}
+
+// TestReaper verifies expired keys that are never fetched again are
+// removed by the background reaper.
+func TestReaper(t *testing.T) {
+	s, n, b := startServer(t, 65535)
+	defer s.Close()
+
+	for i := 0; i < 50; i++ {
+		expect(t, n, b, "set k"+strconv.Itoa(i)+" 1\r\ndata\r\n", "STORED")
+	}
+	expect(t, n, b, "get k0\r\n", "VALUE k0", "data", "END")
+
+	time.Sleep(1500 * time.Millisecond)
+
+	s.c.lockAll()
+	sh := s.c.shards[0]
+	items, expiring := len(sh.Cache), len(sh.expiring)
+	s.c.unlockAll()
+	unfetched := atomic.LoadInt64(&s.c.dbs[0].stats.Load().expiredUnfetched)
+	reclaimed := atomic.LoadInt64(&s.c.dbs[0].stats.Load().reclaimed)
+
+	if items != 0 || expiring != 0 {
+		t.Errorf("reaper left %v items and %v expiring keys, wanted 0", items, expiring)
+	}
+	if reclaimed != 50 {
+		t.Errorf("reclaimed = %v, wanted 50", reclaimed)
+	}
+	if unfetched != 49 {
+		t.Errorf("expired_unfetched = %v, wanted 49", unfetched)
+	}
+}
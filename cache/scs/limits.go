@@ -0,0 +1,179 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// errShuttingDown and errTooManyConns are why serverStats.open
+	// refused a connection.
+	errShuttingDown = errors.New("server is shutting down")
+	errTooManyConns = errors.New("too many connections")
+)
+
+// rejectTimeout is how long a refused client has to take the error
+// telling it why.
+const rejectTimeout = time.Second
+
+// timeouts are the deadlines set on every client connection.  A zero
+// duration leaves that deadline off.
+type timeouts struct {
+	// idle is how long a connection can wait between commands,
+	// except while it is subscribed and waiting for messages.
+	idle time.Duration
+	// read is how long the rest of a command, such as the data of a
+	// set, can take to arrive once its first line has.
+	read time.Duration
+	// write is how long each write to the client can take.
+	write time.Duration
+}
+
+// waiting sets the read deadline for a connection about to wait for its
+// next command.
+func (t timeouts) waiting(conn net.Conn, subscribed bool) {
+	if t.idle > 0 && !subscribed {
+		conn.SetReadDeadline(time.Now().Add(t.idle))
+	} else if t.read > 0 || t.idle > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// running sets the read deadline for a connection that has started
+// sending a command.
+func (t timeouts) running(conn net.Conn) {
+	if t.read > 0 {
+		conn.SetReadDeadline(time.Now().Add(t.read))
+	} else if t.idle > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// writeTimeoutListener gives each connection it accepts a write
+// timeout.
+type writeTimeoutListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (l *writeTimeoutListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &writeTimeoutConn{conn, l.timeout}, nil
+}
+
+// writeTimeoutConn sets a new write deadline before every write, so a
+// client that stops reading can hold up a goroutine for at most timeout
+// at a time.  Every write, including the ones subscribers and replicas
+// are sent without a command, is covered.
+type writeTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *writeTimeoutConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
+}
+
+// rateLimiter hands out a token bucket to each remote IP, shared by
+// all of its connections.  A bucket holds up to burst commands and
+// refills at rate a second.  It is kept after the IP's last connection
+// closes, so reconnecting does not give it a full one, until it has
+// been idle long enough to have refilled anyway.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	full  time.Duration // how long an empty bucket takes to refill
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// bucket is the token bucket of one IP.
+type bucket struct {
+	conns int       // guarded by rateLimiter.mu
+	idle  time.Time // when conns went to 0, guarded by rateLimiter.mu
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		full:    time.Duration(float64(burst) / rate * float64(time.Second)),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// acquire returns the bucket of the IP addr is at, creating a full one
+// for a new IP.  At most once every refill time, it also removes the
+// buckets that have had no connections for that long.
+func (rl *rateLimiter) acquire(addr net.Addr) *bucket {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	if now.Sub(rl.swept) >= rl.full {
+		for k, b := range rl.buckets {
+			if b.conns == 0 && now.Sub(b.idle) >= rl.full {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.swept = now
+	}
+
+	b, ok := rl.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[ip] = b
+	}
+	b.conns++
+	return b
+}
+
+// release gives back a bucket returned by acquire.  The bucket is left
+// for the next connection from the IP until acquire removes it.
+func (rl *rateLimiter) release(b *bucket) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	b.conns--
+	if b.conns == 0 {
+		b.idle = time.Now()
+	}
+}
+
+// allow takes a token from b for a command, and reports false if there
+// are none left.
+func (rl *rateLimiter) allow(b *bucket) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
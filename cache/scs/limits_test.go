@@ -0,0 +1,245 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startLimited creates a server with opts on top of the test options
+// and serves it.
+func startLimited(t *testing.T, opts ...Option) *Server {
+	t.Helper()
+
+	s, err := NewServer(testOptions(opts...)...)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	go s.Serve()
+	return s
+}
+
+// closed verifies the server closes the connection within 5 seconds.
+func closed(t *testing.T, b *bufio.Reader, why string) {
+	t.Helper()
+
+	if r, err := b.ReadString('\n'); err == nil {
+		t.Errorf("%v: connection still open, got %q", why, r)
+	}
+}
+
+// TestMaxConns verifies clients over the connection limit are told so
+// and disconnected, on every protocol, and counted in stats.
+func TestMaxConns(t *testing.T) {
+	s := startLimited(t, WithMaxConns(2), WithRESPPort(0))
+	defer s.Close()
+
+	n1, b1 := dial(t, s)
+	expect(t, n1, b1, "get sushi\r\n", "END")
+	n2, b2 := dial(t, s)
+	expect(t, n2, b2, "get sushi\r\n", "END")
+
+	n3, b3 := dial(t, s)
+	expect(t, n3, b3, "", "ERROR too many connections")
+	closed(t, b3, "text over the limit")
+	rn, err := net.Dial("tcp", s.rl.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect to RESP: %v", err)
+	}
+	defer rn.Close()
+	rn.SetDeadline(time.Now().Add(5 * time.Second))
+	rb := bufio.NewReader(rn)
+	expect(t, rn, rb, "", "-ERR max number of clients reached")
+	closed(t, rb, "RESP over the limit")
+	if r := atomic.LoadInt64(&s.stats.rejected); r != 2 {
+		t.Errorf("rejected %v connections, wanted 2", r)
+	}
+
+	// A closed connection makes room for another
+	expect(t, n2, b2, "quit\r\n")
+	closed(t, b2, "quit")
+	for end := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		n, b := dial(t, s)
+		n.Write([]byte("get sushi\r\n"))
+		r, _ := b.ReadString('\n')
+		n.Close()
+		if r == "END\r\n" {
+			break
+		}
+		if time.Now().After(end) {
+			t.Fatalf("connection after quit got %q", r)
+		}
+	}
+	stats := readStats(t, n1, b1, "stats\r\n")
+	if stats["rejected_connections"] == "0" || stats["throttled_commands"] != "0" {
+		t.Errorf("stats = %v", stats)
+	}
+}
+
+// TestTimeouts verifies clients are disconnected when idle or slow to
+// finish a command, but not while they keep sending commands or are
+// subscribed.
+func TestTimeouts(t *testing.T) {
+	s := startLimited(t, WithTimeouts(200*time.Millisecond, 200*time.Millisecond, 0), WithMemcached(true))
+	defer s.Close()
+
+	idle, ib := dial(t, s)
+	busy, bb := dial(t, s)
+	slow, sb := dial(t, s)
+	sub, subb := dial(t, s)
+	expect(t, sub, subb, "subscribe news\r\n", "SUBSCRIBED news 1")
+	expect(t, idle, ib, "get sushi\r\n", "END")
+	slow.Write([]byte("set sushi 0 0 9\r\ndeli"))
+
+	for i := 0; i < 6; i++ {
+		time.Sleep(100 * time.Millisecond)
+		expect(t, busy, bb, "get sushi\r\n", "END")
+	}
+	expect(t, busy, bb, "publish news hello\r\n", "PUBLISHED 1")
+	expect(t, sub, subb, "", "MESSAGE news", "hello")
+
+	closed(t, ib, "idle")
+	closed(t, sb, "slow")
+}
+
+// TestReadTimeout verifies binary and RESP clients that take too long
+// to send the rest of a command are disconnected, with no idle timeout.
+func TestReadTimeout(t *testing.T) {
+	s := startLimited(t, WithTimeouts(0, 200*time.Millisecond, 0), WithBinaryPort(0), WithRESPPort(0))
+	defer s.Close()
+
+	for _, c := range []struct {
+		l       net.Listener
+		partial []byte
+	}{
+		{s.bl, binPacket(binSet, 1, make([]byte, 8), "sushi", "delicious")[:30]},
+		{s.rl, []byte("*3\r\n$3\r\nSET\r\n$5\r\nsus")},
+	} {
+		n, err := net.Dial("tcp", c.l.Addr().String())
+		if err != nil {
+			t.Fatalf("unable to connect: %v", err)
+		}
+		n.SetDeadline(time.Now().Add(5 * time.Second))
+		start := time.Now()
+		n.Write(c.partial)
+		closed(t, bufio.NewReader(n), "slow")
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("slow client on %v disconnected after %v", c.l.Addr(), d)
+		}
+		n.Close()
+	}
+}
+
+// TestWriteTimeout verifies writes to a client that stops reading give
+// up after the write timeout.
+func TestWriteTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	c := &writeTimeoutConn{server, 50 * time.Millisecond}
+	start := time.Now()
+	if _, err := c.Write([]byte("VALUE sushi\r\n")); err == nil {
+		t.Errorf("write to a client that is not reading succeeded")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("write took %v to time out", d)
+	}
+}
+
+// TestRateLimit verifies each IP's connections share a token bucket,
+// that commands over it are refused on every protocol, and that the
+// bucket is kept after the IP's last connection until it has refilled.
+func TestRateLimit(t *testing.T) {
+	s := startLimited(t, WithRateLimit(1, 3), WithRESPPort(0))
+	defer s.Close()
+
+	if _, err := NewServer(testOptions(WithRateLimit(1, 0))...); err == nil {
+		t.Errorf("NewServer with a burst of 0 succeeded")
+	}
+
+	n1, b1 := dial(t, s)
+	n2, b2 := dial(t, s)
+	expect(t, n1, b1, "get sushi\r\nget sushi\r\n", "END", "END")
+	expect(t, n2, b2, "get sushi\r\nget sushi\r\n", "END", "ERROR rate limited")
+	expect(t, n1, b1, "stats\r\n", "ERROR rate limited")
+
+	rn, err := net.Dial("tcp", s.rl.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect to RESP: %v", err)
+	}
+	rn.SetDeadline(time.Now().Add(5 * time.Second))
+	expect(t, rn, bufio.NewReader(rn), respCmd("PING"), "-ERR rate limited")
+	if th := atomic.LoadInt64(&s.stats.throttled); th != 3 {
+		t.Errorf("throttled %v commands, wanted 3", th)
+	}
+
+	// The bucket refills at a command a second
+	time.Sleep(1100 * time.Millisecond)
+	expect(t, n2, b2, "get sushi\r\nget sushi\r\n", "END", "ERROR rate limited")
+
+	// Reconnecting keeps the empty bucket
+	n1.Close()
+	n2.Close()
+	rn.Close()
+	idle(t, s)
+	n3, b3 := dial(t, s)
+	expect(t, n3, b3, "get sushi\r\n", "ERROR rate limited")
+	n3.Close()
+
+	// Until it has been idle long enough to refill
+	idle(t, s)
+	rl := s.stats.limiter
+	rl.mu.Lock()
+	for _, b := range rl.buckets {
+		b.idle = b.idle.Add(-rl.full)
+	}
+	rl.swept = rl.swept.Add(-rl.full)
+	rl.mu.Unlock()
+	n4, b4 := dial(t, s)
+	expect(t, n4, b4, "get sushi\r\nget sushi\r\nget sushi\r\n", "END", "END", "END")
+	rl.mu.Lock()
+	if len(rl.buckets) != 1 {
+		t.Errorf("%v buckets after the idle one was removed, wanted 1", len(rl.buckets))
+	}
+	rl.mu.Unlock()
+}
+
+// idle waits for every rate limit bucket to have no connections.
+func idle(t *testing.T, s *Server) {
+	rl := s.stats.limiter
+	for end := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		conns := 0
+		rl.mu.Lock()
+		for _, b := range rl.buckets {
+			conns += b.conns
+		}
+		rl.mu.Unlock()
+		if conns == 0 {
+			return
+		}
+		if time.Now().After(end) {
+			t.Fatalf("%v connections left in the buckets after every one closed", conns)
+		}
+	}
+}
+
+// TestRateLimitData verifies the data of a throttled set is read and
+// thrown away, not run as the next command.
+func TestRateLimitData(t *testing.T) {
+	s := startLimited(t, WithRateLimit(1, 2))
+	defer s.Close()
+
+	n, b := dial(t, s)
+	expect(t, n, b, "set sushi\r\ndelicious\r\nget sushi\r\n", "STORED", "VALUE sushi", "delicious", "END")
+	expect(t, n, b, "set y 0 0 7\r\nflushdb\r\nset y\r\nflushdb\r\n", "ERROR rate limited", "ERROR rate limited")
+
+	time.Sleep(1100 * time.Millisecond)
+	expect(t, n, b, "get sushi\r\n", "VALUE sushi", "delicious", "END")
+}
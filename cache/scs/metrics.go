@@ -0,0 +1,265 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the buckets in the
+// command latency histograms.
+var latencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// counterStats are the stats that only ever go up.  Every other stat
+// that is a number is exported as a gauge.
+var counterStats = map[string]bool{
+	"cmd_get":           true,
+	"cmd_set":           true,
+	"get_hits":          true,
+	"get_misses":        true,
+	"delete_hits":       true,
+	"delete_misses":     true,
+	"expired_unfetched": true,
+	"reclaimed":         true,
+	"evictions":         true,
+	"incr_hits":         true,
+	"incr_misses":       true,
+	"decr_hits":         true,
+	"decr_misses":       true,
+}
+
+// binCmdNames names the binary protocol opcodes for the latency
+// histograms.  The quiet opcodes share the name of the loud ones.
+var binCmdNames = map[byte]string{
+	binGet: "get", binGetQ: "get", binGetK: "get", binGetKQ: "get",
+	binSet: "set", binSetQ: "set",
+	binAdd: "add", binAddQ: "add",
+	binReplace: "replace", binReplaceQ: "replace",
+	binAppend: "append", binAppendQ: "append",
+	binPrepend: "prepend", binPrependQ: "prepend",
+	binDelete: "delete", binDeleteQ: "delete",
+	binIncr: "incr", binIncrQ: "incr",
+	binDecr: "decr", binDecrQ: "decr",
+	binStat: "stat", binNoop: "noop", binVersion: "version",
+	binQuit: "quit", binQuitQ: "quit",
+}
+
+// respCmdNames are the commands the RESP listener understands.
+var respCmdNames = []string{"get", "mget", "set", "del", "exists", "ping", "info", "select", "flushdb", "dbsize", "move", "quit"}
+
+// metrics is what the server measures for /metrics on top of the
+// stats.  Everything in it is updated atomically, and the maps are only
+// added to before Serve, so a scrape never takes a lock.
+type metrics struct {
+	listeners []*listenerStats
+	// map[Protocol]map[Command]*histogram
+	latency map[string]map[string]*histogram
+}
+
+// listenerStats counts the connections made to a listener and the
+// bytes they carry, including any TLS overhead.
+type listenerStats struct {
+	protocol string
+	open     int64
+	accepted int64
+	read     int64
+	written  int64
+}
+
+// histogram counts how long a command takes in latencyBuckets.  counts
+// has one more bucket for anything slower, and sum is in nanoseconds.
+type histogram struct {
+	counts []int64
+	sum    int64
+}
+
+func newMetrics() *metrics {
+	return &metrics{latency: make(map[string]map[string]*histogram)}
+}
+
+// listener adds the stats for a listener of protocol.  It must be
+// called before Serve.
+func (m *metrics) listener(protocol string) *listenerStats {
+	st := &listenerStats{protocol: protocol}
+	m.listeners = append(m.listeners, st)
+	return st
+}
+
+// track adds a latency histogram for cmd on protocol, if it does not
+// have one yet.  It must be called before Serve.
+func (m *metrics) track(protocol, cmd string) {
+	if m.latency[protocol] == nil {
+		m.latency[protocol] = make(map[string]*histogram)
+	}
+	if m.latency[protocol][cmd] == nil {
+		m.latency[protocol][cmd] = &histogram{counts: make([]int64, len(latencyBuckets)+1)}
+	}
+}
+
+// observe records that cmd on protocol took since start.  Commands
+// without a histogram are ignored.
+func (m *metrics) observe(protocol, cmd string, start time.Time) {
+	h := m.latency[protocol][cmd]
+	if h != nil {
+		h.observe(time.Since(start))
+	}
+}
+
+// observe records a command that took d.
+func (h *histogram) observe(d time.Duration) {
+	secs := d.Seconds()
+	i := 0
+	for i < len(latencyBuckets) && secs > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// meteredListener counts the connections it accepts and wraps them to
+// count their bytes.
+type meteredListener struct {
+	net.Listener
+	st *listenerStats
+}
+
+func (l *meteredListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&l.st.accepted, 1)
+	atomic.AddInt64(&l.st.open, 1)
+	return &meteredConn{Conn: conn, st: l.st}, nil
+}
+
+// meteredConn counts the bytes read from and written to a connection,
+// and that it is no longer open once it is closed.
+type meteredConn struct {
+	net.Conn
+	st     *listenerStats
+	closed int32
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.st.read, int64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.st.written, int64(n))
+	return n, err
+}
+
+func (c *meteredConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.st.open, -1)
+	}
+	return c.Conn.Close()
+}
+
+// listenMetrics starts listening for /metrics requests on addr:port.
+func (s *Server) listenMetrics(addr string, port int) error {
+	l, err := net.Listen("tcp", fmt.Sprintf("%v:%v", addr, port))
+	if err != nil {
+		return err
+	}
+	s.ml = l
+	return nil
+}
+
+// serveMetrics serves /metrics until the listener is closed.
+func (s *Server) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.writeMetrics)
+	http.Serve(s.ml, mux)
+}
+
+// writeMetrics writes the stats and metrics in the Prometheus text
+// format.  Counter stats get a _total suffix, and stats that are not
+// numbers are written as a gauge of 1 with the value as a label.
+func (s *Server) writeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	for _, st := range s.st.Stats() {
+		name := "scs_" + metricName(st.Name)
+		if _, err := strconv.ParseFloat(st.Value, 64); err != nil {
+			fmt.Fprintf(bw, "# TYPE %v gauge\n%v{%v=%q} 1\n", name, name, metricName(st.Name), st.Value)
+			continue
+		}
+		if counterStats[st.Name] {
+			fmt.Fprintf(bw, "# TYPE %v_total counter\n%v_total %v\n", name, name, st.Value)
+		} else {
+			fmt.Fprintf(bw, "# TYPE %v gauge\n%v %v\n", name, name, st.Value)
+		}
+	}
+
+	families := []struct {
+		name, typ, help string
+		value           func(*listenerStats) *int64
+	}{
+		{"scs_connections", "gauge", "Connections open.", func(l *listenerStats) *int64 { return &l.open }},
+		{"scs_connections_accepted_total", "counter", "Connections accepted.", func(l *listenerStats) *int64 { return &l.accepted }},
+		{"scs_read_bytes_total", "counter", "Bytes read from clients.", func(l *listenerStats) *int64 { return &l.read }},
+		{"scs_written_bytes_total", "counter", "Bytes written to clients.", func(l *listenerStats) *int64 { return &l.written }},
+	}
+	for _, f := range families {
+		fmt.Fprintf(bw, "# HELP %v %v\n# TYPE %v %v\n", f.name, f.help, f.name, f.typ)
+		for _, l := range s.metrics.listeners {
+			fmt.Fprintf(bw, "%v{protocol=%q} %v\n", f.name, l.protocol, atomic.LoadInt64(f.value(l)))
+		}
+	}
+
+	name := "scs_command_duration_seconds"
+	fmt.Fprintf(bw, "# HELP %v Time taken to run commands.\n# TYPE %v histogram\n", name, name)
+	for _, l := range s.metrics.listeners {
+		cmds := s.metrics.latency[l.protocol]
+		names := make([]string, 0, len(cmds))
+		for cmd := range cmds {
+			names = append(names, cmd)
+		}
+		sort.Strings(names)
+
+		for _, cmd := range names {
+			h := cmds[cmd]
+			labels := fmt.Sprintf("protocol=%q,command=%q", l.protocol, cmd)
+			var count int64
+			for i := range h.counts {
+				count += atomic.LoadInt64(&h.counts[i])
+				le := "+Inf"
+				if i < len(latencyBuckets) {
+					le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+				}
+				fmt.Fprintf(bw, "%v_bucket{%v,le=%q} %v\n", name, labels, le, count)
+			}
+			sum := time.Duration(atomic.LoadInt64(&h.sum)).Seconds()
+			fmt.Fprintf(bw, "%v_sum{%v} %v\n", name, labels, sum)
+			fmt.Fprintf(bw, "%v_count{%v} %v\n", name, labels, count)
+		}
+	}
+}
+
+// metricName replaces anything that can not be in a Prometheus metric
+// name with an underscore.
+func metricName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,121 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape fetches /metrics from s and returns its lines.
+func scrape(t *testing.T, s *Server) map[string]bool {
+	t.Helper()
+
+	resp, err := http.Get("http://" + s.ml.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("scrape failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("Content-Type is %q", ct)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("scrape read failed: %v", err)
+	}
+	lines := make(map[string]bool)
+	for _, l := range strings.Split(string(b), "\n") {
+		lines[l] = true
+	}
+	return lines
+}
+
+// TestMetrics verifies /metrics has the stats, the connection and byte
+// counts of each protocol and the command latency histograms.
+func TestMetrics(t *testing.T) {
+	s, err := NewServer(testOptions(WithMetricsPort(0), WithRESPPort(0), WithMaxItems(1))...)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	n, b := dial(t, s)
+	defer n.Close()
+	expect(t, n, b, "set sushi\r\ndelicious\r\nset pizza\r\ncheesy\r\nget pizza\r\n", "STORED", "STORED", "VALUE pizza", "cheesy", "END")
+
+	rn, err := net.Dial("tcp", s.rl.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect to RESP: %v", err)
+	}
+	rn.SetDeadline(time.Now().Add(5 * time.Second))
+	expect(t, rn, bufio.NewReader(rn), respCmd("PING"), "+PONG")
+	rn.Close()
+
+	// The server sees the RESP connection close on its next read
+	for end := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if scrape(t, s)[`scs_connections{protocol="resp"} 0`] {
+			break
+		}
+		if time.Now().After(end) {
+			t.Fatalf("closed RESP connection is still counted as open")
+		}
+	}
+
+	lines := scrape(t, s)
+	for _, want := range []string{
+		"# TYPE scs_cmd_set_total counter",
+		"scs_cmd_set_total 2",
+		"scs_get_hits_total 1",
+		"scs_evictions_total 1",
+		"# TYPE scs_curr_items gauge",
+		"scs_curr_items 1",
+		`scs_role{role="primary"} 1`,
+		`scs_connections{protocol="text"} 1`,
+		`scs_connections_accepted_total{protocol="text"} 1`,
+		`scs_connections_accepted_total{protocol="resp"} 1`,
+		`scs_read_bytes_total{protocol="resp"} 14`,
+		`scs_written_bytes_total{protocol="resp"} 7`,
+		"# TYPE scs_command_duration_seconds histogram",
+		`scs_command_duration_seconds_bucket{protocol="text",command="set",le="+Inf"} 2`,
+		`scs_command_duration_seconds_count{protocol="text",command="set"} 2`,
+		`scs_command_duration_seconds_count{protocol="text",command="get"} 1`,
+		`scs_command_duration_seconds_count{protocol="text",command="delete"} 0`,
+		`scs_command_duration_seconds_count{protocol="resp",command="ping"} 1`,
+	} {
+		if !lines[want] {
+			t.Errorf("/metrics is missing %q", want)
+		}
+	}
+	for l := range lines {
+		if strings.Contains(l, `protocol="binary"`) {
+			t.Errorf("/metrics has %q without a binary listener", l)
+		}
+	}
+}
+
+// TestHistogram verifies commands are counted in the first bucket they
+// fit in.
+func TestHistogram(t *testing.T) {
+	m := newMetrics()
+	m.track("text", "get")
+	m.observe("text", "unknown", time.Now())
+
+	h := m.latency["text"]["get"]
+	h.observe(50 * time.Microsecond)
+	h.observe(time.Millisecond)
+	h.observe(2 * time.Second)
+	if h.counts[0] != 1 || h.counts[3] != 1 || h.counts[len(latencyBuckets)] != 1 {
+		t.Errorf("bucket counts are %v", h.counts)
+	}
+	if want := int64(2*time.Second + time.Millisecond + 50*time.Microsecond); h.sum != want {
+		t.Errorf("sum is %v, wanted %v", h.sum, want)
+	}
+}
@@ -0,0 +1,562 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Operations recorded in the mutation log.  opSelect makes the records
+// after it apply to another database, and its key is the number of the
+// database in decimal.  Logs start in database 0.  opFlush removes every
+// item in the database, and its key is empty.
+const (
+	opStore  = 'S'
+	opRemove = 'r'
+	opExpire = 'e'
+	opSelect = 'd'
+	opFlush  = 'f'
+)
+
+// errRewriteInProgress is returned when a rewrite is asked for while
+// another one is still running.
+var errRewriteInProgress = errors.New("ERROR log rewrite already in progress")
+
+// mutationLog appends every change made to the dataCache to a file so
+// it can be replayed after a restart.  Changes are recorded by the
+// cacheShard methods that make them rather than by command, so any
+// handler that changes the cache through store, remove and setTTL is
+// logged, as are evictions and expirations.
+//
+// Each record is a uvarint length, the payload, and a CRC32 of the
+// payload.  The payload is the operation followed by its key, and for
+// opStore the value and flags as a uvarint, and for opStore and opExpire
+// the expiration time in unix nanoseconds (0 for none).  Strings are
+// prefixed by their length as a uvarint.
+//
+// Records are written while the shard of their key is locked, so the
+// records of a key are always in the order its changes were made.  mu
+// serializes writes from different shards.  A change is written after
+// an opSelect record whenever it is in another database than the one
+// before it.
+type mutationLog struct {
+	mu    sync.Mutex
+	path  string
+	f     *os.File
+	fsync string
+	buf   []byte
+	db    int // the database of the last record written, -1 if unknown
+
+	// rewriting is set while rewrite is writing the current state of
+	// the cache to a new log.  Records appended meanwhile are kept in
+	// rewriteBuf to be added to the end of the new log.
+	rewriting  bool
+	rewriteBuf []byte
+}
+
+// setLog replays the mutation log at path into the cache, then appends
+// every change to it from then on.  fsync is how often the log is
+// flushed to disk: "always" after each change, "everysec", or "never"
+// to leave it to the OS.  If the log did not exist, the current cache
+// is written to it first, and if it did, items over the limits are
+// evicted after it is replayed.  It must be called before Serve.
+func (s *Server) setLog(path, fsync string) error {
+	if fsync != "always" && fsync != "everysec" && fsync != "never" {
+		return fmt.Errorf("unknown fsync policy '%v', must be one of always, everysec or never", fsync)
+	}
+
+	s.c.lockAll()
+	defer s.c.unlockAll()
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if fi.Size() == 0 {
+		// A new log starts with everything already in the cache,
+		// such as items loaded from a snapshot
+		var db int
+		for _, e := range s.c.snapshotEntries() {
+			_, err = f.Write(encodeEntry(nil, &db, e))
+			if err != nil {
+				f.Close()
+				return err
+			}
+		}
+	} else {
+		// The log holds the full history of the cache, so it
+		// replaces anything loaded from elsewhere
+		for _, sh := range s.c.shards {
+			for k := range sh.Cache {
+				sh.remove(k)
+			}
+		}
+		err = s.c.replayLog(f)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("%v: %v", path, err)
+		}
+	}
+	atomic.StoreInt64(&s.c.dirty, 0)
+
+	s.c.log = &mutationLog{path: path, f: f, fsync: fsync, db: -1}
+	// The log may have been written under higher limits.  Evicting
+	// once it is set logs the removals, so the next replay matches.
+	s.c.trim()
+	if fsync == "everysec" {
+		go s.syncLog()
+	}
+	return nil
+}
+
+// syncLog flushes the mutation log to disk every second until the
+// server closes.  The log is only locked to find the current file, so
+// commands can run while the disk catches up.
+func (s *Server) syncLog() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			s.c.log.mu.Lock()
+			f := s.c.log.f
+			s.c.log.mu.Unlock()
+			f.Sync()
+		}
+	}
+}
+
+// replayLog applies every record in the log to the cache.  A record that
+// is cut short or fails its checksum means the server stopped part way
+// through writing it, so the log is truncated there.  The caller must
+// hold every shard lock.
+func (c *dataCache) replayLog(f *os.File) error {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	db := c.dbs[0]
+	var good int64
+	for {
+		var n int64
+		db, n, err = c.replayRecord(r, db)
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(dbRangeError); ok {
+			return err
+		}
+		if err != nil {
+			fmt.Printf("mutation log damaged at offset %v, truncating: %v\n", good, err)
+			err = f.Truncate(good)
+			if err != nil {
+				return err
+			}
+			break
+		}
+		good += n
+	}
+
+	_, err = f.Seek(good, io.SeekStart)
+	return err
+}
+
+// replayRecord reads a single record from r and applies it to db,
+// returning the database the next record is for and the number of bytes
+// it took up.  The caller must hold every shard lock.
+func (c *dataCache) replayRecord(r *bufio.Reader, db *database) (*database, int64, error) {
+	payload, n, err := readRecord(r)
+	if err != nil {
+		return db, 0, err
+	}
+
+	op, key, value, flags, expires, err := decodeRecord(payload)
+	if err != nil {
+		return db, 0, err
+	}
+	db, err = c.apply(db, op, key, value, flags, expires)
+	if err != nil {
+		return db, 0, err
+	}
+	return db, n, nil
+}
+
+// apply makes the change a decoded record describes to db, and returns
+// the database the records after it are for, which only opSelect
+// changes.  The caller must hold the lock of key's shard, or every shard
+// lock of db for opFlush.
+func (c *dataCache) apply(db *database, op byte, key string, value []byte, flags uint32, expires int64) (*database, error) {
+	switch op {
+	case opSelect:
+		next, err := c.selectRecord(key)
+		if err != nil {
+			return db, err
+		}
+		return next, nil
+	case opFlush:
+		db.clear()
+		return db, nil
+	}
+	return db, db.shard(key).applyRecord(op, key, value, flags, expires)
+}
+
+// selectRecord returns the database an opSelect record for key selects.
+func (c *dataCache) selectRecord(key string) (*database, error) {
+	n, err := strconv.Atoi(key)
+	if err != nil {
+		return nil, fmt.Errorf("bad database %q", key)
+	}
+	return c.database(n)
+}
+
+// readRecord reads a single record from r and checks its checksum,
+// returning its payload and the number of bytes it took up.
+func readRecord(r *bufio.Reader) ([]byte, int64, error) {
+	size, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		return nil, 0, io.EOF
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if size > MAX_KEY_SIZE+MAX_DATA_SIZE+64 {
+		return nil, 0, fmt.Errorf("record of %v bytes is too large", size)
+	}
+
+	payload := make([]byte, size+4)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	payload, sum := payload[:size], binary.BigEndian.Uint32(payload[size:])
+	if crc32.ChecksumIEEE(payload) != sum {
+		return nil, 0, fmt.Errorf("checksum mismatch")
+	}
+
+	var b [binary.MaxVarintLen64]byte
+	return payload, int64(binary.PutUvarint(b[:], size) + len(payload) + 4), nil
+}
+
+// applyRecord makes the change a decoded record describes.  The caller
+// must hold the shard lock.
+func (sh *cacheShard) applyRecord(op byte, key string, value []byte, flags uint32, expires int64) error {
+	now := time.Now()
+	switch op {
+	case opStore:
+		var ttl time.Duration
+		if expires != 0 {
+			ttl = time.Unix(0, expires).Sub(now)
+		}
+		if ttl < 0 {
+			sh.remove(key)
+		} else {
+			sh.store(key, value, flags, ttl)
+		}
+	case opRemove:
+		sh.remove(key)
+	case opExpire:
+		i, ok := sh.Cache[key]
+		if !ok {
+			break
+		}
+		var ttl time.Duration
+		if expires != 0 {
+			ttl = time.Unix(0, expires).Sub(now)
+		}
+		if ttl < 0 {
+			sh.remove(key)
+		} else {
+			sh.setExpires(key, i, ttl)
+		}
+	default:
+		return fmt.Errorf("unknown operation %q", op)
+	}
+	return nil
+}
+
+// decodeRecord splits a record payload into its fields.
+func decodeRecord(p []byte) (op byte, key string, value []byte, flags uint32, expires int64, err error) {
+	if len(p) == 0 {
+		return 0, "", nil, 0, 0, io.ErrUnexpectedEOF
+	}
+	op, p = p[0], p[1:]
+
+	getBytes := func() ([]byte, error) {
+		n, l := binary.Uvarint(p)
+		if l <= 0 || n > uint64(len(p)-l) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b := p[l : l+int(n)]
+		p = p[l+int(n):]
+		return b, nil
+	}
+	getTime := func() (int64, error) {
+		if len(p) < 8 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		t := int64(binary.BigEndian.Uint64(p))
+		p = p[8:]
+		return t, nil
+	}
+
+	k, err := getBytes()
+	if err != nil {
+		return
+	}
+	key = string(k)
+	switch op {
+	case opStore:
+		value, err = getBytes()
+		if err != nil {
+			return
+		}
+		f, l := binary.Uvarint(p)
+		if l <= 0 {
+			err = io.ErrUnexpectedEOF
+			return
+		}
+		flags, p = uint32(f), p[l:]
+		expires, err = getTime()
+	case opExpire:
+		expires, err = getTime()
+	}
+	return
+}
+
+// appendRecord frames a payload as a log record and appends it to dst.
+func appendRecord(dst, payload []byte) []byte {
+	var b [binary.MaxVarintLen64]byte
+	dst = append(dst, b[:binary.PutUvarint(b[:], uint64(len(payload)))]...)
+	dst = append(dst, payload...)
+	binary.BigEndian.PutUint32(b[:4], crc32.ChecksumIEEE(payload))
+	return append(dst, b[:4]...)
+}
+
+// appendString appends s prefixed by its length to dst.
+func appendString(dst []byte, s string) []byte {
+	var b [binary.MaxVarintLen64]byte
+	dst = append(dst, b[:binary.PutUvarint(b[:], uint64(len(s)))]...)
+	return append(dst, s...)
+}
+
+// appendBytes appends s prefixed by its length to dst.
+func appendBytes(dst []byte, s []byte) []byte {
+	var b [binary.MaxVarintLen64]byte
+	dst = append(dst, b[:binary.PutUvarint(b[:], uint64(len(s)))]...)
+	return append(dst, s...)
+}
+
+// appendTime appends t as unix nanoseconds, or 0 for the zero time.
+func appendTime(dst []byte, t time.Time) []byte {
+	var n int64
+	if !t.IsZero() {
+		n = t.UnixNano()
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	return append(dst, b[:]...)
+}
+
+// encodeStore appends an opStore record to dst.
+func encodeStore(dst []byte, key string, value []byte, flags uint32, expires time.Time) []byte {
+	p := appendString([]byte{opStore}, key)
+	p = appendBytes(p, value)
+	var b [binary.MaxVarintLen64]byte
+	p = append(p, b[:binary.PutUvarint(b[:], uint64(flags))]...)
+	return appendRecord(dst, appendTime(p, expires))
+}
+
+// encodeRemove appends an opRemove record to dst.
+func encodeRemove(dst []byte, key string) []byte {
+	return appendRecord(dst, appendString([]byte{opRemove}, key))
+}
+
+// encodeSelect appends an opSelect record for database db to dst.
+func encodeSelect(dst []byte, db int) []byte {
+	return appendRecord(dst, appendString([]byte{opSelect}, strconv.Itoa(db)))
+}
+
+// encodeEntry appends an opStore record for e to dst, after an opSelect
+// record if e is in another database than *db, the database of the
+// records before it, which it then updates.
+func encodeEntry(dst []byte, db *int, e snapshotEntry) []byte {
+	if e.db != *db {
+		dst = encodeSelect(dst, e.db)
+		*db = e.db
+	}
+	return encodeStore(dst, e.key, e.value, e.flags, e.expires)
+}
+
+// encodeFlush appends an opFlush record to dst.
+func encodeFlush(dst []byte) []byte {
+	return appendRecord(dst, appendString([]byte{opFlush}, ""))
+}
+
+// encodeExpire appends an opExpire record to dst.
+func encodeExpire(dst []byte, key string, expires time.Time) []byte {
+	return appendRecord(dst, appendTime(appendString([]byte{opExpire}, key), expires))
+}
+
+// stored records key being set to value in database db.  Like removed
+// and expires, it holds mu while encoding as the record is built in
+// buf.
+func (l *mutationLog) stored(db int, key string, value []byte, flags uint32, expires time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.write(encodeStore(l.selectDB(db), key, value, flags, expires))
+}
+
+// removed records key being removed from database db.
+func (l *mutationLog) removed(db int, key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.write(encodeRemove(l.selectDB(db), key))
+}
+
+// expires records the expiration of key in database db changing.
+func (l *mutationLog) expires(db int, key string, expires time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.write(encodeExpire(l.selectDB(db), key, expires))
+}
+
+// flushed records every item in database db being removed.
+func (l *mutationLog) flushed(db int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.write(encodeFlush(l.selectDB(db)))
+}
+
+// selectDB empties buf for the next record, which is for database db,
+// and starts it with an opSelect record if the last one was for another
+// database.  The caller must hold mu.
+func (l *mutationLog) selectDB(db int) []byte {
+	buf := l.buf[:0]
+	if db != l.db {
+		buf = encodeSelect(buf, db)
+		l.db = db
+	}
+	return buf
+}
+
+// write appends a record to the log file, and to the rewrite buffer
+// if a rewrite is running.  The caller must hold mu.
+func (l *mutationLog) write(rec []byte) {
+	l.buf = rec
+	_, err := l.f.Write(rec)
+	if err != nil {
+		fmt.Println("failed to write mutation log: ", err)
+	}
+	if l.rewriting {
+		l.rewriteBuf = append(l.rewriteBuf, rec...)
+	}
+	if l.fsync == "always" {
+		l.f.Sync()
+	}
+}
+
+// rewrite compacts the log by writing the current cache to a new log
+// in the background, then replacing the old log with it.  c is the
+// cache the log belongs to, whose shards the caller must all lock so
+// the copy matches the point the rewrite buffer starts from.
+func (l *mutationLog) rewrite(c *dataCache) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rewriting {
+		return errRewriteInProgress
+	}
+	l.rewriting = true
+	l.rewriteBuf = nil
+	// The new log could end in any database, so the first record
+	// added to it has to say which it is for
+	l.db = -1
+	entries := c.snapshotEntries()
+
+	go func() {
+		f, err := l.writeBase(entries)
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.rewriting = false
+		if err == nil {
+			err = l.finishRewrite(f)
+		}
+		l.rewriteBuf = nil
+		if err != nil {
+			if f != nil {
+				f.Close()
+				os.Remove(f.Name())
+			}
+			fmt.Println("mutation log rewrite failed: ", err)
+		}
+	}()
+	return nil
+}
+
+// writeBase writes entries to a new temporary log next to the current
+// one.  It does not need the lock.
+func (l *mutationLog) writeBase(entries []snapshotEntry) (*os.File, error) {
+	f, err := ioutil.TempFile(filepath.Dir(l.path), filepath.Base(l.path)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+	var rec []byte
+	var db int
+	for _, e := range entries {
+		rec = encodeEntry(rec[:0], &db, e)
+		w.Write(rec)
+	}
+	err = w.Flush()
+	if err != nil {
+		return f, err
+	}
+	return f, f.Sync()
+}
+
+// finishRewrite appends the changes made during the rewrite to the new
+// log and moves it over the old one.  The caller must hold mu.
+func (l *mutationLog) finishRewrite(f *os.File) error {
+	_, err := f.Write(l.rewriteBuf)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(f.Name(), l.path)
+	if err != nil {
+		return err
+	}
+	l.f.Close()
+	l.f = f
+	return nil
+}
@@ -0,0 +1,148 @@
+package scs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestMutationLog verifies changes made to the cache are replayed into
+// a new server, and that a damaged record at the end is truncated.
+func TestMutationLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "scs.log")
+
+	s, n, b := startServer(t, 65535)
+	if err := s.setLog(path, "sometimes"); err == nil {
+		t.Errorf("setLog with an unknown fsync policy succeeded")
+	}
+	if err := s.setLog(path, "always"); err != nil {
+		t.Fatalf("setLog = %v", err)
+	}
+	expect(t, n, b, "set sushi\r\ndelicious\r\n", "STORED")
+	expect(t, n, b, "set topcoder\r\nfun\r\n", "STORED")
+	expect(t, n, b, "set gone\r\nsoon\r\n", "STORED")
+	expect(t, n, b, "set sushi\r\ntasty\r\n", "STORED")
+	expect(t, n, b, "delete gone\r\n", "DELETED")
+	expect(t, n, b, "expire topcoder 100\r\n", "TOUCHED")
+	s.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{20, 's', 3})
+	f.Close()
+
+	s, n, b = startServer(t, 65535)
+	defer s.Close()
+	if err := s.setLog(path, "never"); err != nil {
+		t.Fatalf("setLog = %v", err)
+	}
+	expect(t, n, b, "get sushi topcoder gone\r\n", "VALUE sushi", "tasty", "VALUE topcoder", "fun", "END")
+	expect(t, n, b, "ttl topcoder\r\n", "TTL 100")
+
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() != fi.Size() {
+		t.Errorf("log is %v bytes after replay, wanted it truncated to %v", after.Size(), fi.Size())
+	}
+}
+
+// TestMutationLogLimits verifies a log written under a higher item
+// limit is trimmed to the limit of the server replaying it, and that
+// the evictions are logged.
+func TestMutationLogLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "scs.log")
+
+	s, n, b := startServer(t, 65535)
+	if err := s.setLog(path, "always"); err != nil {
+		t.Fatalf("setLog = %v", err)
+	}
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		expect(t, n, b, "set "+k+"\r\ndata\r\n", "STORED")
+	}
+	s.Close()
+
+	for _, max := range []int{3, 65535} {
+		s, n, b = startServer(t, max)
+		if err := s.setLog(path, "always"); err != nil {
+			t.Fatalf("setLog = %v", err)
+		}
+		stats := readStats(t, n, b, "stats\r\n")
+		if stats["curr_items"] != "3" {
+			t.Errorf("curr_items = %v with an item limit of %v, wanted 3", stats["curr_items"], max)
+		}
+		s.Close()
+	}
+}
+
+// TestRewriteLog verifies rewritelog compacts the log down to the
+// current cache and keeps changes made after it.
+func TestRewriteLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "scs.log")
+
+	s, n, b := startServer(t, 65535)
+	expect(t, n, b, "rewritelog\r\n", "ERROR no mutation log configured")
+	expect(t, n, b, "set before\r\nthe log\r\n", "STORED")
+	if err := s.setLog(path, "everysec"); err != nil {
+		t.Fatalf("setLog = %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		expect(t, n, b, "set counter\r\n"+strconv.Itoa(i)+"\r\n", "STORED")
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect(t, n, b, "rewritelog\r\n", "BACKGROUND_REWRITE_STARTED")
+	for i := 0; i < 100; i++ {
+		s.c.log.mu.Lock()
+		rewriting := s.c.log.rewriting
+		s.c.log.mu.Unlock()
+		if !rewriting {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Errorf("log is %v bytes after rewrite, wanted less than %v", after.Size(), before.Size())
+	}
+	expect(t, n, b, "set after\r\nthe rewrite\r\n", "STORED")
+	s.Close()
+
+	s, n, b = startServer(t, 65535)
+	defer s.Close()
+	if err := s.setLog(path, "never"); err != nil {
+		t.Fatalf("setLog = %v", err)
+	}
+	expect(t, n, b, "get before counter after\r\n", "VALUE before", "the log", "VALUE counter", "99", "VALUE after", "the rewrite", "END")
+}
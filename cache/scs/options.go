@@ -0,0 +1,213 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import "time"
+
+// Option configures a Server when it is created by NewServer.
+type Option func(*options)
+
+// options holds everything NewServer can be told.  The defaults are the
+// same as the scs command's flags.
+type options struct {
+	addr         string
+	port         int
+	binaryPort   int // -1 leaves the binary protocol off
+	respPort     int // -1 leaves RESP off
+	metricsPort  int // -1 leaves /metrics off
+	maxItems     int
+	maxBytes     int
+	shards       int
+	databases    int
+	policy       string
+	memcached    bool
+	snapshot     string
+	saveRules    string
+	log          string
+	fsync        string
+	replicaOf    string
+	tlsCert      string
+	tlsKey       string
+	tlsCA        string
+	auth         string
+	maxConns     int
+	idleTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	rateLimit    float64
+	rateBurst    int
+	storage      Storage
+}
+
+func defaultOptions() options {
+	return options{
+		port:        11212,
+		binaryPort:  -1,
+		respPort:    -1,
+		metricsPort: -1,
+		maxItems:    65535,
+		maxBytes:    64 * 1024 * 1024,
+		shards:      16,
+		databases:   1,
+		policy:      "lru",
+		saveRules:   "900 1 300 10 60 10000",
+		fsync:       "everysec",
+	}
+}
+
+// WithAddr sets the IP address every listener binds to.  The default
+// of "" listens on all of them.
+func WithAddr(addr string) Option {
+	return func(o *options) { o.addr = addr }
+}
+
+// WithPort sets the port the text protocol listens on.  0 picks any
+// free port, which Addr reports.
+func WithPort(port int) Option {
+	return func(o *options) { o.port = port }
+}
+
+// WithBinaryPort turns on the memcached binary protocol on port.
+func WithBinaryPort(port int) Option {
+	return func(o *options) { o.binaryPort = port }
+}
+
+// WithRESPPort turns on the Redis RESP protocol on port.
+func WithRESPPort(port int) Option {
+	return func(o *options) { o.respPort = port }
+}
+
+// WithMetricsPort turns on an HTTP listener on port that serves the
+// stats and metrics at /metrics in the Prometheus text format.  It is
+// always plain HTTP, even with WithTLS.
+func WithMetricsPort(port int) Option {
+	return func(o *options) { o.metricsPort = port }
+}
+
+// WithMaxItems sets the most items each database of the cache holds.
+func WithMaxItems(n int) Option {
+	return func(o *options) { o.maxItems = n }
+}
+
+// WithMaxBytes sets the most bytes of keys and values each database of
+// the cache holds.  0 means no limit.
+func WithMaxBytes(n int) Option {
+	return func(o *options) { o.maxBytes = n }
+}
+
+// WithShards sets how many independently locked shards each database
+// is split into.  The default is 16.
+func WithShards(n int) Option {
+	return func(o *options) { o.shards = n }
+}
+
+// WithDatabases splits the cache into n isolated databases that
+// clients switch between with select.  Each has its own shards, stats
+// and item and memory limits of the sizes WithMaxItems and WithMaxBytes
+// give.  The default is 1.
+func WithDatabases(n int) Option {
+	return func(o *options) { o.databases = n }
+}
+
+// WithEvictionPolicy sets how the cache makes room for new keys once it
+// is full: lru, lfu, random or reject.
+func WithEvictionPolicy(name string) Option {
+	return func(o *options) { o.policy = name }
+}
+
+// WithMemcached makes get reply with VALUE <key> <flags> <bytes> lines
+// like memcached does, instead of only the key, so stock memcached
+// clients can read from the cache.
+func WithMemcached(on bool) Option {
+	return func(o *options) { o.memcached = on }
+}
+
+// WithSnapshot loads the cache from path and saves it back there.
+func WithSnapshot(path string) Option {
+	return func(o *options) { o.snapshot = path }
+}
+
+// WithSaveRules sets the pairs of "<seconds> <changes>" that trigger a
+// background save of the snapshot once both are reached.
+func WithSaveRules(rules string) Option {
+	return func(o *options) { o.saveRules = rules }
+}
+
+// WithLog appends every change to the mutation log at path, which is
+// replayed when the server starts.  fsync is always, everysec or never.
+func WithLog(path, fsync string) Option {
+	return func(o *options) {
+		o.log = path
+		o.fsync = fsync
+	}
+}
+
+// WithReplicaOf makes the server a read only replica of the primary at
+// addr.  It copies the primary's cache, then applies every change the
+// primary makes, copying it again whenever the link drops.
+func WithReplicaOf(addr string) Option {
+	return func(o *options) { o.replicaOf = addr }
+}
+
+// WithTLS makes every listener serve TLS with the PEM certificate and
+// key in certFile and keyFile.  If caFile is not "", clients must
+// connect with a certificate signed by one of the CAs in it, and the
+// common name of its subject is the Request's Identity.
+func WithTLS(certFile, keyFile, caFile string) Option {
+	return func(o *options) {
+		o.tlsCert = certFile
+		o.tlsKey = keyFile
+		o.tlsCA = caFile
+	}
+}
+
+// WithAuth makes clients run auth with a domain, username and password
+// from the JSON user file at path before any other command.  It uses
+// the same format as the auth package, and is read again whenever it
+// changes.  Only the text protocol has auth, so the binary and RESP
+// protocols can not be used with it.
+func WithAuth(path string) Option {
+	return func(o *options) { o.auth = path }
+}
+
+// WithMaxConns limits the client connections open at once over every
+// protocol to n.  Clients over it are sent an error and disconnected.
+// The default of 0 has no limit.
+func WithMaxConns(n int) Option {
+	return func(o *options) { o.maxConns = n }
+}
+
+// WithTimeouts sets how long a client can take before it is
+// disconnected.  idle is the time between commands, read the time for
+// the rest of a command, such as the data of a set, once its first line
+// has arrived, and write the time each write to the client can take.
+// Subscribers waiting for messages are never idle.  0 leaves a timeout
+// off, which is the default.
+func WithTimeouts(idle, read, write time.Duration) Option {
+	return func(o *options) {
+		o.idleTimeout = idle
+		o.readTimeout = read
+		o.writeTimeout = write
+	}
+}
+
+// WithRateLimit limits each client IP to rate commands a second over
+// all of its connections, with bursts of up to burst commands.
+// Commands over it reply "ERROR rate limited" instead of running.  A
+// rate of 0, the default, has no limit.
+func WithRateLimit(rate float64, burst int) Option {
+	return func(o *options) {
+		o.rateLimit = rate
+		o.rateBurst = burst
+	}
+}
+
+// WithStorage makes the server keep its data in st instead of its own
+// sharded cache.  The limits, eviction policy, snapshot, mutation log
+// and replication all belong to the built in cache, so they can not be
+// used with it.
+func WithStorage(st Storage) Option {
+	return func(o *options) { o.storage = st }
+}
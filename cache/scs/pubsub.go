@@ -0,0 +1,365 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+)
+
+// subscriberBacklog is how many bytes of messages can wait to be sent
+// to a subscriber before it is disconnected for being too slow.
+const subscriberBacklog = 1024 * 1024
+
+// pubsub routes published messages to the connections subscribed to
+// their channel, or to a pattern matching it.
+type pubsub struct {
+	backlog  int // subscriberBacklog, or less for tests
+	mu       sync.RWMutex
+	channels map[string]map[*subscriber]struct{}
+	patterns map[string]map[*subscriber]struct{}
+}
+
+// subscriber is the connection of a client that has subscribed.  Once
+// a client subscribes, everything written to it goes through queue, so
+// messages published from other connections and the replies to its own
+// commands are sent whole and in order by a goroutine of its own.
+// Replies are held in buf until the connection is flushed.
+type subscriber struct {
+	net.Conn
+	raw      net.Conn // closed directly when the client is too slow
+	buf      bytes.Buffer
+	channels map[string]struct{} // only used by the connection's goroutine
+	patterns map[string]struct{}
+
+	mu      sync.Mutex
+	queue   [][]byte
+	pending int // bytes in queue
+	backlog int
+	wake    chan struct{}
+	closed  bool
+}
+
+func newPubSub() *pubsub {
+	return &pubsub{
+		backlog:  subscriberBacklog,
+		channels: make(map[string]map[*subscriber]struct{}),
+		patterns: make(map[string]map[*subscriber]struct{}),
+	}
+}
+
+// subscriber switches the connection into push mode the first time it
+// is called, and returns its subscriber.
+func (c *Request) subscriber() *subscriber {
+	if c.sub != nil {
+		return c.sub
+	}
+	c.Flush()
+	sub := &subscriber{
+		Conn:     c.Conn,
+		raw:      c.Conn,
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		wake:     make(chan struct{}, 1),
+		backlog:  c.ps.backlog,
+	}
+	if b, ok := c.Conn.(*bufferedConn); ok {
+		sub.raw = b.Conn
+	}
+	go sub.run()
+	c.sub = sub
+	c.Conn = sub
+	return sub
+}
+
+// Write holds p until the connection is flushed.
+func (sub *subscriber) Write(p []byte) (int, error) {
+	return sub.buf.Write(p)
+}
+
+// WriteString holds s until the connection is flushed.
+func (sub *subscriber) WriteString(s string) (int, error) {
+	return sub.buf.WriteString(s)
+}
+
+// Flush queues the replies written since the last flush.
+func (sub *subscriber) Flush() error {
+	if sub.buf.Len() == 0 {
+		return nil
+	}
+	p := append([]byte(nil), sub.buf.Bytes()...)
+	sub.buf.Reset()
+	if !sub.push(p) {
+		return fmt.Errorf("subscriber disconnected")
+	}
+	return nil
+}
+
+// Close sends everything queued, then closes the connection.
+func (sub *subscriber) Close() error {
+	sub.Flush()
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if !sub.closed {
+		sub.closed = true
+		close(sub.wake)
+	}
+	return nil
+}
+
+// push queues p to be sent, or disconnects the client if that would
+// put it more than its backlog of bytes behind.  It reports if p was
+// queued.
+func (sub *subscriber) push(p []byte) bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return false
+	}
+	if sub.pending+len(p) > sub.backlog {
+		sub.closed = true
+		sub.queue = nil
+		close(sub.wake)
+		// Closing the socket itself fails a write that is blocked
+		// on the client, where closing Conn would wait to flush
+		sub.raw.Close()
+		return false
+	}
+
+	sub.queue = append(sub.queue, p)
+	sub.pending += len(p)
+	select {
+	case sub.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// run sends what is queued whenever push wakes it, until the connection
+// is closed or a write fails.
+func (sub *subscriber) run() {
+	for {
+		_, ok := <-sub.wake
+		sub.mu.Lock()
+		q := sub.queue
+		sub.queue = nil
+		sub.mu.Unlock()
+
+		n := 0
+		var err error
+		for _, p := range q {
+			n += len(p)
+			_, err = sub.Conn.Write(p)
+		}
+		if f, isFlusher := sub.Conn.(flusher); isFlusher && err == nil {
+			err = f.Flush()
+		}
+		if err != nil || !ok {
+			sub.Conn.Close()
+			return
+		}
+
+		sub.mu.Lock()
+		sub.pending -= n
+		sub.mu.Unlock()
+	}
+}
+
+// subscribe adds sub to name in set.
+func (ps *pubsub) subscribe(set map[string]map[*subscriber]struct{}, name string, sub *subscriber) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	subs, ok := set[name]
+	if !ok {
+		subs = make(map[*subscriber]struct{})
+		set[name] = subs
+	}
+	subs[sub] = struct{}{}
+}
+
+// unsubscribe removes sub from name in set.
+func (ps *pubsub) unsubscribe(set map[string]map[*subscriber]struct{}, name string, sub *subscriber) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	delete(set[name], sub)
+	if len(set[name]) == 0 {
+		delete(set, name)
+	}
+}
+
+// unsubscribeAll removes every subscription of sub, when its connection
+// closes.
+func (ps *pubsub) unsubscribeAll(sub *subscriber) {
+	for ch := range sub.channels {
+		ps.unsubscribe(ps.channels, ch, sub)
+	}
+	for pat := range sub.patterns {
+		ps.unsubscribe(ps.patterns, pat, sub)
+	}
+}
+
+// publish sends msg to every subscriber of channel and every
+// subscriber of a pattern matching it, and returns how many it was
+// sent to.
+func (ps *pubsub) publish(channel, msg string) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	n := 0
+	if subs := ps.channels[channel]; len(subs) != 0 {
+		frame := []byte("MESSAGE " + channel + "\r\n" + msg + "\r\n")
+		for sub := range subs {
+			if sub.push(frame) {
+				n++
+			}
+		}
+	}
+	for pat, subs := range ps.patterns {
+		if ok, _ := path.Match(pat, channel); !ok {
+			continue
+		}
+		frame := []byte("PMESSAGE " + pat + " " + channel + "\r\n" + msg + "\r\n")
+		for sub := range subs {
+			if sub.push(frame) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// subscribed is the number of channels and patterns sub is subscribed
+// to.
+func (sub *subscriber) subscribed() int {
+	if sub == nil {
+		return 0
+	}
+	return len(sub.channels) + len(sub.patterns)
+}
+
+// pubsubCmds are the only commands a connection can send while it is
+// subscribed to something.
+var pubsubCmds = map[string]bool{
+	"subscribe":    true,
+	"unsubscribe":  true,
+	"psubscribe":   true,
+	"punsubscribe": true,
+	"quit":         true,
+}
+
+// cmdSubscribe takes one or more channels and sends every message
+// published to them to the connection as MESSAGE <channel> followed by
+// a line holding the message.  Each channel is acknowledged with
+// SUBSCRIBED <channel> <subscriptions>.  While subscribed, only the
+// subscribe family of commands and quit can be sent.
+func cmdSubscribe(c *Request) {
+	subscribeCmd(c, false)
+}
+
+// cmdPsubscribe is subscribe for patterns, matched against the channel
+// with path.Match.  Messages are sent as PMESSAGE <pattern> <channel>.
+func cmdPsubscribe(c *Request) {
+	subscribeCmd(c, true)
+}
+
+// subscribeCmd handles subscribe and psubscribe.
+func subscribeCmd(c *Request, pattern bool) {
+	if len(c.Subcmd) == 0 {
+		c.WriteStr(fmt.Sprintf("ERROR %v command requires at least one channel", c.Cmd))
+		return
+	}
+	if pattern {
+		for _, pat := range c.Subcmd {
+			if _, err := path.Match(pat, ""); err != nil {
+				c.WriteStr("ERROR invalid pattern " + pat)
+				return
+			}
+		}
+	}
+
+	sub := c.subscriber()
+	set, mine, reply := c.ps.channels, sub.channels, "SUBSCRIBED "
+	if pattern {
+		set, mine, reply = c.ps.patterns, sub.patterns, "PSUBSCRIBED "
+	}
+	for _, name := range c.Subcmd {
+		if _, ok := mine[name]; !ok {
+			mine[name] = struct{}{}
+			c.ps.subscribe(set, name, sub)
+		}
+		c.WriteStr(fmt.Sprintf("%v%v %v", reply, name, sub.subscribed()))
+	}
+}
+
+// cmdUnsubscribe takes the channels to stop receiving messages from, or
+// none for all of them.  Each one is acknowledged with
+// UNSUBSCRIBED <channel> <subscriptions left>, or NOT_SUBSCRIBED if
+// there are none to remove.
+func cmdUnsubscribe(c *Request) {
+	unsubscribeCmd(c, false)
+}
+
+// cmdPunsubscribe is unsubscribe for patterns.
+func cmdPunsubscribe(c *Request) {
+	unsubscribeCmd(c, true)
+}
+
+// unsubscribeCmd handles unsubscribe and punsubscribe.
+func unsubscribeCmd(c *Request, pattern bool) {
+	sub := c.sub
+	if sub == nil {
+		c.WriteStr("NOT_SUBSCRIBED")
+		return
+	}
+	set, mine, reply := c.ps.channels, sub.channels, "UNSUBSCRIBED "
+	if pattern {
+		set, mine, reply = c.ps.patterns, sub.patterns, "PUNSUBSCRIBED "
+	}
+
+	names := c.Subcmd
+	if len(names) == 0 {
+		for name := range mine {
+			names = append(names, name)
+		}
+		if len(names) == 0 {
+			c.WriteStr("NOT_SUBSCRIBED")
+			return
+		}
+	}
+	for _, name := range names {
+		if _, ok := mine[name]; ok {
+			delete(mine, name)
+			c.ps.unsubscribe(set, name, sub)
+		}
+		c.WriteStr(fmt.Sprintf("%v%v %v", reply, name, sub.subscribed()))
+	}
+}
+
+// cmdPublish takes a channel and a message, which is the rest of the
+// line, and sends it to everyone subscribed.  It replies with
+// PUBLISHED <receivers>.
+func cmdPublish(c *Request) {
+	if len(c.Subcmd) < 2 {
+		c.WriteStr("ERROR publish command requires a channel and a message")
+		return
+	}
+
+	n := c.ps.publish(c.Subcmd[0], publishMessage(c.line))
+	c.WriteStr(fmt.Sprintf("PUBLISHED %v", n))
+}
+
+// publishMessage returns the message of a publish line: everything
+// after the space that follows the channel, with its spacing kept.
+func publishMessage(line string) string {
+	for n := 0; n < 2; n++ {
+		line = strings.TrimLeft(line, " ")
+		line = line[strings.Index(line, " ")+1:]
+	}
+	return line
+}
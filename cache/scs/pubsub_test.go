@@ -0,0 +1,101 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPubSub verifies messages reach the subscribers of their channel
+// and of patterns matching it, and that a subscribed connection only
+// takes the subscribe commands until it unsubscribes from everything.
+func TestPubSub(t *testing.T) {
+	s, pn, pb := startServer(t, 65535)
+	defer s.Close()
+	sn, sb := dial(t, s)
+	on, ob := dial(t, s)
+
+	expect(t, sn, sb, "unsubscribe\r\n", "NOT_SUBSCRIBED")
+	expect(t, sn, sb, "subscribe news weather\r\n", "SUBSCRIBED news 1", "SUBSCRIBED weather 2")
+	expect(t, sn, sb, "psubscribe sport.*\r\n", "PSUBSCRIBED sport.* 3")
+	expect(t, on, ob, "psubscribe [\r\n", "ERROR invalid pattern [")
+	expect(t, on, ob, "subscribe news\r\n", "SUBSCRIBED news 1")
+
+	expect(t, pn, pb, "publish news hello  world \r\n", "PUBLISHED 2")
+	expect(t, sn, sb, "", "MESSAGE news", "hello  world ")
+	expect(t, on, ob, "", "MESSAGE news", "hello  world ")
+	expect(t, pn, pb, "publish sport.golf birdie\r\n", "PUBLISHED 1")
+	expect(t, sn, sb, "", "PMESSAGE sport.* sport.golf", "birdie")
+	expect(t, pn, pb, "publish sport\r\n", "ERROR publish command requires a channel and a message")
+
+	expect(t, sn, sb, "get sushi\r\n", "ERROR only subscribe, unsubscribe, psubscribe, punsubscribe and quit are allowed while subscribed")
+	expect(t, sn, sb, "unsubscribe news\r\n", "UNSUBSCRIBED news 2")
+	expect(t, pn, pb, "publish news again\r\n", "PUBLISHED 1")
+	expect(t, sn, sb, "unsubscribe\r\npunsubscribe\r\n", "UNSUBSCRIBED weather 1", "PUNSUBSCRIBED sport.* 0")
+	expect(t, sn, sb, "set sushi\r\ndelicious\r\nget sushi\r\n", "STORED", "VALUE sushi", "delicious", "END")
+
+	// Closing a subscriber's connection removes its subscriptions
+	expect(t, on, ob, "", "MESSAGE news", "again")
+	expect(t, on, ob, "quit\r\n")
+	if _, err := ob.ReadByte(); err == nil {
+		t.Errorf("quit fail, expected connection to close")
+	}
+	for end := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		pn.Write([]byte("publish news gone\r\n"))
+		r, _ := pb.ReadString('\n')
+		if r == "PUBLISHED 0\r\n" {
+			break
+		}
+		if time.Now().After(end) {
+			t.Fatalf("publish after quit got %q, wanted no subscribers", r)
+		}
+	}
+}
+
+// TestSlowSubscriber verifies a subscriber that stops reading is
+// disconnected once its backlog is full, without holding up publishers.
+func TestSlowSubscriber(t *testing.T) {
+	s, pn, pb := startServer(t, 65535)
+	defer s.Close()
+	s.ps.backlog = 1000
+
+	// A pipe has no buffer, so nothing is sent until the client reads
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.handle(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("subscribe news\r\n"))
+	r := bufio.NewReader(client)
+	if line, _ := r.ReadString('\n'); line != "SUBSCRIBED news 1\r\n" {
+		t.Fatalf("subscribe got %q", line)
+	}
+
+	msg := strings.Repeat("x", 100)
+	for i := 0; ; i++ {
+		if i == 100 {
+			t.Fatalf("subscriber was never disconnected")
+		}
+		pn.Write([]byte("publish news " + msg + "\r\n"))
+		line, err := pb.ReadString('\n')
+		if err != nil {
+			t.Fatalf("publish read error: %v", err)
+		}
+		if line == "PUBLISHED 0\r\n" {
+			break
+		}
+	}
+
+	// The connection is closed once the messages already written out
+	// are read
+	for {
+		if _, err := r.ReadString('\n'); err != nil {
+			break
+		}
+	}
+}
@@ -0,0 +1,399 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// opOffset is a heartbeat record in the replication stream.  Its key
+// is empty and it carries the primary's offset as 8 bytes.  It is never
+// written to the mutation log.
+const opOffset = 'o'
+
+var (
+	// replHeartbeat is how often a primary tells its replicas its
+	// offset.  A replica that hears nothing for replTimeout resyncs.
+	replHeartbeat = time.Second
+	replTimeout   = 5 * time.Second
+	// replRetry is how long a replica waits before reconnecting.
+	replRetry = time.Second
+	// replQueue is how many records a replica can fall behind by
+	// before the primary drops it and makes it resync.
+	replQueue = 64 * 1024
+)
+
+// replicaFeed sends every change made to the cache to the replicas
+// following it, as mutation log records.  Like the log, records are
+// added while the shard of their key is locked, so every replica sees
+// the changes to a key in order.  offset counts the bytes of every
+// record sent, and is how far replicas say they are.  Nothing is
+// encoded while count is 0, which only changes with every shard
+// locked.  Like the log, a change is sent after an opSelect record
+// whenever it is in another database than the one before it, and db
+// is reset when a replica is added so its stream starts with one.
+type replicaFeed struct {
+	mu       sync.Mutex
+	offset   int64
+	count    int64
+	db       int // the database of the last record sent, -1 if unknown
+	replicas map[*replica]struct{}
+}
+
+// replica is a single replica following the feed.  queue holds the
+// records still to be sent to it, and is closed if it falls too far
+// behind.
+type replica struct {
+	queue chan []byte
+}
+
+// replicaLink is a replica's connection to its primary.  offset is the
+// primary's offset of the last record applied, primaryOffset the last
+// one the primary reported, and contact when it last heard from it in
+// unix nanoseconds.  All three are updated atomically.
+type replicaLink struct {
+	addr          string
+	offset        int64
+	primaryOffset int64
+	contact       int64
+}
+
+func newReplicaFeed() *replicaFeed {
+	return &replicaFeed{db: -1, replicas: make(map[*replica]struct{})}
+}
+
+// stored records key being set to value in database db.
+func (f *replicaFeed) stored(db int, key string, value []byte, flags uint32, expires time.Time) {
+	if atomic.LoadInt64(&f.count) != 0 {
+		f.write(db, encodeStore(nil, key, value, flags, expires))
+	}
+}
+
+// removed records key being removed from database db.
+func (f *replicaFeed) removed(db int, key string) {
+	if atomic.LoadInt64(&f.count) != 0 {
+		f.write(db, encodeRemove(nil, key))
+	}
+}
+
+// flushed records every item in database db being removed.
+func (f *replicaFeed) flushed(db int) {
+	if atomic.LoadInt64(&f.count) != 0 {
+		f.write(db, encodeFlush(nil))
+	}
+}
+
+// expires records the expiration of key in database db changing.
+func (f *replicaFeed) expires(db int, key string, expires time.Time) {
+	if atomic.LoadInt64(&f.count) != 0 {
+		f.write(db, encodeExpire(nil, key, expires))
+	}
+}
+
+// write queues a record for a change in database db for every replica,
+// dropping any that are too far behind to take it.
+func (f *replicaFeed) write(db int, rec []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if db != f.db {
+		rec = append(encodeSelect(nil, db), rec...)
+		f.db = db
+	}
+	atomic.AddInt64(&f.offset, int64(len(rec)))
+	for r := range f.replicas {
+		select {
+		case r.queue <- rec:
+		default:
+			f.drop(r)
+		}
+	}
+}
+
+// add starts queueing records for a new replica.  The caller must hold
+// every shard lock, so the replica's copy of the cache is taken at the
+// same point.
+func (f *replicaFeed) add() *replica {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	r := &replica{queue: make(chan []byte, replQueue)}
+	f.replicas[r] = struct{}{}
+	f.db = -1
+	atomic.AddInt64(&f.count, 1)
+	return r
+}
+
+// remove stops queueing records for r.
+func (f *replicaFeed) remove(r *replica) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.drop(r)
+}
+
+// drop removes r and closes its queue.  The caller must hold mu.
+func (f *replicaFeed) drop(r *replica) {
+	if _, ok := f.replicas[r]; !ok {
+		return
+	}
+	delete(f.replicas, r)
+	close(r.queue)
+	atomic.AddInt64(&f.count, -1)
+}
+
+// dropAll stops queueing records for every replica, which makes their
+// sync commands close their connections.
+func (f *replicaFeed) dropAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for r := range f.replicas {
+		f.drop(r)
+	}
+}
+
+// cmdSync turns the connection into a replication stream.  It sends
+// FULLSYNC <offset> <items>, a store record for every item in the
+// cache with select records between the databases, then every change
+// made after that point along with a heartbeat of the current offset
+// every replHeartbeat, until the replica disconnects or falls too far
+// behind.
+func cmdSync(c *Request) {
+	if len(c.Subcmd) != 0 {
+		c.WriteStr("ERROR sync does not take any parameters")
+		return
+	}
+	if c.c == nil {
+		c.WriteStr("ERROR replication needs the built in storage")
+		return
+	}
+
+	c.c.lockAll()
+	feed := c.c.feed
+	r := feed.add()
+	offset := atomic.LoadInt64(&feed.offset)
+	entries := c.c.snapshotEntries()
+	c.c.unlockAll()
+	defer feed.remove(r)
+
+	c.WriteStr(fmt.Sprintf("FULLSYNC %v %v", offset, len(entries)))
+	var rec []byte
+	var db int
+	for _, e := range entries {
+		rec = encodeEntry(rec[:0], &db, e)
+		c.Conn.Write(rec)
+	}
+
+	t := time.NewTicker(replHeartbeat)
+	defer t.Stop()
+	for {
+		if len(r.queue) == 0 {
+			if c.Flush() != nil {
+				break
+			}
+		}
+		select {
+		case rec, ok := <-r.queue:
+			if !ok {
+				// Too far behind, the replica has to start over
+				c.Conn.Close()
+				return
+			}
+			c.Conn.Write(rec)
+		case <-t.C:
+			c.Conn.Write(encodeOffset(nil, atomic.LoadInt64(&feed.offset)))
+		}
+	}
+	c.Conn.Close()
+}
+
+// encodeOffset appends an opOffset heartbeat record to dst.
+func encodeOffset(dst []byte, offset int64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(offset))
+	p := appendString([]byte{opOffset}, "")
+	return appendRecord(dst, append(p, b[:]...))
+}
+
+// replicate follows the primary until the server closes, connecting
+// again whenever the link drops.
+func (s *Server) replicate() {
+	for {
+		err := s.c.follow(s.done)
+		if err != nil {
+			fmt.Printf("replication from %v stopped: %v\n", s.c.link.addr, err)
+		}
+		select {
+		case <-s.done:
+			return
+		case <-time.After(replRetry):
+		}
+	}
+}
+
+// follow connects to the primary, replaces the cache with its copy,
+// then applies every change it sends until the link drops or done is
+// closed.
+func (c *dataCache) follow(done chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", c.link.addr, replTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-done:
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	conn.SetDeadline(time.Now().Add(replTimeout))
+	_, err = io.WriteString(conn, "sync\r\n")
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	f := strings.Fields(line)
+	if len(f) != 3 || f[0] != "FULLSYNC" {
+		return fmt.Errorf("primary replied %q", strings.TrimSpace(line))
+	}
+	offset, err := strconv.ParseInt(f[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad offset %q", f[1])
+	}
+	n, err := strconv.Atoi(f[2])
+	if err != nil {
+		return fmt.Errorf("bad item count %q", f[2])
+	}
+
+	// Read the whole copy before locking, so reads are only blocked
+	// while it is applied.  n only counts the items, not the select
+	// records between them.
+	payloads := make([][]byte, 0, n)
+	for items := 0; items < n; {
+		conn.SetDeadline(time.Now().Add(replTimeout))
+		p, _, err := readRecord(r)
+		if err != nil {
+			return err
+		}
+		if len(p) == 0 || p[0] != opSelect {
+			items++
+		}
+		payloads = append(payloads, p)
+	}
+	db, err := c.fullSync(payloads, offset)
+	if err != nil {
+		return err
+	}
+
+	for {
+		conn.SetDeadline(time.Now().Add(replTimeout))
+		payload, size, err := readRecord(r)
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt64(&c.link.contact, time.Now().UnixNano())
+
+		op, key, value, flags, expires, err := decodeRecord(payload)
+		if op == opOffset {
+			if len(payload) != 10 {
+				return fmt.Errorf("bad heartbeat")
+			}
+			atomic.StoreInt64(&c.link.primaryOffset, int64(binary.BigEndian.Uint64(payload[2:])))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case opSelect:
+			db, err = c.selectRecord(key)
+		case opFlush:
+			db.flush()
+		default:
+			sh := db.lock(key)
+			err = sh.applyRecord(op, key, value, flags, expires)
+			sh.Unlock()
+		}
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&c.link.offset, size)
+	}
+}
+
+// fullSync replaces everything in the cache with the primary's copy,
+// and returns the database the changes after it start in.
+func (c *dataCache) fullSync(payloads [][]byte, offset int64) (*database, error) {
+	c.lockAll()
+	defer c.unlockAll()
+
+	for _, sh := range c.shards {
+		for k := range sh.Cache {
+			sh.remove(k)
+		}
+	}
+	db := c.dbs[0]
+	for _, p := range payloads {
+		op, key, value, flags, expires, err := decodeRecord(p)
+		if err != nil {
+			return nil, err
+		}
+		db, err = c.apply(db, op, key, value, flags, expires)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	atomic.StoreInt64(&c.link.offset, offset)
+	atomic.StoreInt64(&c.link.primaryOffset, offset)
+	atomic.StoreInt64(&c.link.contact, time.Now().UnixNano())
+	return db, nil
+}
+
+// replStats lists the replication statistics.  The offsets are bytes of
+// records in the primary's replication stream, so repl_lag_bytes is how
+// far a replica is behind the primary's last heartbeat, and
+// repl_lag_seconds how long it is since the replica heard from it.
+func (c *dataCache) replStats() []Stat {
+	role, lag, secs := "primary", int64(0), int64(0)
+	replicas := atomic.LoadInt64(&c.feed.count)
+	offset := atomic.LoadInt64(&c.feed.offset)
+	if c.link != nil {
+		role = "replica"
+		offset = atomic.LoadInt64(&c.link.offset)
+		if p := atomic.LoadInt64(&c.link.primaryOffset); p > offset {
+			lag = p - offset
+		}
+		secs = -1
+		if t := atomic.LoadInt64(&c.link.contact); t != 0 {
+			secs = int64(time.Since(time.Unix(0, t)) / time.Second)
+		}
+	}
+	return []Stat{
+		{"role", role},
+		{"connected_replicas", fmt.Sprint(replicas)},
+		{"repl_offset", fmt.Sprint(offset)},
+		{"repl_lag_bytes", fmt.Sprint(lag)},
+		{"repl_lag_seconds", fmt.Sprint(secs)},
+	}
+}
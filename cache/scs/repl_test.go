@@ -0,0 +1,115 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"testing"
+	"time"
+)
+
+func init() {
+	// Reconnect quickly so the resync test does not wait a second
+	replRetry = 10 * time.Millisecond
+}
+
+// startReplica creates a replica of p on a random localhost port.
+func startReplica(t *testing.T, p *Server) *Server {
+	t.Helper()
+
+	s, err := NewServer(testOptions(WithReplicaOf(p.Addr().String()))...)
+	if err != nil {
+		t.Fatalf("failed to create replica: %v", err)
+	}
+	go s.Serve()
+	return s
+}
+
+// waitFor polls the cache of s until key holds value, or is missing
+// when value is "".
+func waitFor(t *testing.T, s *Server, key, value string) {
+	t.Helper()
+
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); time.Sleep(5 * time.Millisecond) {
+		i, ok := s.st.Peek(key)
+		if value == "" && !ok || ok && string(i.Value) == value {
+			return
+		}
+	}
+	t.Fatalf("replica never got %v = %q", key, value)
+}
+
+// TestReplication verifies a replica copies what the primary already
+// has, follows every change made after that, and refuses writes.
+func TestReplication(t *testing.T) {
+	p, pn, pb := startServer(t, 65535)
+	defer p.Close()
+	expect(t, pn, pb, "set sushi\r\ndelicious\r\n", "STORED")
+	expect(t, pn, pb, "set topcoder\r\nfun\r\n", "STORED")
+
+	r := startReplica(t, p)
+	defer r.Close()
+	rn, rb := dial(t, r)
+	waitFor(t, r, "sushi", "delicious")
+	expect(t, rn, rb, "get sushi topcoder\r\n", "VALUE sushi", "delicious", "VALUE topcoder", "fun", "END")
+
+	expect(t, pn, pb, "set sushi\r\ntasty\r\n", "STORED")
+	expect(t, pn, pb, "delete topcoder\r\n", "DELETED")
+	expect(t, pn, pb, "set counter\r\n5\r\n", "STORED")
+	expect(t, pn, pb, "incr counter 3\r\n", "8")
+	expect(t, pn, pb, "expire counter 100\r\n", "TOUCHED")
+	expect(t, pn, pb, "set last\r\none\r\n", "STORED")
+	waitFor(t, r, "last", "one")
+	expect(t, rn, rb, "get sushi topcoder counter\r\n", "VALUE sushi", "tasty", "VALUE counter", "8", "END")
+	expect(t, rn, rb, "ttl counter\r\n", "TTL 100")
+
+	expect(t, rn, rb, "set sushi\r\nstale\r\n", "ERROR replica is read only")
+	expect(t, rn, rb, "delete sushi\r\n", "ERROR replica is read only")
+	expect(t, rn, rb, "incr counter 1\r\n", "ERROR replica is read only")
+	expect(t, rn, rb, "get sushi\r\n", "VALUE sushi", "tasty", "END")
+
+	stats := make(map[string]string)
+	for _, st := range p.c.dbs[0].Stats() {
+		stats[st.Name] = st.Value
+	}
+	if stats["role"] != "primary" || stats["connected_replicas"] != "1" || stats["repl_offset"] == "0" {
+		t.Errorf("primary stats = %v", stats)
+	}
+	offset := stats["repl_offset"]
+	stats = make(map[string]string)
+	for _, st := range r.c.dbs[0].Stats() {
+		stats[st.Name] = st.Value
+	}
+	if stats["role"] != "replica" || stats["repl_offset"] != offset || stats["repl_lag_bytes"] != "0" || stats["repl_lag_seconds"] != "0" {
+		t.Errorf("replica stats = %v, wanted repl_offset %v", stats, offset)
+	}
+}
+
+// TestReplicaResync verifies a replica the primary drops connects again
+// and copies the whole cache, including changes made while it was gone.
+func TestReplicaResync(t *testing.T) {
+	p, pn, pb := startServer(t, 65535)
+	defer p.Close()
+	expect(t, pn, pb, "set sushi\r\ndelicious\r\n", "STORED")
+
+	r := startReplica(t, p)
+	defer r.Close()
+	waitFor(t, r, "sushi", "delicious")
+
+	// Drop the replica as if it fell too far behind, then change the
+	// cache before it can come back
+	p.c.lockAll()
+	feed := p.c.feed
+	feed.mu.Lock()
+	for rep := range feed.replicas {
+		feed.drop(rep)
+	}
+	feed.mu.Unlock()
+	p.c.dbs[0].shard("sushi").remove("sushi")
+	p.c.unlockAll()
+	expect(t, pn, pb, "set topcoder\r\nfun\r\n", "STORED")
+
+	waitFor(t, r, "topcoder", "fun")
+	waitFor(t, r, "sushi", "")
+}
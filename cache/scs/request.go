@@ -0,0 +1,600 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bitbucket.org/kyrra/sandbox/auth"
+)
+
+// Request represents a single command sent
+// to the server.  Writes to Conn are buffered and sent once every
+// command the client has sent so far is handled, so pipelined commands
+// have their replies sent together.
+type Request struct {
+	Storage   Storage
+	Cmd       string
+	Subcmd    []string
+	Conn      net.Conn
+	Memcached bool       // reply in the memcached format
+	Identity  string     // common name of the client's TLS certificate, if any
+	line      string     // the command line as sent, without its \r\n
+	c         *dataCache // the built in cache, nil when WithStorage is used
+	db        *database  // the database of c that select picked, also Storage
+	ps        *pubsub
+	sub       *subscriber     // set once the connection subscribes
+	users     *auth.Datastore // nil unless clients must auth
+	authed    bool
+	stats     *serverStats
+	conn      *connStats // nil for RESP commands, which count themselves
+	reader    *bufio.Reader
+}
+
+// bufferedConn is the connection text protocol handlers are given.
+// Writes are held in w until Flush, and Close sends them first so a
+// reply written just before closing still reaches the client.
+type bufferedConn struct {
+	net.Conn
+	w *bufio.Writer
+}
+
+func (b *bufferedConn) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
+
+func (b *bufferedConn) WriteString(s string) (int, error) {
+	return b.w.WriteString(s)
+}
+
+func (b *bufferedConn) Flush() error {
+	return b.w.Flush()
+}
+
+func (b *bufferedConn) Close() error {
+	b.w.Flush()
+	return b.Conn.Close()
+}
+
+// flusher is a connection that buffers its writes.
+type flusher interface {
+	Flush() error
+}
+
+// maxLineSize is the longest line a client can send.  Clients are
+// disconnected when they go over it without sending a newline.
+const maxLineSize = 64 * 1024
+
+// dataCache stores all cache information for the
+// entire server.  It is split into databases, and the keys of each
+// database are spread over shards by their hash, each with its own
+// lock, so commands on keys in different shards run in parallel.
+// Everything else is set before Serve, updated atomically, or guarded
+// by saveMutex.
+type dataCache struct {
+	dbs []*database
+	// shards holds the shards of every database in order, for the
+	// work that covers the whole cache.
+	shards []*cacheShard
+	// maxItems and maxBytes are the limits of each database.
+	maxItems int
+	maxBytes int
+	// policy names the eviction policy every shard uses.
+	policy string
+
+	// snapshot is the file the cache is saved to.  dirty counts the
+	// changes made since the last save finished at lastSave, and
+	// saving is set while a background save is writing.  saveMutex
+	// guards lastSave and saving, and is always taken before any shard
+	// lock.
+	snapshot  string
+	dirty     int64
+	saveMutex sync.Mutex
+	lastSave  time.Time
+	saving    bool
+
+	// log records every change to the cache when it is set.
+	log *mutationLog
+	// feed sends every change to the replicas following the cache, and
+	// link is set when the cache is itself a replica, which makes it
+	// read only to clients.
+	feed *replicaFeed
+	link *replicaLink
+	// casID is the version given to the last item stored.
+	casID uint64
+}
+
+// cacheShard holds the items whose key hashes to it.  Every method
+// must be called with the shard locked.
+type cacheShard struct {
+	sync.Mutex
+	db    *database
+	idx   int
+	Cache map[string]*item
+	// bytes is the size of every key and value in Cache.  maxBytes is
+	// enforced on the database's total, not on each shard.
+	bytes int
+	// expiring holds the keys of Cache that have a ttl set, so the
+	// reaper only has to sample keys that can actually expire.
+	expiring map[string]struct{}
+	policy   evictionPolicy
+}
+
+// item is a single value stored in the cache.
+type item struct {
+	key     string
+	value   []byte    // never changed once stored, so it can be shared
+	flags   uint32    // opaque to the server, set by memcached clients
+	expires time.Time // zero value means the item never expires
+	fetched bool
+	cas     uint64 // version, changed every time the item is stored
+	used    int64  // unix nanoseconds it was last stored or fetched
+
+	// bookkeeping for the eviction policy
+	elem *list.Element
+	freq *list.Element
+	idx  int
+}
+
+// dataStats tracks usage information for a database.  Every
+// counter is updated atomically so shards never wait on each other,
+// and stats reset swaps in a new dataStats rather than zeroing them.
+type dataStats struct {
+	get              int64
+	set              int64
+	getHits          int64
+	getMisses        int64
+	delHits          int64
+	delMisses        int64
+	expiredUnfetched int64
+	reclaimed        int64
+	evictions        int64
+	incrHits         int64
+	incrMisses       int64
+	decrHits         int64
+	decrMisses       int64
+}
+
+// size is the number of bytes the item counts against the memory limit.
+func (i *item) size() int {
+	return len(i.key) + len(i.value)
+}
+
+// expired reports if the item has a ttl that has passed.
+func (i *item) expired(now time.Time) bool {
+	return !i.expires.IsZero() && now.After(i.expires)
+}
+
+// lookup returns the item stored at key.  Items that have expired are
+// removed and treated as missing.
+func (sh *cacheShard) lookup(key string, now time.Time) (*item, bool) {
+	i, ok := sh.Cache[key]
+	if !ok {
+		return nil, false
+	}
+	if i.expired(now) {
+		sh.reclaim(key, i)
+		return nil, false
+	}
+	return i, true
+}
+
+// fetch returns the item stored at key for a client that is reading
+// it, updating the usage the eviction policy sees.
+func (sh *cacheShard) fetch(key string, now time.Time) (*item, bool) {
+	i, ok := sh.lookup(key, now)
+	if !ok {
+		return nil, false
+	}
+	i.fetched = true
+	i.used = now.UnixNano()
+	sh.policy.accessed(i)
+	return i, true
+}
+
+// store places value at key, replacing anything already there.  A ttl
+// of 0 stores the value without an expiration.
+func (sh *cacheShard) store(key string, value []byte, flags uint32, ttl time.Duration) {
+	db, c := sh.db, sh.db.c
+	if old, ok := sh.Cache[key]; ok {
+		sh.policy.removed(old)
+		sh.bytes -= old.size()
+		atomic.AddInt64(&db.bytes, -int64(old.size()))
+		atomic.AddInt64(&db.items, -1)
+	}
+	i := &item{key: key, value: value, flags: flags, cas: atomic.AddUint64(&c.casID, 1), used: time.Now().UnixNano()}
+	sh.Cache[key] = i
+	sh.bytes += i.size()
+	atomic.AddInt64(&db.bytes, int64(i.size()))
+	atomic.AddInt64(&db.items, 1)
+	sh.policy.added(i)
+	sh.setExpires(key, i, ttl)
+	atomic.AddInt64(&c.dirty, 1)
+	if c.log != nil {
+		c.log.stored(db.idx, key, value, flags, i.expires)
+	}
+	c.feed.stored(db.idx, key, value, flags, i.expires)
+}
+
+// setTTL changes the expiration of an item already in the cache.  A ttl
+// of 0 removes any expiration.
+func (sh *cacheShard) setTTL(key string, i *item, ttl time.Duration) {
+	sh.setExpires(key, i, ttl)
+	db, c := sh.db, sh.db.c
+	atomic.AddInt64(&c.dirty, 1)
+	if c.log != nil {
+		c.log.expires(db.idx, key, i.expires)
+	}
+	c.feed.expires(db.idx, key, i.expires)
+}
+
+// setExpires sets when an item expires without recording it as a
+// change.
+func (sh *cacheShard) setExpires(key string, i *item, ttl time.Duration) {
+	if ttl == 0 {
+		i.expires = time.Time{}
+		delete(sh.expiring, key)
+		return
+	}
+	i.expires = time.Now().Add(ttl)
+	sh.expiring[key] = struct{}{}
+}
+
+// remove deletes key from the cache.
+func (sh *cacheShard) remove(key string) {
+	if !sh.drop(key) {
+		return
+	}
+	db, c := sh.db, sh.db.c
+	if c.log != nil {
+		c.log.removed(db.idx, key)
+	}
+	c.feed.removed(db.idx, key)
+}
+
+// drop removes key like remove, without recording it in the mutation
+// log or replication stream, and reports if it was there.  It is for
+// changes recorded some other way, like flushdb.
+func (sh *cacheShard) drop(key string) bool {
+	i, ok := sh.Cache[key]
+	if !ok {
+		return false
+	}
+	db, c := sh.db, sh.db.c
+	sh.policy.removed(i)
+	sh.bytes -= i.size()
+	atomic.AddInt64(&db.bytes, -int64(i.size()))
+	atomic.AddInt64(&db.items, -1)
+	atomic.AddInt64(&c.dirty, 1)
+	delete(sh.Cache, key)
+	delete(sh.expiring, key)
+	return true
+}
+
+// storeData stores data at key the way the set family command given by
+// mode does.  expired is set for data given an expiration time that has
+// already passed, which is stored and immediately removed the way
+// memcached does.  A cas other than 0 only stores data if the item at
+// key still has that version.
+func (sh *cacheShard) storeData(mode StoreMode, key string, data []byte, flags uint32, ttl time.Duration, expired bool, cas uint64) Result {
+	now := time.Now()
+	old, exists := sh.lookup(key, now)
+	if cas != 0 && !exists {
+		return NotFound
+	}
+	if cas != 0 && old.cas != cas {
+		return Exists
+	}
+	if (mode == StoreAdd && exists) || (mode != StoreSet && mode != StoreAdd && !exists) {
+		return NotStored
+	}
+
+	if mode == StoreAppend || mode == StorePrepend {
+		// Only the data changes, the item keeps its flags and ttl
+		flags, ttl = old.flags, 0
+		if !old.expires.IsZero() {
+			ttl = old.expires.Sub(now)
+		}
+		// Stored values are shared with snapshots, so build a new one
+		joined := make([]byte, 0, len(old.value)+len(data))
+		if mode == StoreAppend {
+			data = append(append(joined, old.value...), data...)
+		} else {
+			data = append(append(joined, data...), old.value...)
+		}
+		if len(data) >= MAX_DATA_SIZE {
+			return TooLarge
+		}
+	}
+
+	size := len(key) + len(data)
+	if max := sh.db.c.maxBytes; max > 0 && size > max {
+		return OverMemory
+	}
+
+	if !sh.makeRoom(key, size) {
+		return CacheFull
+	}
+
+	atomic.AddInt64(&sh.db.stats.Load().set, 1)
+	sh.store(key, data, flags, ttl)
+	if expired {
+		sh.remove(key)
+	}
+	return OK
+}
+
+// incr adds delta to the decimal number stored at key, or subtracts it
+// when decr is set.  Like memcached, incrementing wraps around at 64
+// bits and decrementing stops at 0.  The item keeps its flags and ttl.
+// Only keys holding a number count as hits.
+func (sh *cacheShard) incr(key string, delta uint64, decr bool) (uint64, Result) {
+	st := sh.db.stats.Load()
+	now := time.Now()
+	i, ok := sh.lookup(key, now)
+	if !ok {
+		if decr {
+			atomic.AddInt64(&st.decrMisses, 1)
+		} else {
+			atomic.AddInt64(&st.incrMisses, 1)
+		}
+		return 0, NotFound
+	}
+
+	n, err := strconv.ParseUint(string(i.value), 10, 64)
+	if err != nil {
+		return 0, NonNumeric
+	}
+
+	switch {
+	case !decr:
+		atomic.AddInt64(&st.incrHits, 1)
+		n += delta
+	case delta > n:
+		atomic.AddInt64(&st.decrHits, 1)
+		n = 0
+	default:
+		atomic.AddInt64(&st.decrHits, 1)
+		n -= delta
+	}
+
+	var ttl time.Duration
+	if !i.expires.IsZero() {
+		ttl = i.expires.Sub(now)
+	}
+	// A number with more digits takes more memory, which store does
+	// not check for
+	value := []byte(strconv.FormatUint(n, 10))
+	if !sh.makeRoom(key, len(key)+len(value)) {
+		return 0, CacheFull
+	}
+	sh.store(key, value, i.flags, ttl)
+	return n, OK
+}
+
+// Stats implements Storage.  The usage is the database's own, and the
+// replication stats are the whole cache's.  It does not need any lock.
+func (db *database) Stats() []Stat {
+	load := func(n *int64) string {
+		return fmt.Sprint(atomic.LoadInt64(n))
+	}
+	ds := db.stats.Load()
+	st := []Stat{
+		{"cmd_get", load(&ds.get)},
+		{"cmd_set", load(&ds.set)},
+		{"get_hits", load(&ds.getHits)},
+		{"get_misses", load(&ds.getMisses)},
+		{"delete_hits", load(&ds.delHits)},
+		{"delete_misses", load(&ds.delMisses)},
+		{"curr_items", load(&db.items)},
+		{"limit_items", fmt.Sprint(db.c.maxItems)},
+		{"expired_unfetched", load(&ds.expiredUnfetched)},
+		{"reclaimed", load(&ds.reclaimed)},
+		{"evictions", load(&ds.evictions)},
+		{"bytes", load(&db.bytes)},
+		{"limit_maxbytes", fmt.Sprint(db.c.maxBytes)},
+		{"incr_hits", load(&ds.incrHits)},
+		{"incr_misses", load(&ds.incrMisses)},
+		{"decr_hits", load(&ds.decrHits)},
+		{"decr_misses", load(&ds.decrMisses)},
+	}
+	return append(st, db.c.replStats()...)
+}
+
+// makeRoom evicts items until size bytes can be stored at key without
+// going over the database's item or memory limits, counting anything
+// already stored at key as replaced.  Returns false if the eviction
+// policy ran out of items to evict first.
+func (sh *cacheShard) makeRoom(key string, size int) bool {
+	db := sh.db
+	maxItems, maxBytes := int64(db.c.maxItems), int64(db.c.maxBytes)
+	for {
+		items := atomic.LoadInt64(&db.items) + 1
+		bytes := atomic.LoadInt64(&db.bytes) + int64(size)
+		if old, ok := sh.Cache[key]; ok {
+			items--
+			bytes -= int64(old.size())
+		}
+		if items <= maxItems && (maxBytes == 0 || bytes <= maxBytes) {
+			return true
+		}
+		if !db.evict(sh, false) {
+			return false
+		}
+	}
+}
+
+// evict removes the item the eviction policy picks out of the victims
+// of every shard of db, so the policy is followed across the database.
+// sh is the shard locked by the caller, or nil if all is set and the
+// caller holds every shard lock.  Other shards that are locked at the
+// moment are skipped, as waiting for them could deadlock with a caller
+// of lockAll.  Returns false if the policy would not pick an item.
+func (db *database) evict(sh *cacheShard, all bool) bool {
+	var from *cacheShard
+	var victim *item
+	start := rand.Intn(len(db.shards))
+	for n := range db.shards {
+		o := db.shards[(start+n)%len(db.shards)]
+		if o != sh && !all {
+			if !o.TryLock() {
+				continue
+			}
+			defer o.Unlock()
+		}
+		i, ok := o.policy.victim()
+		if ok && (victim == nil || o.policy.before(i, victim)) {
+			from, victim = o, i
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	from.remove(victim.key)
+	atomic.AddInt64(&db.stats.Load().evictions, 1)
+	return true
+}
+
+// trim evicts items from every database that is over its item or
+// memory limit, such as after loading a snapshot or mutation log
+// written under higher limits.  The caller must hold every shard lock.
+func (c *dataCache) trim() {
+	for _, db := range c.dbs {
+		for db.full() && db.evict(nil, true) {
+		}
+	}
+}
+
+// full reports if the database holds more than its item or memory
+// limit.
+func (db *database) full() bool {
+	if atomic.LoadInt64(&db.items) > int64(db.c.maxItems) {
+		return true
+	}
+	return db.c.maxBytes > 0 && atomic.LoadInt64(&db.bytes) > int64(db.c.maxBytes)
+}
+
+// reclaim removes an expired item and records it in the stats.
+func (sh *cacheShard) reclaim(key string, i *item) {
+	sh.remove(key)
+	atomic.AddInt64(&sh.db.stats.Load().reclaimed, 1)
+	if !i.fetched {
+		atomic.AddInt64(&sh.db.stats.Load().expiredUnfetched, 1)
+	}
+}
+
+// ValidateInput takes a raw byte input from a client, validates and removes
+// the trailing \r\n, validates the characters are acceptable, and returns the
+// data as a string.
+func (c *Request) ValidateInput(data []byte) (string, error) {
+	// Check that it was \r\n
+	if len(data) < 2 || data[len(data)-2] != '\r' {
+		return "", fmt.Errorf("ERROR invalid input")
+	}
+
+	// Trim \r\n
+	data = data[:len(data)-2]
+	// Validate string data
+	if len(data) == 0 {
+		return "", nil
+	}
+
+	input := string(data)
+	if !validChars.MatchString(input) {
+		return "", fmt.Errorf("ERROR invalid input characters")
+	}
+
+	return input, nil
+}
+
+// Readln will block waiting for a full line of input from the client.
+// The \r\n is left on the line for ValidateInput to check.  The line is
+// only valid until the next read from the client.
+func (c *Request) Readln() ([]byte, error) {
+	c.flushIfDrained()
+	data, err := c.reader.ReadSlice('\n')
+	if err != nil {
+		// The client closed the connection or sent more than
+		// maxLineSize without a newline
+		c.Conn.Close()
+		return nil, err
+	}
+	return data, nil
+}
+
+// ReadData will block waiting for exactly n bytes followed by \r\n
+// from the client.  Unlike Readln, the data can hold any bytes, so it
+// is not checked against the valid characters.
+func (c *Request) ReadData(n int) ([]byte, error) {
+	c.flushIfDrained()
+	data := make([]byte, n+2)
+	_, err := io.ReadFull(c.reader, data)
+	if err != nil {
+		c.Conn.Close()
+		return nil, err
+	}
+	if data[n] != '\r' || data[n+1] != '\n' {
+		// Throw away the rest of the line so the next command
+		// is read from the start of a line
+		if data[n+1] != '\n' {
+			c.reader.ReadSlice('\n')
+		}
+		return nil, fmt.Errorf("ERROR bad data chunk")
+	}
+	return data[:n], nil
+}
+
+// SkipData reads and throws away n bytes followed by \r\n, for data
+// that will not be stored.
+func (c *Request) SkipData(n int) error {
+	c.flushIfDrained()
+	_, err := io.CopyN(ioutil.Discard, c.reader, int64(n)+2)
+	if err != nil {
+		c.Conn.Close()
+	}
+	return err
+}
+
+// WriteStr writes out a string to the connection.  It will append
+// a \r\n.
+func (c *Request) WriteStr(s string) {
+	io.WriteString(c.Conn, s)
+	io.WriteString(c.Conn, "\r\n")
+}
+
+// WriteBytes writes out data to the connection.  It will append
+// a \r\n.
+func (c *Request) WriteBytes(b []byte) {
+	c.Conn.Write(b)
+	io.WriteString(c.Conn, "\r\n")
+}
+
+// Flush sends everything written so far to the client.  Handlers only
+// need it to send a reply before the client sends anything more.
+func (c *Request) Flush() error {
+	if f, ok := c.Conn.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// flushIfDrained flushes the replies written so far when every command
+// the client has sent is handled, as the next read waits on the client,
+// and the client may be waiting on them.
+func (c *Request) flushIfDrained() {
+	if c.reader.Buffered() == 0 {
+		c.Flush()
+	}
+}
@@ -0,0 +1,144 @@
+package scs
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBinaryValues verifies values with a declared length can hold any
+// bytes, and survive being encoded for the mutation log.
+func TestBinaryValues(t *testing.T) {
+	s, n, b := startServer(t, 65535)
+	defer s.Close()
+
+	data := "\x00\x01\r\n\xff\xfebinary\r\n"
+	expect(t, n, b, "set blob 0 0 14\r\n"+data+"\r\n", "STORED")
+	expect(t, n, b, "get blob\r\n", "VALUE blob", "\x00\x01", "\xff\xfebinary", "", "END")
+
+	expect(t, n, b, "set blob 0 0 2\r\nabc\r\n", "ERROR bad data chunk")
+	big := strings.Repeat("a", MAX_DATA_SIZE)
+	expect(t, n, b, "set big 0 0 8192\r\n"+big+"\r\nget blob\r\n", "ERROR data can only be 8192 characters long",
+		"VALUE blob", "\x00\x01", "\xff\xfebinary", "", "END")
+
+	expect(t, n, b, "append blob 0 0 2\r\n\r\n\r\n", "STORED")
+	s.c.lockAll()
+	v := string(s.c.dbs[0].shard("blob").Cache["blob"].value)
+	entries := s.c.snapshotEntries()
+	s.c.unlockAll()
+	if v != data+"\r\n" {
+		t.Errorf("blob = %q, wanted %q", v, data+"\r\n")
+	}
+
+	rec := encodeStore(nil, "blob", entries[0].value, 0, entries[0].expires)
+	_, _, value, _, _, err := decodeRecord(rec[1 : len(rec)-4])
+	if err != nil || string(value) != data+"\r\n" {
+		t.Errorf("decodeRecord = %q, %v, wanted %q", value, err, data+"\r\n")
+	}
+}
+
+// TestLongLine verifies clients are disconnected after sending a line
+// longer than maxLineSize.
+func TestLongLine(t *testing.T) {
+	s, n, b := startServer(t, 65535)
+	defer s.Close()
+
+	n.Write([]byte("get " + strings.Repeat("a", maxLineSize)))
+	r, err := b.ReadString('\n')
+	if err == nil {
+		t.Errorf("long line fail, expected connection to close, got %v", r)
+	}
+}
+
+// countingConn counts the writes made to a connection.
+type countingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(p)
+}
+
+// TestPipelining verifies commands sent back to back get their replies
+// in order, in a single write once they are all handled, and that quit
+// still sends the replies before it.
+func TestPipelining(t *testing.T) {
+	s, n, b := startServer(t, 65535)
+	defer s.Close()
+
+	var cmds string
+	var want []string
+	for i := 0; i < 50; i++ {
+		k := "k" + strconv.Itoa(i)
+		cmds += "set " + k + "\r\n" + strconv.Itoa(i) + "\r\nget " + k + " missing\r\n"
+		want = append(want, "STORED", "VALUE "+k, strconv.Itoa(i), "END")
+	}
+	expect(t, n, b, cmds, want...)
+
+	// The server side of a pipe lets the test count the writes
+	server, client := net.Pipe()
+	defer client.Close()
+	cc := &countingConn{Conn: server}
+	go s.handle(cc)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	go client.Write([]byte("get k1 k2 k3\r\nstats\r\nquit\r\n"))
+	r := bufio.NewReader(client)
+	lines := 0
+	for {
+		_, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		lines++
+	}
+	if lines != 7+35 {
+		t.Errorf("got %v lines before quit closed the connection, wanted %v", lines, 7+35)
+	}
+	if cc.writes != 1 {
+		t.Errorf("got %v writes, wanted the replies sent in 1", cc.writes)
+	}
+}
+
+// benchmarkGets runs b.N gets of a 10 key get, with depth of them sent
+// before reading any reply.
+func benchmarkGets(b *testing.B, depth int) {
+	s, err := NewServer(testOptions()...)
+	if err != nil {
+		b.Fatalf("failed to create server: %v", err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	n, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		b.Fatalf("unable to connect to server: %v", err)
+	}
+	defer n.Close()
+	r := bufio.NewReader(n)
+
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+		n.Write([]byte("set " + keys[i] + "\r\nvalue\r\n"))
+		r.ReadString('\n')
+	}
+	get := []byte(strings.Repeat("get "+strings.Join(keys, " ")+"\r\n", depth))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i += depth {
+		n.Write(get)
+		for j := 0; j < depth*21; j++ {
+			if _, err := r.ReadString('\n'); err != nil {
+				b.Fatalf("read error: %v", err)
+			}
+		}
+	}
+}
+
+func BenchmarkGetRoundTrip(b *testing.B) { benchmarkGets(b, 1) }
+func BenchmarkGetPipelined(b *testing.B) { benchmarkGets(b, 100) }
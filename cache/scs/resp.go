@@ -0,0 +1,559 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// respMaxCommand is the most bytes a single RESP command can take,
+	// counting each bulk string and its $<length> line: a text protocol
+	// line's worth of keys and a value of MAX_DATA_SIZE.  Values over
+	// MAX_DATA_SIZE are still refused by the set handlers, this stops a
+	// client from making the server allocate more before that.
+	respMaxCommand = maxLineSize + MAX_DATA_SIZE
+	// respMaxArgs is the most arguments a single RESP command can have,
+	// each taking at least the 6 bytes of "$0\r\n\r\n".
+	respMaxArgs = respMaxCommand / 6
+)
+
+// respProtocolError is returned when a client sends something that is
+// not RESP.  The client is told why and disconnected, as there is no
+// way to find the start of the next command.
+type respProtocolError string
+
+func (e respProtocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// respConn is a single client connection speaking RESP2, the Redis
+// protocol.  Commands are run by the same handlers as the text protocol
+// and their replies translated into RESP types.  Like binConn, replies
+// are only flushed once every command sent so far is handled.
+type respConn struct {
+	s        *Server
+	conn     net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	identity string // see Request.Identity
+	cs       *connStats
+	db       *database // see Request.db
+}
+
+// respCapture is given to handlers in place of the client connection so
+// their text replies can be translated before the client sees them.
+// Close still closes the client connection.
+type respCapture struct {
+	net.Conn
+	out bytes.Buffer
+}
+
+func (c *respCapture) Write(b []byte) (int, error) {
+	return c.out.Write(b)
+}
+
+// listenRESP opens a listener that speaks the Redis RESP2 protocol on
+// port, so Redis clients can use the cache.  Commands are mapped onto
+// the handlers registered with Handle.  It must be called before
+// Serve.
+func (s *Server) listenRESP(addr string, port int) error {
+	l, err := s.listen("resp", addr, port)
+	if err != nil {
+		return err
+	}
+	s.rl = l
+	for _, cmd := range respCmdNames {
+		s.metrics.track("resp", cmd)
+	}
+	return nil
+}
+
+// serveRESP accepts connections on the RESP listener and passes each
+// one to its own goroutine.
+func (s *Server) serveRESP() {
+	for {
+		conn, err := s.rl.Accept()
+		if err != nil {
+			return
+		}
+		r := &respConn{s, conn, bufio.NewReaderSize(conn, maxLineSize), bufio.NewWriter(conn), "", nil, nil}
+		if s.c != nil {
+			r.db = s.c.dbs[0]
+		}
+		go r.handle()
+	}
+}
+
+// handle reads commands from the client and replies to them until the
+// client quits or breaks the protocol.
+func (r *respConn) handle() {
+	defer r.conn.Close()
+	var err error
+	r.cs, err = r.s.stats.open("resp", r.conn)
+	if err != nil {
+		if err == errTooManyConns {
+			r.conn.SetDeadline(time.Now().Add(rejectTimeout))
+			r.writeError("max number of clients reached")
+			r.w.Flush()
+		}
+		return
+	}
+	defer r.s.stats.close(r.cs)
+
+	r.identity, err = identify(r.conn)
+	if err != nil {
+		return
+	}
+
+	for {
+		if r.r.Buffered() == 0 {
+			if r.w.Flush() != nil {
+				return
+			}
+		}
+
+		r.s.timeouts.waiting(r.conn, false)
+		args, err := r.readCommand()
+		if err != nil {
+			if _, ok := err.(respProtocolError); ok {
+				r.writeError(err.Error())
+				r.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if !r.cs.begin() {
+			return
+		}
+		if !r.s.stats.allow(r.cs) {
+			r.writeError("rate limited")
+		} else if !r.dispatch(args) {
+			r.w.Flush()
+			return
+		}
+		if !r.cs.end() {
+			r.w.Flush()
+			return
+		}
+	}
+}
+
+// readLine reads a single line and strips the \r\n from it.  The line
+// is only valid until the next read.
+func (r *respConn) readLine() ([]byte, error) {
+	line, err := r.r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, respProtocolError("expected \\r\\n")
+	}
+	return line[:len(line)-2], nil
+}
+
+// readCommand reads an array of bulk strings, or an inline command of
+// space separated words as typed into telnet.
+func (r *respConn) readCommand() ([]string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(string(line)), nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > respMaxArgs {
+		return nil, respProtocolError("invalid multibulk length")
+	}
+	// The rest of the command is under the read timeout, not the idle one
+	r.s.timeouts.running(r.conn)
+
+	var args []string
+	left := respMaxCommand
+	for ; n > 0; n-- {
+		line, err = r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, respProtocolError(fmt.Sprintf("expected '$', got '%q'", line))
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 {
+			return nil, respProtocolError("invalid bulk length")
+		}
+		// Refused before anything is allocated for it
+		left -= len(line) + 2 + size + 2
+		if left < 0 {
+			return nil, respProtocolError("command too long")
+		}
+
+		b := make([]byte, size+2)
+		_, err = io.ReadFull(r.r, b)
+		if err != nil {
+			return nil, err
+		}
+		if b[size] != '\r' || b[size+1] != '\n' {
+			return nil, respProtocolError("bulk string not followed by \\r\\n")
+		}
+		args = append(args, string(b[:size]))
+	}
+	return args, nil
+}
+
+// dispatch runs a single command.  Returns false once the connection
+// should be closed.
+func (r *respConn) dispatch(args []string) bool {
+	name := strings.ToUpper(args[0])
+	defer r.s.metrics.observe("resp", strings.ToLower(name), time.Now())
+	r.cs.command(strings.ToLower(name))
+	switch name {
+	case "GET":
+		if len(args) != 2 {
+			r.writeArgsError(args[0])
+			break
+		}
+		values, ok := r.get(args[1:])
+		if ok {
+			r.writeBulk(values[args[1]])
+		}
+	case "MGET":
+		if len(args) < 2 {
+			r.writeArgsError(args[0])
+			break
+		}
+		values, ok := r.get(args[1:])
+		if ok {
+			r.writeArray(len(args) - 1)
+			for _, k := range args[1:] {
+				r.writeBulk(values[k])
+			}
+		}
+	case "SET":
+		r.set(args)
+	case "DEL", "EXISTS":
+		if len(args) < 2 {
+			r.writeArgsError(args[0])
+			break
+		}
+		r.count(name, args[1:])
+	case "PING":
+		switch len(args) {
+		case 1:
+			r.writeSimple("PONG")
+		case 2:
+			r.writeBulk([]byte(args[1]))
+		default:
+			r.writeArgsError(args[0])
+		}
+	case "INFO":
+		r.info()
+	case "SELECT":
+		if len(args) != 2 {
+			r.writeArgsError(args[0])
+			break
+		}
+		if _, ok := r.run("select", args[1:], nil); ok {
+			r.writeSimple("OK")
+		}
+	case "FLUSHDB":
+		if len(args) != 1 {
+			r.writeArgsError(args[0])
+			break
+		}
+		if _, ok := r.run("flushdb", nil, nil); ok {
+			r.writeSimple("OK")
+		}
+	case "DBSIZE":
+		if len(args) != 1 {
+			r.writeArgsError(args[0])
+			break
+		}
+		r.dbsize()
+	case "MOVE":
+		if len(args) != 3 {
+			r.writeArgsError(args[0])
+			break
+		}
+		r.move(args[1], args[2])
+	case "QUIT":
+		r.writeSimple("OK")
+		r.w.Flush()
+		r.run("quit", nil, nil)
+		return false
+	default:
+		r.writeError(fmt.Sprintf("unknown command '%v'", args[0]))
+	}
+	return true
+}
+
+// run calls the handler registered for cmd with args, and data as the
+// rest of the input for handlers that read from the client.  Returns
+// what the handler wrote, or false if it was an error, which is
+// already written to the client.
+func (r *respConn) run(cmd string, args []string, data []byte) ([]byte, bool) {
+	h, ok := r.s.cmds[cmd]
+	if !ok {
+		r.writeError(fmt.Sprintf("unknown command '%v'", cmd))
+		return nil, false
+	}
+
+	capture := &respCapture{Conn: r.conn}
+	req := Request{}
+	req.Storage = r.s.st
+	req.c = r.s.c
+	if r.db != nil {
+		req.Storage = r.db
+		req.db = r.db
+	}
+	req.Cmd = cmd
+	req.Subcmd = args
+	req.Conn = capture
+	req.Memcached = true
+	req.Identity = r.identity
+	req.stats = r.s.stats
+	if data != nil {
+		data = append(data, "\r\n"...)
+	}
+	req.reader = bufio.NewReader(bytes.NewReader(data))
+
+	h.ServeRequest(&req)
+	r.db = req.db
+
+	out := capture.out.Bytes()
+	if bytes.HasPrefix(out, []byte("ERROR")) {
+		line := out
+		if i := bytes.IndexByte(line, '\r'); i >= 0 {
+			line = line[:i]
+		}
+		r.writeError(strings.TrimSpace(string(line[len("ERROR"):])))
+		return nil, false
+	}
+	return out, true
+}
+
+// validKeys checks keys can be used with the text protocol handlers,
+// which split their input on spaces.
+func (r *respConn) validKeys(keys []string) bool {
+	for _, k := range keys {
+		if strings.Contains(k, " ") || !validChars.MatchString(k) {
+			r.writeError("invalid key characters")
+			return false
+		}
+	}
+	return true
+}
+
+// get runs the get handler for keys and returns the values found.
+func (r *respConn) get(keys []string) (map[string][]byte, bool) {
+	if !r.validKeys(keys) {
+		return nil, false
+	}
+	out, ok := r.run("get", keys, nil)
+	if !ok {
+		return nil, false
+	}
+
+	// Parse the VALUE <key> <flags> <bytes> replies up to END
+	values := make(map[string][]byte)
+	for {
+		i := bytes.Index(out, []byte("\r\n"))
+		if i < 0 {
+			break
+		}
+		f := strings.Fields(string(out[:i]))
+		out = out[i+2:]
+		if len(f) != 4 || f[0] != "VALUE" {
+			break
+		}
+		n, err := strconv.Atoi(f[3])
+		if err != nil || n+2 > len(out) {
+			break
+		}
+		values[f[1]] = out[:n]
+		out = out[n+2:]
+	}
+	return values, true
+}
+
+// set handles SET <key> <value> [EX seconds|PX milliseconds] [NX|XX]
+// with the memcached form of the set, add and replace handlers.
+// Milliseconds are rounded up to whole seconds.
+func (r *respConn) set(args []string) {
+	if len(args) < 3 {
+		r.writeArgsError(args[0])
+		return
+	}
+
+	cmd := "set"
+	var exptime int64
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		switch {
+		case opt == "NX" && cmd == "set":
+			cmd = "add"
+		case opt == "XX" && cmd == "set":
+			cmd = "replace"
+		case (opt == "EX" || opt == "PX") && exptime == 0 && i+1 < len(args):
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || n <= 0 {
+				r.writeError("invalid expire time in 'set' command")
+				return
+			}
+			if opt == "PX" {
+				n = (n + 999) / 1000
+			}
+			exptime = n
+		default:
+			r.writeError("syntax error")
+			return
+		}
+	}
+	if exptime > maxRelativeExptime {
+		// Too long to be taken as a number of seconds
+		exptime += time.Now().Unix()
+	}
+
+	if !r.validKeys(args[1:2]) {
+		return
+	}
+	value := []byte(args[2])
+	sub := []string{args[1], "0", strconv.FormatInt(exptime, 10), strconv.Itoa(len(value))}
+	out, ok := r.run(cmd, sub, value)
+	if !ok {
+		return
+	}
+	if bytes.HasPrefix(out, []byte("STORED")) {
+		r.writeSimple("OK")
+	} else {
+		r.writeBulk(nil)
+	}
+}
+
+// count handles DEL and EXISTS, replying with the number of keys that
+// were deleted or found.  EXISTS uses the ttl handler so looking a key
+// up does not count as a get.
+func (r *respConn) count(name string, keys []string) {
+	if !r.validKeys(keys) {
+		return
+	}
+	cmd, hit := "delete", "DELETED"
+	if name == "EXISTS" {
+		cmd, hit = "ttl", "TTL"
+	}
+
+	n := 0
+	for _, k := range keys {
+		out, ok := r.run(cmd, []string{k}, nil)
+		if !ok {
+			return
+		}
+		if bytes.HasPrefix(out, []byte(hit)) {
+			n++
+		}
+	}
+	r.writeInt(n)
+}
+
+// info handles INFO by running the stats handler and replying with its
+// stats as name:value lines.
+func (r *respConn) info() {
+	out, ok := r.run("stats", nil, nil)
+	if !ok {
+		return
+	}
+
+	var b bytes.Buffer
+	b.WriteString("# Stats\r\n")
+	for _, line := range strings.Split(string(out), "\r\n") {
+		f := strings.Fields(line)
+		if len(f) == 2 {
+			b.WriteString(f[0] + ":" + f[1] + "\r\n")
+		}
+	}
+	r.writeBulk(b.Bytes())
+}
+
+// dbsize handles DBSIZE by running the dbsize handler and replying
+// with its count.
+func (r *respConn) dbsize() {
+	out, ok := r.run("dbsize", nil, nil)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(string(out), "DBSIZE")))
+	if err != nil {
+		r.writeError("bad dbsize reply")
+		return
+	}
+	r.writeInt(n)
+}
+
+// move handles MOVE <key> <db>, replying 1 if the key was moved and 0
+// if it was not in this database or already in the other one.
+func (r *respConn) move(key, db string) {
+	if !r.validKeys([]string{key}) {
+		return
+	}
+	out, ok := r.run("move", []string{key, db}, nil)
+	if !ok {
+		return
+	}
+	if bytes.HasPrefix(out, []byte("MOVED")) {
+		r.writeInt(1)
+	} else {
+		r.writeInt(0)
+	}
+}
+
+// writeSimple writes a simple string reply.
+func (r *respConn) writeSimple(s string) {
+	r.w.WriteString("+" + s + "\r\n")
+}
+
+// writeError writes an error reply.
+func (r *respConn) writeError(msg string) {
+	r.w.WriteString("-ERR " + msg + "\r\n")
+}
+
+// writeArgsError writes the error for a command given the wrong number
+// of arguments.
+func (r *respConn) writeArgsError(name string) {
+	r.writeError(fmt.Sprintf("wrong number of arguments for '%v' command", strings.ToLower(name)))
+}
+
+// writeInt writes an integer reply.
+func (r *respConn) writeInt(n int) {
+	fmt.Fprintf(r.w, ":%d\r\n", n)
+}
+
+// writeBulk writes a bulk string reply, or the null bulk string if b
+// is nil.
+func (r *respConn) writeBulk(b []byte) {
+	if b == nil {
+		r.w.WriteString("$-1\r\n")
+		return
+	}
+	fmt.Fprintf(r.w, "$%d\r\n", len(b))
+	r.w.Write(b)
+	r.w.WriteString("\r\n")
+}
+
+// writeArray writes the header of an array reply of n elements.
+func (r *respConn) writeArray(n int) {
+	fmt.Fprintf(r.w, "*%d\r\n", n)
+}
@@ -0,0 +1,115 @@
+package scs
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// respCmd builds a RESP array of bulk strings.
+func respCmd(args ...string) string {
+	s := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, a := range args {
+		s += "$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n"
+	}
+	return s
+}
+
+// TestRESP runs Redis commands against the RESP listener and verifies
+// they share the cache with the text protocol.
+func TestRESP(t *testing.T) {
+	s, err := NewServer(testOptions(WithRESPPort(0))...)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer s.Close()
+	go s.Serve()
+
+	rn, err := net.Dial("tcp", s.rl.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect to server: %v", err)
+	}
+	rn.SetDeadline(time.Now().Add(5 * time.Second))
+	rb := bufio.NewReader(rn)
+
+	expect(t, rn, rb, respCmd("PING"), "+PONG")
+	expect(t, rn, rb, respCmd("ping", "hi"), "$2", "hi")
+	expect(t, rn, rb, respCmd("SET", "sushi", "deli\r\ncious"), "+OK")
+	expect(t, rn, rb, respCmd("GET", "sushi"), "$11", "deli", "cious")
+	expect(t, rn, rb, respCmd("GET", "missing"), "$-1")
+	expect(t, rn, rb, respCmd("SET", "sushi", "again", "NX"), "$-1")
+	expect(t, rn, rb, respCmd("SET", "missing", "again", "XX"), "$-1")
+	expect(t, rn, rb, respCmd("SET", "sushi", "1", "NX", "XX"), "-ERR syntax error")
+	expect(t, rn, rb, respCmd("SET", "bad key", "1"), "-ERR invalid key characters")
+	expect(t, rn, rb, respCmd("GET"), "-ERR wrong number of arguments for 'get' command")
+	expect(t, rn, rb, respCmd("HGET", "a", "b"), "-ERR unknown command 'HGET'")
+
+	// the text protocol sees the same data
+	n, b := dial(t, s)
+	expect(t, n, b, "get sushi\r\n", "VALUE sushi", "deli", "cious", "END")
+	expect(t, n, b, "set topcoder\r\nfun\r\n", "STORED")
+
+	expect(t, rn, rb, respCmd("MGET", "topcoder", "missing", "sushi"),
+		"*3", "$3", "fun", "$-1", "$11", "deli", "cious")
+	expect(t, rn, rb, respCmd("EXISTS", "topcoder", "missing", "topcoder"), ":2")
+	expect(t, rn, rb, respCmd("DEL", "topcoder", "missing", "sushi"), ":2")
+	expect(t, rn, rb, respCmd("EXISTS", "topcoder"), ":0")
+
+	expect(t, rn, rb, respCmd("SET", "short", "lived", "EX", "10"), "+OK")
+	expect(t, n, b, "ttl short\r\n", "TTL 10")
+	expect(t, rn, rb, respCmd("SET", "short", "lived", "PX", "1500"), "+OK")
+	expect(t, n, b, "ttl short\r\n", "TTL 2")
+	expect(t, rn, rb, respCmd("SET", "short", "lived", "EX", "0"), "-ERR invalid expire time in 'set' command")
+
+	// errors from the handlers are passed on
+	expect(t, rn, rb, respCmd("SET", "big", string(make([]byte, MAX_DATA_SIZE))),
+		"-ERR data can only be 8192 characters long")
+
+	// inline commands and pipelining
+	expect(t, rn, rb, "SET inline works\r\nGET inline\r\n", "+OK", "$5", "works")
+
+	// The server stats change from run to run, so neither they nor the
+	// length of the reply are checked
+	rn.Write([]byte(respCmd("INFO")))
+	if r, err := rb.ReadString('\n'); err != nil || r[0] != '$' {
+		t.Errorf("INFO expected a bulk string, got %q %v", r, err)
+	}
+	expect(t, rn, rb, "", "# Stats", "cmd_get:7", "cmd_set:5", "get_hits:5", "get_misses:2",
+		"delete_hits:2", "delete_misses:1", "curr_items:2", "limit_items:65535", "expired_unfetched:0",
+		"reclaimed:0", "evictions:0", "bytes:21", "limit_maxbytes:67108864",
+		"incr_hits:0", "incr_misses:0", "decr_hits:0", "decr_misses:0",
+		"role:primary", "connected_replicas:0", "repl_offset:0", "repl_lag_bytes:0", "repl_lag_seconds:0")
+	skipServerStats(t, rb, ":")
+	expect(t, rn, rb, "", "")
+
+	expect(t, rn, rb, respCmd("QUIT"), "+OK")
+	if _, err := rb.ReadByte(); err == nil {
+		t.Errorf("quit fail, expected connection to close")
+	}
+
+	// protocol errors disconnect the client
+	rn, err = net.Dial("tcp", s.rl.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect to server: %v", err)
+	}
+	rn.SetDeadline(time.Now().Add(5 * time.Second))
+	rb = bufio.NewReader(rn)
+	expect(t, rn, rb, "*1\r\n+PING\r\n", "-ERR Protocol error: expected '$', got '\"+PING\"'")
+	if _, err := rb.ReadByte(); err == nil {
+		t.Errorf("expected connection to close after a protocol error")
+	}
+
+	// so do commands over respMaxCommand bytes, before they are read
+	rn, err = net.Dial("tcp", s.rl.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect to server: %v", err)
+	}
+	rn.SetDeadline(time.Now().Add(5 * time.Second))
+	rb = bufio.NewReader(rn)
+	expect(t, rn, rb, "*3\r\n$3\r\nSET\r\n$5\r\nsushi\r\n$"+strconv.Itoa(respMaxCommand)+"\r\n", "-ERR Protocol error: command too long")
+	if _, err := rb.ReadByte(); err == nil {
+		t.Errorf("expected connection to close after a command that is too long")
+	}
+}
@@ -0,0 +1,12 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import "time"
+
+// rusage is not available on Windows, so stats reports no CPU time.
+func rusage() (user, system time.Duration) {
+	return 0, 0
+}
@@ -0,0 +1,549 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/kyrra/sandbox/auth"
+)
+
+const (
+	MAX_KEY_SIZE  = 250
+	MAX_DATA_SIZE = 8192
+)
+
+// validChars is used to make sure there are only supports ascii character
+// in a given string
+var validChars = regexp.MustCompile("^[a-zA-Z0-9!#$%&'\"*+\\-/\\\\=?^_{|}~()<>\\[\\]:;@,. ]+$")
+
+// Server is the TCP server for the cache application.
+// It maintains the TCP listener, the map of commands to
+// their given handler, and keeps the Storage to pass
+// to each new connection.
+type Server struct {
+	l        net.Listener
+	bl       net.Listener // memcached binary protocol, when enabled
+	rl       net.Listener // Redis RESP protocol, when enabled
+	ml       net.Listener // HTTP /metrics, when enabled
+	cmds     map[string]Handler
+	tls      *tls.Config // nil unless the listeners serve TLS
+	st       Storage
+	c        *dataCache // the built in cache, nil when WithStorage is used
+	ps       *pubsub
+	auth     *auth.Datastore // nil unless clients must auth
+	metrics  *metrics
+	stats    *serverStats
+	timeouts timeouts
+	done     chan struct{}
+	// stopping is closed when Shutdown starts and stopped once it is
+	// done.  done is closed by whichever of Shutdown and Close is first.
+	stopping     chan struct{}
+	stopped      chan struct{}
+	doneOnce     sync.Once
+	shutdownOnce sync.Once
+	// memcached makes get reply in the memcached format
+	memcached bool
+}
+
+// Handler runs a command sent to the server.  It reads any more input
+// it needs from the request and writes its reply back to it.
+type Handler interface {
+	ServeRequest(c *Request)
+}
+
+// HandlerFunc lets an ordinary function be used as a Handler.
+type HandlerFunc func(c *Request)
+
+// ServeRequest calls f(c).
+func (f HandlerFunc) ServeRequest(c *Request) {
+	f(c)
+}
+
+// NewServer initializes everything needed to handle new
+// connections to the cache server.  It starts listening, creates or
+// loads the cache and registers every built in command, so more can be
+// added with Handle before calling Serve.
+func NewServer(opts ...Option) (*Server, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.storage != nil && (o.snapshot != "" || o.log != "" || o.replicaOf != "") {
+		return nil, fmt.Errorf("snapshots, the mutation log and replication need the built in storage")
+	}
+	if o.auth != "" && (o.binaryPort >= 0 || o.respPort >= 0) {
+		return nil, fmt.Errorf("auth is only supported by the text protocol")
+	}
+	if o.rateLimit > 0 && o.rateBurst < 1 {
+		return nil, fmt.Errorf("rate limit burst must be at least 1")
+	}
+
+	s := Server{}
+	s.metrics = newMetrics()
+	s.stats = newServerStats(s.metrics)
+	s.stats.maxConns = o.maxConns
+	if o.rateLimit > 0 {
+		s.stats.limiter = newRateLimiter(o.rateLimit, o.rateBurst)
+	}
+	s.timeouts = timeouts{idle: o.idleTimeout, read: o.readTimeout, write: o.writeTimeout}
+	if o.tlsCert != "" || o.tlsKey != "" || o.tlsCA != "" {
+		config, err := loadTLS(o.tlsCert, o.tlsKey, o.tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		s.tls = config
+	}
+
+	l, err := s.listen("text", o.addr, o.port)
+	if err != nil {
+		return nil, err
+	}
+	s.l = l
+	s.cmds = make(map[string]Handler)
+	s.memcached = o.memcached
+	s.ps = newPubSub()
+	s.done = make(chan struct{})
+	s.stopping = make(chan struct{})
+	s.stopped = make(chan struct{})
+
+	err = s.configure(o)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// configure sets up everything but the text protocol listener in the
+// order each part needs: the cache limits before anything is loaded
+// into it, and the snapshot before the log that follows it.
+func (s *Server) configure(o options) error {
+	s.st = o.storage
+	if s.st == nil {
+		s.c = &dataCache{}
+		s.c.maxItems = o.maxItems
+		s.c.policy = "lru"
+		s.c.feed = newReplicaFeed()
+		if o.replicaOf != "" {
+			s.c.link = &replicaLink{addr: o.replicaOf}
+		}
+
+		err := s.setDatabases(o.databases)
+		if err != nil {
+			return err
+		}
+		err = s.setShards(o.shards)
+		if err != nil {
+			return err
+		}
+		err = s.setEvictionPolicy(o.policy)
+		if err != nil {
+			return err
+		}
+		s.setMemoryLimit(o.maxBytes)
+	}
+
+	if o.binaryPort >= 0 {
+		err := s.listenBinary(o.addr, o.binaryPort)
+		if err != nil {
+			return err
+		}
+	}
+	if o.respPort >= 0 {
+		err := s.listenRESP(o.addr, o.respPort)
+		if err != nil {
+			return err
+		}
+	}
+	if o.metricsPort >= 0 {
+		err := s.listenMetrics(o.addr, o.metricsPort)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.snapshot != "" {
+		err := s.setSnapshot(o.snapshot)
+		if err != nil {
+			return err
+		}
+		err = s.setSaveRules(o.saveRules)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.log != "" {
+		err := s.setLog(o.log, o.fsync)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.auth != "" {
+		var err error
+		s.auth, err = loadUsers(o.auth)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.registerHandlers()
+}
+
+// Addr returns the address the text protocol is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.l.Addr()
+}
+
+// Server will start accepting new connections and
+// pass each new connection onto its own goroutine.
+func (s *Server) Serve() error {
+	if s.c != nil {
+		go s.reaper()
+	}
+	if s.c != nil && s.c.link != nil {
+		go s.replicate()
+	}
+	if s.bl != nil {
+		go s.serveBinary()
+	}
+	if s.rl != nil {
+		go s.serveRESP()
+	}
+	if s.ml != nil {
+		go s.serveMetrics()
+	}
+
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			select {
+			case <-s.stopping:
+				<-s.stopped
+				return ErrServerClosed
+			default:
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close will shut down the listening sockets and stop the
+// background reaper.  Any open connections remain open; Shutdown
+// closes them once their commands finish.
+func (s *Server) Close() {
+	s.closeListeners()
+	s.doneOnce.Do(func() { close(s.done) })
+}
+
+// closeListeners closes every listener, so no more connections are
+// accepted.
+func (s *Server) closeListeners() {
+	s.l.Close()
+	if s.bl != nil {
+		s.bl.Close()
+	}
+	if s.rl != nil {
+		s.rl.Close()
+	}
+	if s.ml != nil {
+		s.ml.Close()
+	}
+}
+
+// Handle adds a new command handler for the server to call when
+// name is matched to user input.  It must be called before Serve.
+func (s *Server) Handle(name string, h Handler) error {
+	_, ok := s.cmds[name]
+	if ok {
+		return fmt.Errorf("Command '%v' is already registered", name)
+	}
+
+	s.cmds[name] = h
+	s.metrics.track("text", name)
+	return nil
+}
+
+// HandleFunc adds a function as the handler for name.
+func (s *Server) HandleFunc(name string, f func(c *Request)) error {
+	return s.Handle(name, HandlerFunc(f))
+}
+
+// registerHandlers will associate the built in command handlers to
+// their given command available via the server.
+func (s *Server) registerHandlers() error {
+	err := s.HandleFunc("auth", cmdAuth)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("set", cmdSet)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("add", cmdAdd)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("replace", cmdReplace)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("append", cmdAppend)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("prepend", cmdPrepend)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("get", cmdGet)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("gets", cmdGets)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("cas", cmdCas)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("delete", cmdDelete)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("incr", cmdIncr)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("decr", cmdDecr)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("expire", cmdExpire)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("ttl", cmdTTL)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("persist", cmdPersist)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("select", cmdSelect)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("flushdb", cmdFlushDB)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("dbsize", cmdDBSize)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("move", cmdMove)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("stats", cmdStats)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("save", cmdSave)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("bgsave", cmdBgsave)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("rewritelog", cmdRewriteLog)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("sync", cmdSync)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("subscribe", cmdSubscribe)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("unsubscribe", cmdUnsubscribe)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("psubscribe", cmdPsubscribe)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("punsubscribe", cmdPunsubscribe)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("publish", cmdPublish)
+	if err != nil {
+		return err
+	}
+	err = s.HandleFunc("quit", cmdQuit)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// handle take a connection and reads data from it,
+// processing the requests
+func (s *Server) handle(conn net.Conn) {
+
+	req := Request{}
+	req.reader = bufio.NewReaderSize(conn, maxLineSize)
+	req.Conn = &bufferedConn{conn, bufio.NewWriter(conn)}
+	req.Storage = s.st
+	req.c = s.c
+	if s.c != nil {
+		req.db = s.c.dbs[0]
+	}
+	req.Memcached = s.memcached
+	req.ps = s.ps
+	req.users = s.auth
+	req.stats = s.stats
+	var err error
+	req.conn, err = s.stats.open("text", conn)
+	if err != nil {
+		if err == errTooManyConns {
+			conn.SetDeadline(time.Now().Add(rejectTimeout))
+			conn.Write([]byte("ERROR too many connections\r\n"))
+		}
+		conn.Close()
+		return
+	}
+	defer s.stats.close(req.conn)
+
+	req.Identity, err = identify(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	// Shutdown closes the connection between commands, or once the
+	// one running has replied
+	for {
+		s.timeouts.waiting(conn, req.sub.subscribed() != 0)
+		data, err := req.Readln()
+		if err != nil || !req.conn.begin() {
+			break
+		}
+		s.timeouts.running(conn)
+
+		input, err := req.ValidateInput(data)
+		if err != nil {
+			req.WriteStr(err.Error())
+		} else if len(input) != 0 {
+			s.processInput(string(data), &req)
+		}
+
+		if !req.conn.end() {
+			break
+		}
+	}
+	req.Conn.Close()
+	if req.sub != nil {
+		s.ps.unsubscribeAll(req.sub)
+	}
+}
+
+// storageCmds are the commands that are followed by a line or block of
+// data, in either of the forms parseStorage takes.
+var storageCmds = map[string]bool{
+	"set":     true,
+	"add":     true,
+	"replace": true,
+	"append":  true,
+	"prepend": true,
+	"cas":     true,
+}
+
+// reject writes msg to the client in place of running its command.  The
+// data sent after a set family command is read and thrown away first,
+// or it would be taken for the next command.
+func reject(c *Request, msg string) {
+	if !storageCmds[c.Cmd] {
+		c.WriteStr(msg)
+		return
+	}
+
+	// cas has a version as well, just before the memcached form's
+	// noreply or after the key and ttl of the simple one
+	n := len(c.Subcmd)
+	if c.Cmd == "cas" {
+		n--
+	}
+	var err error
+	switch {
+	case n == 1 || n == 2:
+		_, err = c.Readln()
+	case n == 4 || (n == 5 && c.Subcmd[len(c.Subcmd)-1] == "noreply"):
+		if size, serr := strconv.Atoi(c.Subcmd[3]); serr == nil && size >= 0 {
+			err = c.SkipData(size)
+		}
+	}
+	if err == nil {
+		c.WriteStr(msg)
+	}
+}
+
+// processInput takes a string, splits it by space, then calls
+// the appropriate cmd function to handle the request
+func (s *Server) processInput(input string, c *Request) {
+	cmds := strings.Fields(input)
+	if len(cmds) == 0 {
+		return
+	}
+
+	c.Cmd = cmds[0]
+	c.Subcmd = cmds[1:]
+	c.line = strings.TrimSuffix(input, "\r\n")
+	if c.conn != nil {
+		c.conn.command(c.Cmd)
+	}
+
+	if c.conn != nil && !s.stats.allow(c.conn) {
+		reject(c, "ERROR rate limited")
+		return
+	}
+	h, ok := s.cmds[c.Cmd]
+	if !ok {
+		c.WriteStr("ERROR unknown command")
+		return
+	}
+	if c.users != nil && !c.authed && c.Cmd != "auth" && c.Cmd != "quit" {
+		reject(c, "ERROR authentication required")
+		return
+	}
+	if c.sub.subscribed() != 0 && !pubsubCmds[c.Cmd] {
+		reject(c, "ERROR only subscribe, unsubscribe, psubscribe, punsubscribe and quit are allowed while subscribed")
+		return
+	}
+
+	start := time.Now()
+	h.ServeRequest(c)
+	s.metrics.observe("text", c.Cmd, start)
+}
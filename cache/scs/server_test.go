@@ -0,0 +1,130 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestHandle verifies custom commands can be added next to the built in
+// ones and reach the cache through Storage.
+func TestHandle(t *testing.T) {
+	s, err := NewServer(testOptions()...)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.HandleFunc("get", cmdGet); err == nil {
+		t.Errorf("registering get twice succeeded")
+	}
+	err = s.HandleFunc("upper", func(c *Request) {
+		if len(c.Subcmd) != 1 {
+			c.WriteStr("ERROR upper command requires a single key to be specified")
+			return
+		}
+		i, ok := c.Storage.Get(c.Subcmd[0])
+		if !ok {
+			c.WriteStr("NOT_FOUND")
+			return
+		}
+		c.WriteStr(strings.ToUpper(string(i.Value)))
+	})
+	if err != nil {
+		t.Fatalf("failed to register upper: %v", err)
+	}
+	go s.Serve()
+	n, b := dial(t, s)
+
+	expect(t, n, b, "set sushi\r\ndelicious\r\n", "STORED")
+	expect(t, n, b, "upper sushi\r\n", "DELICIOUS")
+	expect(t, n, b, "upper tofu\r\n", "NOT_FOUND")
+	expect(t, n, b, "stats\r\n", "cmd_get 2", "cmd_set 1", "get_hits 1", "get_misses 1")
+}
+
+// mapStorage is a Storage that only supports set, get and delete.
+type mapStorage struct {
+	sync.Mutex
+	m map[string]Item
+}
+
+func (m *mapStorage) Get(key string) (Item, bool) {
+	return m.Peek(key)
+}
+
+func (m *mapStorage) Peek(key string) (Item, bool) {
+	m.Lock()
+	defer m.Unlock()
+	i, ok := m.m[key]
+	return i, ok
+}
+
+func (m *mapStorage) Store(mode StoreMode, key string, value []byte, flags uint32, ttl time.Duration, cas uint64) (uint64, Result) {
+	if mode != StoreSet || ttl != 0 || cas != 0 {
+		return 0, NotStored
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.m[key] = Item{Key: key, Value: value, Flags: flags, Cas: 1}
+	return 1, OK
+}
+
+func (m *mapStorage) Delete(key string, cas uint64) Result {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.m[key]; !ok {
+		return NotFound
+	}
+	delete(m.m, key)
+	return OK
+}
+
+func (m *mapStorage) Incr(key string, delta uint64, decr bool, cas uint64) (uint64, uint64, Result) {
+	return 0, 0, NonNumeric
+}
+
+func (m *mapStorage) Touch(key string, ttl time.Duration) Result {
+	return NotFound
+}
+
+func (m *mapStorage) Stats() []Stat {
+	m.Lock()
+	defer m.Unlock()
+	return []Stat{{"keys", strconv.Itoa(len(m.m))}}
+}
+
+// TestWithStorage verifies the built in commands use the Storage given
+// to the server, and that options needing the built in cache are
+// refused.
+func TestWithStorage(t *testing.T) {
+	st := &mapStorage{m: make(map[string]Item)}
+	if _, err := NewServer(testOptions(WithStorage(st), WithSnapshot("scs.snapshot"))...); err == nil {
+		t.Errorf("NewServer with a snapshot and a Storage succeeded")
+	}
+
+	s, err := NewServer(testOptions(WithStorage(st))...)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer s.Close()
+	go s.Serve()
+	n, b := dial(t, s)
+
+	expect(t, n, b, "set sushi\r\ndelicious\r\n", "STORED")
+	expect(t, n, b, "add tofu\r\nbland\r\n", "NOT_STORED")
+	expect(t, n, b, "get sushi tofu\r\n", "VALUE sushi", "delicious", "END")
+	expect(t, n, b, "stats\r\n", "keys 1")
+	skipServerStats(t, b, " ")
+	expect(t, n, b, "", "END")
+	expect(t, n, b, "delete sushi\r\n", "DELETED")
+	expect(t, n, b, "save\r\n", "ERROR no snapshot file configured")
+	if len(st.m) != 0 {
+		t.Errorf("got %v keys left in the storage, wanted none", len(st.m))
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"fmt"
+)
+
+// newShards creates n empty shards for db, each with its own instance
+// of the eviction policy.
+func newShards(db *database, n int) ([]*cacheShard, error) {
+	shards := make([]*cacheShard, n)
+	for idx := range shards {
+		p, err := newEvictionPolicy(db.c.policy)
+		if err != nil {
+			return nil, err
+		}
+		shards[idx] = &cacheShard{
+			db:       db,
+			idx:      idx,
+			Cache:    make(map[string]*item),
+			expiring: make(map[string]struct{}),
+			policy:   p,
+		}
+	}
+	return shards, nil
+}
+
+// setShards splits each database into n shards, each with its own lock,
+// so commands on keys in different shards never wait on each other.
+// The item and memory limits are for the whole database, and eviction
+// compares the policy's pick from each shard, so the number of shards
+// does not change what is evicted.  It must be called before
+// setSaveRules, setLog and Serve.
+func (s *Server) setShards(n int) error {
+	if n < 1 {
+		return fmt.Errorf("shards must be at least 1")
+	}
+
+	shards := make([][]*cacheShard, len(s.c.dbs))
+	for idx, db := range s.c.dbs {
+		var err error
+		shards[idx], err = newShards(db, n)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, sh := range s.c.shards {
+		sh.Lock()
+		defer sh.Unlock()
+	}
+
+	var all []*cacheShard
+	for idx, db := range s.c.dbs {
+		old := db.shards
+		db.shards = shards[idx]
+		all = append(all, db.shards...)
+		for _, sh := range old {
+			for k, i := range sh.Cache {
+				dst := db.shard(k)
+				dst.Cache[k] = i
+				dst.bytes += i.size()
+				dst.policy.added(i)
+				if !i.expires.IsZero() {
+					dst.expiring[k] = struct{}{}
+				}
+			}
+		}
+	}
+	s.c.shards = all
+	return nil
+}
+
+// shard returns the shard key belongs to, picked by its FNV-1a hash.
+func (db *database) shard(key string) *cacheShard {
+	if len(db.shards) == 1 {
+		return db.shards[0]
+	}
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return db.shards[h%uint32(len(db.shards))]
+}
+
+// lock locks and returns the shard key belongs to.
+func (db *database) lock(key string) *cacheShard {
+	sh := db.shard(key)
+	sh.Lock()
+	return sh
+}
+
+// lockAll locks every shard, for changes that need a consistent view of
+// the whole cache.  Shards are always locked in order so two callers
+// can never deadlock, and no shard may already be locked by the caller.
+func (c *dataCache) lockAll() {
+	for _, sh := range c.shards {
+		sh.Lock()
+	}
+}
+
+// unlockAll unlocks every shard locked by lockAll.
+func (c *dataCache) unlockAll() {
+	for _, sh := range c.shards {
+		sh.Unlock()
+	}
+}
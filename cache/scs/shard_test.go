@@ -0,0 +1,189 @@
+package scs
+
+import (
+	"bufio"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestShards verifies keys are spread over shards that together keep to
+// the item limit, and that the totals add up.
+func TestShards(t *testing.T) {
+	s, err := NewServer(testOptions(WithMaxItems(64))...)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer s.Close()
+	if err := s.setShards(0); err == nil {
+		t.Errorf("setShards(0) succeeded, wanted an error")
+	}
+	err = s.setShards(16)
+	if err != nil {
+		t.Fatalf("setShards(16) = %v", err)
+	}
+	go s.Serve()
+
+	n, err := net.Dial("tcp", s.l.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect to server: %v", err)
+	}
+	n.SetDeadline(time.Now().Add(5 * time.Second))
+	b := bufio.NewReader(n)
+
+	for i := 0; i < 200; i++ {
+		expect(t, n, b, "set k"+strconv.Itoa(i)+"\r\ndata\r\n", "STORED")
+	}
+
+	s.c.lockAll()
+	items, used := 0, 0
+	for _, sh := range s.c.shards {
+		if len(sh.Cache) > 0 {
+			used++
+		}
+		for k := range sh.Cache {
+			if s.c.dbs[0].shard(k) != sh {
+				t.Errorf("key %v stored in the wrong shard", k)
+			}
+		}
+		items += len(sh.Cache)
+	}
+	s.c.unlockAll()
+
+	if used < 8 {
+		t.Errorf("keys only spread over %v of 16 shards", used)
+	}
+	if total := atomic.LoadInt64(&s.c.dbs[0].items); total != int64(items) || items != 64 {
+		t.Errorf("got %v items counted and %v stored, wanted 64", total, items)
+	}
+	if e := atomic.LoadInt64(&s.c.dbs[0].stats.Load().evictions); e != int64(200-items) {
+		t.Errorf("evictions = %v, wanted %v", e, 200-items)
+	}
+	if bytes := atomic.LoadInt64(&s.c.dbs[0].bytes); bytes < int64(items*6) {
+		t.Errorf("bytes = %v, wanted at least %v", bytes, items*6)
+	}
+}
+
+// TestShardsItemLimit verifies a sharded database holds as many items
+// as the item limit before it evicts, even with shards left empty.
+func TestShardsItemLimit(t *testing.T) {
+	s := startLimited(t, WithMaxItems(5), WithShards(16))
+	defer s.Close()
+
+	n, b := dial(t, s)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		expect(t, n, b, "set "+k+"\r\ndata\r\n", "STORED")
+	}
+	stats := readStats(t, n, b, "stats\r\n")
+	if stats["curr_items"] != "5" || stats["evictions"] != "0" {
+		t.Errorf("curr_items = %v and evictions = %v, wanted 5 and 0", stats["curr_items"], stats["evictions"])
+	}
+
+	for i := 0; i < 20; i++ {
+		expect(t, n, b, "set k"+strconv.Itoa(i)+"\r\ndata\r\n", "STORED")
+	}
+	stats = readStats(t, n, b, "stats\r\n")
+	if stats["curr_items"] != "5" || stats["evictions"] != "20" {
+		t.Errorf("curr_items = %v and evictions = %v, wanted 5 and 20", stats["curr_items"], stats["evictions"])
+	}
+}
+
+// TestSetShards verifies items already in the cache move to their new
+// shard when the number of shards changes.
+func TestSetShards(t *testing.T) {
+	s, err := NewServer(testOptions(WithMaxItems(1000))...)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 100; i++ {
+		k := "k" + strconv.Itoa(i)
+		sh := s.c.dbs[0].lock(k)
+		sh.store(k, []byte("data"), 0, time.Duration(i%2)*time.Hour)
+		sh.Unlock()
+	}
+	err = s.setShards(16)
+	if err != nil {
+		t.Fatalf("setShards(16) = %v", err)
+	}
+	if len(s.c.shards) != 16 {
+		t.Errorf("got %v shards, wanted 16", len(s.c.shards))
+	}
+	err = s.setShards(4)
+	if err != nil {
+		t.Fatalf("setShards(4) = %v", err)
+	}
+
+	s.c.lockAll()
+	defer s.c.unlockAll()
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		k := "k" + strconv.Itoa(i)
+		it, ok := s.c.dbs[0].shard(k).fetch(k, now)
+		if !ok || string(it.value) != "data" {
+			t.Errorf("%v missing after setShards", k)
+		}
+	}
+	items, expiring, bytes := 0, 0, 0
+	for _, sh := range s.c.shards {
+		items += len(sh.Cache)
+		expiring += len(sh.expiring)
+		bytes += sh.bytes
+	}
+	if items != 100 || expiring != 50 || int64(bytes) != atomic.LoadInt64(&s.c.dbs[0].bytes) {
+		t.Errorf("got %v items, %v expiring and %v bytes, wanted 100, 50 and %v",
+			items, expiring, bytes, atomic.LoadInt64(&s.c.dbs[0].bytes))
+	}
+}
+
+// benchmarkCache runs a mix of 90% gets and 10% sets on 1000 keys from
+// every goroutine against a cache split into n shards.  Run it with
+// -cpu 1,2,4,8 to see how throughput scales with more cores.
+func benchmarkCache(b *testing.B, n int) {
+	s, err := NewServer(testOptions()...)
+	if err != nil {
+		b.Fatalf("failed to create server: %v", err)
+	}
+	defer s.Close()
+	err = s.setShards(n)
+	if err != nil {
+		b.Fatalf("setShards(%v) = %v", n, err)
+	}
+
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+		sh := s.c.dbs[0].lock(keys[i])
+		sh.store(keys[i], []byte("value"), 0, 0)
+		sh.Unlock()
+	}
+	value := []byte("value")
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for i := 0; pb.Next(); i++ {
+			k := keys[r.Intn(len(keys))]
+			sh := s.c.dbs[0].lock(k)
+			if i%10 == 0 {
+				sh.storeData(StoreSet, k, value, 0, 0, false, 0)
+			} else {
+				atomic.AddInt64(&s.c.dbs[0].stats.Load().get, 1)
+				sh.fetch(k, time.Now())
+			}
+			sh.Unlock()
+		}
+	})
+}
+
+func BenchmarkCache1Shard(b *testing.B) {
+	benchmarkCache(b, 1)
+}
+
+func BenchmarkCache16Shards(b *testing.B) {
+	benchmarkCache(b, 16)
+}
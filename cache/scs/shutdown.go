@@ -0,0 +1,111 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve once Shutdown has finished.
+var ErrServerClosed = errors.New("scs: server closed")
+
+// shutdownPoll is how often Shutdown checks if the connections it is
+// waiting on have closed.
+var shutdownPoll = 10 * time.Millisecond
+
+// Shutdown stops the server without cutting off a reply.  It closes the
+// listeners and every connection waiting for a command, then waits for
+// the commands still running to finish and closes their connections.
+// Replicas are disconnected last, so they get every change made by
+// those commands.  Once every connection is closed, or ctx is done and
+// the rest are closed anyway, the background goroutines are stopped,
+// the snapshot is saved if there is one and the mutation log is
+// flushed to disk.
+//
+// Serve returns ErrServerClosed once Shutdown is done.  Shutdown returns
+// ctx's error if it had to close connections that were running a
+// command.
+func (s *Server) Shutdown(ctx context.Context) error {
+	first := false
+	s.shutdownOnce.Do(func() { first = true })
+	if !first {
+		select {
+		case <-s.stopped:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	close(s.stopping)
+	s.closeListeners()
+	s.stats.drain()
+
+	err := s.waitConns(ctx, "sync")
+	s.doneOnce.Do(func() { close(s.done) })
+	if s.c != nil {
+		s.c.feed.dropAll()
+	}
+	if err == nil {
+		err = s.waitConns(ctx, "")
+	}
+	if err != nil {
+		s.stats.closeAll()
+	}
+
+	if s.c != nil {
+		s.persist()
+	}
+	close(s.stopped)
+	return err
+}
+
+// waitConns waits until every connection is closed, other than the
+// ones running the command skip, or until ctx is done.
+func (s *Server) waitConns(ctx context.Context, skip string) error {
+	t := time.NewTicker(shutdownPoll)
+	defer t.Stop()
+	for s.stats.active(skip) != 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
+
+// persist saves the snapshot, if the server has one, and flushes the
+// mutation log to disk.  A background save is waited out first so its
+// rename can't replace the one written here.
+func (s *Server) persist() {
+	if s.c.snapshot != "" {
+		s.c.saveMutex.Lock()
+		for s.c.saving {
+			s.c.saveMutex.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			s.c.saveMutex.Lock()
+		}
+		s.c.lockAll()
+		err := s.c.save()
+		s.c.unlockAll()
+		s.c.saveMutex.Unlock()
+		if err != nil {
+			fmt.Println("failed to save snapshot: ", err)
+		}
+	}
+
+	if s.c.log != nil {
+		s.c.log.mu.Lock()
+		err := s.c.log.f.Sync()
+		s.c.log.mu.Unlock()
+		if err != nil {
+			fmt.Println("failed to sync mutation log: ", err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startSlow creates a server with a slow command that tells started
+// when it runs, then waits for release before writing a three line
+// reply.
+func startSlow(t *testing.T, opts ...Option) (s *Server, started, release chan struct{}, served chan error) {
+	t.Helper()
+
+	s, err := NewServer(testOptions(opts...)...)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	started, release = make(chan struct{}, 1), make(chan struct{})
+	s.HandleFunc("slow", func(c *Request) {
+		started <- struct{}{}
+		<-release
+		c.WriteStr("SLOW 1")
+		c.WriteStr("SLOW 2")
+		c.WriteStr("SLOW 3")
+	})
+	served = make(chan error, 1)
+	go func() { served <- s.Serve() }()
+	return s, started, release, served
+}
+
+// TestShutdown verifies Shutdown closes idle connections at once, lets
+// a running command send its whole reply before closing its
+// connection, disconnects replicas and saves the snapshot.
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dump.scs")
+
+	s, started, release, served := startSlow(t, WithSnapshot(path), WithRESPPort(0))
+	defer s.Close()
+	r := startReplica(t, s)
+	defer r.Close()
+
+	n, b := dial(t, s)
+	expect(t, n, b, "set sushi\r\ndelicious\r\n", "STORED")
+	waitFor(t, r, "sushi", "delicious")
+	idle, ib := dial(t, s)
+	expect(t, idle, ib, "get sushi\r\n", "VALUE sushi", "delicious", "END")
+	rn, err := net.Dial("tcp", s.rl.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect to RESP: %v", err)
+	}
+	defer rn.Close()
+	rn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The get pipelined after slow is never run
+	n.Write([]byte("slow\r\nget sushi\r\n"))
+	<-started
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+
+	if _, err := ib.ReadByte(); err == nil {
+		t.Errorf("idle connection was not closed")
+	}
+	if _, err := rn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle RESP connection read = %v, wanted EOF", err)
+	}
+	if c, err := net.Dial("tcp", s.Addr().String()); err == nil {
+		c.Close()
+		t.Errorf("connected after Shutdown started")
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned %v before the command finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	expect(t, n, b, "", "SLOW 1", "SLOW 2", "SLOW 3")
+	if r, err := b.ReadString('\n'); err == nil {
+		t.Errorf("connection still open after the reply, got %q", r)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown = %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve = %v, wanted ErrServerClosed", err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown = %v", err)
+	}
+
+	s2, n2, b2 := startServer(t, 65535)
+	defer s2.Close()
+	if err := s2.setSnapshot(path); err != nil {
+		t.Fatalf("setSnapshot = %v", err)
+	}
+	expect(t, n2, b2, "get sushi\r\n", "VALUE sushi", "delicious", "END")
+}
+
+// TestShutdownTimeout verifies Shutdown closes the connections of
+// commands that are still running once its context is done.
+func TestShutdownTimeout(t *testing.T) {
+	s, started, release, served := startSlow(t)
+	defer s.Close()
+	defer close(release)
+
+	n, b := dial(t, s)
+	n.Write([]byte("slow\r\n"))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown = %v, wanted %v", err, context.DeadlineExceeded)
+	}
+	if r, err := b.ReadString('\n'); err == nil {
+		t.Errorf("connection still open after Shutdown, got %q", r)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve = %v, wanted ErrServerClosed", err)
+	}
+}
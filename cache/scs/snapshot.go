@@ -0,0 +1,352 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// snapshotMagic starts every snapshot file, followed by the format
+// version.  Only snapshotVersion is read.
+const (
+	snapshotMagic   = "SCS\x00"
+	snapshotVersion = 3
+)
+
+// errSaveInProgress is returned when a save is asked for while a
+// background save is still writing.
+var errSaveInProgress = errors.New("ERROR background save already in progress")
+
+// snapshotEntry is a single item copied out of the cache to be written
+// to a snapshot.
+type snapshotEntry struct {
+	db      int
+	key     string
+	value   []byte
+	flags   uint32
+	expires time.Time
+}
+
+// saveRule triggers a background save once changes keys have changed
+// and at least after has passed since the last save.
+type saveRule struct {
+	after   time.Duration
+	changes int
+}
+
+// setSnapshot sets the file the cache is saved to and loads the items
+// in it if it already exists.  It must be called before Serve.
+func (s *Server) setSnapshot(path string) error {
+	s.c.saveMutex.Lock()
+	defer s.c.saveMutex.Unlock()
+	s.c.lockAll()
+	defer s.c.unlockAll()
+
+	s.c.snapshot = path
+	s.c.lastSave = time.Now()
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = s.c.loadSnapshot(f)
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	atomic.StoreInt64(&s.c.dirty, 0)
+	return nil
+}
+
+// setSaveRules parses rules in the form "<seconds> <changes> ..." and
+// starts a background save whenever one of the pairs is satisfied, for
+// example "900 1 60 1000" saves after 15 minutes if anything changed or
+// after a minute if 1000 keys changed.  setSnapshot must be called first.
+func (s *Server) setSaveRules(rules string) error {
+	f := strings.Fields(rules)
+	if len(f)%2 != 0 {
+		return fmt.Errorf("save rules must be pairs of seconds and changes")
+	}
+
+	var r []saveRule
+	for i := 0; i < len(f); i += 2 {
+		secs, err := strconv.Atoi(f[i])
+		if err != nil || secs <= 0 {
+			return fmt.Errorf("invalid save rule seconds '%v'", f[i])
+		}
+		changes, err := strconv.Atoi(f[i+1])
+		if err != nil || changes <= 0 {
+			return fmt.Errorf("invalid save rule changes '%v'", f[i+1])
+		}
+		r = append(r, saveRule{time.Duration(secs) * time.Second, changes})
+	}
+	if len(r) == 0 {
+		return nil
+	}
+	if s.c.snapshot == "" {
+		return fmt.Errorf("save rules require a snapshot file")
+	}
+
+	go s.autosave(r)
+	return nil
+}
+
+// autosave checks the save rules every second until the server closes.
+func (s *Server) autosave(rules []saveRule) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			s.c.saveMutex.Lock()
+			since := time.Since(s.c.lastSave)
+			dirty := atomic.LoadInt64(&s.c.dirty)
+			for _, r := range rules {
+				if dirty >= int64(r.changes) && since >= r.after {
+					// Does nothing if a save is already running
+					s.c.lockAll()
+					s.c.bgsave()
+					s.c.unlockAll()
+					break
+				}
+			}
+			s.c.saveMutex.Unlock()
+		}
+	}
+}
+
+// save writes the cache to the snapshot file before returning.  The
+// caller must hold saveMutex and every shard lock.
+func (c *dataCache) save() error {
+	if c.saving {
+		return errSaveInProgress
+	}
+	dirty := atomic.LoadInt64(&c.dirty)
+	err := writeSnapshot(c.snapshot, c.snapshotEntries())
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.dirty, -dirty)
+	c.lastSave = time.Now()
+	return nil
+}
+
+// bgsave copies the cache and writes the copy to the snapshot file in
+// a new goroutine, so the shards are only locked while copying.  The
+// caller must hold saveMutex and every shard lock.
+func (c *dataCache) bgsave() error {
+	if c.saving {
+		return errSaveInProgress
+	}
+	c.saving = true
+	dirty := atomic.LoadInt64(&c.dirty)
+	entries := c.snapshotEntries()
+
+	go func() {
+		err := writeSnapshot(c.snapshot, entries)
+
+		c.saveMutex.Lock()
+		defer c.saveMutex.Unlock()
+		c.saving = false
+		if err != nil {
+			fmt.Println("background save failed: ", err)
+			return
+		}
+		atomic.AddInt64(&c.dirty, -dirty)
+		c.lastSave = time.Now()
+	}()
+	return nil
+}
+
+// snapshotEntries copies every unexpired item in the cache, one
+// database after another.  The caller must hold every shard lock.
+func (c *dataCache) snapshotEntries() []snapshotEntry {
+	now := time.Now()
+	var items int64
+	for _, db := range c.dbs {
+		items += atomic.LoadInt64(&db.items)
+	}
+	entries := make([]snapshotEntry, 0, items)
+	for _, sh := range c.shards {
+		for k, i := range sh.Cache {
+			if i.expired(now) {
+				continue
+			}
+			entries = append(entries, snapshotEntry{sh.db.idx, k, i.value, i.flags, i.expires})
+		}
+	}
+	return entries
+}
+
+// writeSnapshot writes entries to a temporary file next to path, then
+// renames it over path so a crash never leaves a partial snapshot.
+//
+// The format is the magic and version, the number of entries, then
+// each entry as its database as a uvarint, key, value, flags as a
+// uvarint, and expiration time in unix nanoseconds (0 for none).
+// Strings are prefixed by their length as a uvarint.
+// A CRC32 of everything before it ends the file.
+func writeSnapshot(path string, entries []snapshotEntry) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	crc := crc32.NewIEEE()
+	w := bufio.NewWriter(io.MultiWriter(f, crc))
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(n uint64) {
+		w.Write(buf[:binary.PutUvarint(buf, n)])
+	}
+	putString := func(s string) {
+		putUvarint(uint64(len(s)))
+		w.WriteString(s)
+	}
+	putBytes := func(b []byte) {
+		putUvarint(uint64(len(b)))
+		w.Write(b)
+	}
+
+	w.WriteString(snapshotMagic)
+	putUvarint(snapshotVersion)
+	putUvarint(uint64(len(entries)))
+	for _, e := range entries {
+		putUvarint(uint64(e.db))
+		putString(e.key)
+		putBytes(e.value)
+		putUvarint(uint64(e.flags))
+		var exp int64
+		if !e.expires.IsZero() {
+			exp = e.expires.UnixNano()
+		}
+		binary.Write(w, binary.BigEndian, exp)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = binary.Write(f, binary.BigEndian, crc.Sum32())
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// loadSnapshot verifies the checksum of a snapshot written by
+// writeSnapshot and stores every entry that has not expired since,
+// evicting any over the limits.  The caller must hold every shard lock.
+func (c *dataCache) loadSnapshot(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) < len(snapshotMagic)+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return fmt.Errorf("not a snapshot file")
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return fmt.Errorf("snapshot checksum mismatch")
+	}
+
+	b := bytes.NewReader(body[len(snapshotMagic):])
+	getBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(b)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(b.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		s := make([]byte, n)
+		_, err = io.ReadFull(b, s)
+		return s, err
+	}
+
+	version, err := binary.ReadUvarint(b)
+	if err != nil {
+		return err
+	}
+	if version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %v", version)
+	}
+	count, err := binary.ReadUvarint(b)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for ; count > 0; count-- {
+		db, err := binary.ReadUvarint(b)
+		if err != nil {
+			return err
+		}
+		if db >= uint64(len(c.dbs)) {
+			return dbRangeError{int(db), len(c.dbs)}
+		}
+		key, err := getBytes()
+		if err != nil {
+			return err
+		}
+		value, err := getBytes()
+		if err != nil {
+			return err
+		}
+		flags, err := binary.ReadUvarint(b)
+		if err != nil {
+			return err
+		}
+		var exp int64
+		err = binary.Read(b, binary.BigEndian, &exp)
+		if err != nil {
+			return err
+		}
+
+		var ttl time.Duration
+		if exp != 0 {
+			ttl = time.Unix(0, exp).Sub(now)
+			if ttl <= 0 {
+				continue
+			}
+		}
+		k := string(key)
+		c.dbs[db].shard(k).store(k, value, uint32(flags), ttl)
+	}
+
+	// The snapshot may have been saved under higher limits
+	c.trim()
+	return nil
+}
@@ -0,0 +1,160 @@
+package scs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSnapshot saves a cache with save and bgsave and verifies a new
+// server loads the same items back.
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dump.scs")
+
+	s, n, b := startServer(t, 65535)
+	expect(t, n, b, "save\r\n", "ERROR no snapshot file configured")
+	if err := s.setSnapshot(path); err != nil {
+		t.Fatalf("setSnapshot on a missing file = %v", err)
+	}
+
+	expect(t, n, b, "set sushi\r\ndelicious\r\n", "STORED")
+	expect(t, n, b, "set topcoder 100\r\nfun\r\n", "STORED")
+	expect(t, n, b, "set short 1\r\ngone soon\r\n", "STORED")
+	expect(t, n, b, "save\r\n", "OK")
+	s.Close()
+
+	time.Sleep(1100 * time.Millisecond)
+
+	s, n, b = startServer(t, 65535)
+	if err := s.setSnapshot(path); err != nil {
+		t.Fatalf("setSnapshot = %v", err)
+	}
+	expect(t, n, b, "get sushi topcoder short\r\n", "VALUE sushi", "delicious", "VALUE topcoder", "fun", "END")
+	expect(t, n, b, "ttl topcoder\r\n", "TTL 99")
+
+	expect(t, n, b, "delete sushi\r\n", "DELETED")
+	expect(t, n, b, "bgsave\r\n", "BACKGROUND_SAVE_STARTED")
+	for i := 0; i < 100; i++ {
+		s.c.saveMutex.Lock()
+		saving := s.c.saving
+		s.c.saveMutex.Unlock()
+		if !saving {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Close()
+
+	s, n, b = startServer(t, 65535)
+	defer s.Close()
+	if err := s.setSnapshot(path); err != nil {
+		t.Fatalf("setSnapshot = %v", err)
+	}
+	expect(t, n, b, "get sushi topcoder\r\n", "VALUE topcoder", "fun", "END")
+}
+
+// TestSnapshotLimits verifies a snapshot saved under a higher item
+// limit is trimmed to the limit of the server loading it.
+func TestSnapshotLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dump.scs")
+
+	s, n, b := startServer(t, 65535)
+	if err := s.setSnapshot(path); err != nil {
+		t.Fatalf("setSnapshot on a missing file = %v", err)
+	}
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		expect(t, n, b, "set "+k+"\r\ndata\r\n", "STORED")
+	}
+	expect(t, n, b, "save\r\n", "OK")
+	s.Close()
+
+	s, n, b = startServer(t, 3)
+	defer s.Close()
+	if err := s.setSnapshot(path); err != nil {
+		t.Fatalf("setSnapshot = %v", err)
+	}
+	stats := readStats(t, n, b, "stats\r\n")
+	if stats["curr_items"] != "3" || stats["evictions"] != "2" {
+		t.Errorf("curr_items = %v and evictions = %v, wanted 3 and 2", stats["curr_items"], stats["evictions"])
+	}
+}
+
+// TestSnapshotCorrupt verifies a snapshot that fails its checksum
+// is not loaded.
+func TestSnapshotCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dump.scs")
+
+	err = writeSnapshot(path, []snapshotEntry{{key: "key", value: []byte("value")}})
+	if err != nil {
+		t.Fatalf("writeSnapshot = %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-6] ^= 0xff
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewServer(testOptions(WithSnapshot(path))...)
+	if err == nil {
+		t.Errorf("NewServer with a corrupt snapshot succeeded")
+	}
+}
+
+// TestSaveRules verifies a background save starts once a save
+// rule is satisfied.
+func TestSaveRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dump.scs")
+
+	s, n, b := startServer(t, 65535)
+	defer s.Close()
+	if err := s.setSaveRules("1 2"); err == nil {
+		t.Errorf("setSaveRules without a snapshot succeeded")
+	}
+	if err := s.setSnapshot(path); err != nil {
+		t.Fatalf("setSnapshot = %v", err)
+	}
+	if err := s.setSaveRules("1"); err == nil {
+		t.Errorf("setSaveRules with an odd number of fields succeeded")
+	}
+	if err := s.setSaveRules("1 2"); err != nil {
+		t.Fatalf("setSaveRules = %v", err)
+	}
+
+	expect(t, n, b, "set a\r\n1\r\n", "STORED")
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(path); err == nil {
+		t.Errorf("snapshot saved after 1 change, wanted 2")
+	}
+
+	expect(t, n, b, "set b\r\n2\r\n", "STORED")
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("snapshot not saved after 2 changes: %v", err)
+	}
+}
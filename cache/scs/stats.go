@@ -0,0 +1,387 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// version is reported by stats.
+const version = "1.0"
+
+// sizeBucket is the width in bytes of the item size buckets reported by
+// stats sizes, the same as memcached's.
+const sizeBucket = 32
+
+// serverStats is what stats reports about the server rather than the
+// cache: when it started, the connections it has and the bytes they
+// carried.  Shutdown drains the connections through it.
+type serverStats struct {
+	start    time.Time
+	m        *metrics
+	maxConns int          // 0 for no limit
+	limiter  *rateLimiter // nil unless commands are rate limited
+
+	// rejected and throttled count the connections refused for going
+	// over maxConns and the commands refused by the limiter.  They
+	// are updated atomically.
+	rejected  int64
+	throttled int64
+
+	mu       sync.Mutex
+	nextID   int64
+	conns    map[int64]*connStats
+	draining bool // set by Shutdown, once no more connections are added
+}
+
+// connStats is a client connection, listed by stats conns and drained
+// by Shutdown.
+type connStats struct {
+	id       int64
+	protocol string
+	addr     string
+	conn     net.Conn
+	bucket   *bucket // the rate limit of the client's IP, if any
+
+	mu      sync.Mutex
+	last    time.Time // when the last command was run, or the connection made
+	cmd     string
+	busy    bool // running a command
+	closing bool // closed by Shutdown, or to be once the command finishes
+}
+
+func newServerStats(m *metrics) *serverStats {
+	return &serverStats{
+		start: time.Now(),
+		m:     m,
+		conns: make(map[int64]*connStats),
+	}
+}
+
+// open adds conn, speaking protocol, to the connections stats conns
+// lists until it is closed.  It returns errShuttingDown once the server
+// is shutting down, or errTooManyConns if it already has maxConns, and
+// the caller must close conn without serving it.
+func (ss *serverStats) open(protocol string, conn net.Conn) (*connStats, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.draining {
+		return nil, errShuttingDown
+	}
+	if ss.maxConns > 0 && len(ss.conns) >= ss.maxConns {
+		atomic.AddInt64(&ss.rejected, 1)
+		return nil, errTooManyConns
+	}
+	ss.nextID++
+	cs := &connStats{
+		id:       ss.nextID,
+		protocol: protocol,
+		addr:     conn.RemoteAddr().String(),
+		conn:     conn,
+		last:     time.Now(),
+	}
+	if ss.limiter != nil {
+		cs.bucket = ss.limiter.acquire(conn.RemoteAddr())
+	}
+	ss.conns[cs.id] = cs
+	return cs, nil
+}
+
+// close removes a connection added by open.
+func (ss *serverStats) close(cs *connStats) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.conns, cs.id)
+	if cs.bucket != nil {
+		ss.limiter.release(cs.bucket)
+	}
+}
+
+// allow reports if the connection can run another command under the
+// rate limit of its IP, and counts it if not.
+func (ss *serverStats) allow(cs *connStats) bool {
+	if cs.bucket == nil || ss.limiter.allow(cs.bucket) {
+		return true
+	}
+	atomic.AddInt64(&ss.throttled, 1)
+	return false
+}
+
+// begin marks the connection as running a command, which it must not
+// do if this returns false because Shutdown has closed it.
+func (cs *connStats) begin() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.closing {
+		return false
+	}
+	cs.busy = true
+	return true
+}
+
+// command records that the connection is running cmd.
+func (cs *connStats) command(cmd string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.last = time.Now()
+	cs.cmd = cmd
+}
+
+// end marks the command started by begin as finished.  It returns false
+// if the server is shutting down, and the caller must flush the reply
+// and close the connection.
+func (cs *connStats) end() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.busy = false
+	return !cs.closing
+}
+
+// drain stops new connections being added, closes the ones waiting for
+// a command and marks the rest to be closed once their command ends.
+func (ss *serverStats) drain() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.draining = true
+	for _, cs := range ss.conns {
+		cs.mu.Lock()
+		cs.closing = true
+		if !cs.busy {
+			cs.conn.Close()
+		}
+		cs.mu.Unlock()
+	}
+}
+
+// closeAll closes every connection, even those running a command.
+func (ss *serverStats) closeAll() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, cs := range ss.conns {
+		cs.conn.Close()
+	}
+}
+
+// active counts the connections that are still open, leaving out the
+// ones running the command skip.
+func (ss *serverStats) active(skip string) int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	n := 0
+	for _, cs := range ss.conns {
+		cs.mu.Lock()
+		if !cs.busy || cs.cmd != skip {
+			n++
+		}
+		cs.mu.Unlock()
+	}
+	return n
+}
+
+// reset zeroes the rejected connection and throttled command counts
+// for stats reset.  The connection and byte counts are kept, like the
+// cache's gauges.
+func (ss *serverStats) reset() {
+	atomic.StoreInt64(&ss.rejected, 0)
+	atomic.StoreInt64(&ss.throttled, 0)
+}
+
+// Stats returns the stats about the server itself, named like
+// memcached's.  The connection and byte counts add up every listener.
+func (ss *serverStats) Stats() []Stat {
+	var open, accepted, read, written int64
+	for _, l := range ss.m.listeners {
+		open += atomic.LoadInt64(&l.open)
+		accepted += atomic.LoadInt64(&l.accepted)
+		read += atomic.LoadInt64(&l.read)
+		written += atomic.LoadInt64(&l.written)
+	}
+	user, system := rusage()
+	now := time.Now()
+	return []Stat{
+		{"pid", fmt.Sprint(os.Getpid())},
+		{"uptime", fmt.Sprint(int64(now.Sub(ss.start).Seconds()))},
+		{"time", fmt.Sprint(now.Unix())},
+		{"version", version},
+		{"rusage_user", fmt.Sprintf("%.6f", user.Seconds())},
+		{"rusage_system", fmt.Sprintf("%.6f", system.Seconds())},
+		{"curr_connections", fmt.Sprint(open)},
+		{"total_connections", fmt.Sprint(accepted)},
+		{"bytes_read", fmt.Sprint(read)},
+		{"bytes_written", fmt.Sprint(written)},
+		{"rejected_connections", fmt.Sprint(atomic.LoadInt64(&ss.rejected))},
+		{"throttled_commands", fmt.Sprint(atomic.LoadInt64(&ss.throttled))},
+	}
+}
+
+// connStats returns three stats for each open connection, ordered by
+// when it connected: its address, the whole seconds since it last ran
+// a command and the name of that command.
+func (ss *serverStats) connStats() []Stat {
+	ss.mu.Lock()
+	conns := make([]*connStats, 0, len(ss.conns))
+	for _, cs := range ss.conns {
+		conns = append(conns, cs)
+	}
+	ss.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+
+	var st []Stat
+	now := time.Now()
+	for _, cs := range conns {
+		cs.mu.Lock()
+		idle, cmd := now.Sub(cs.last), cs.cmd
+		cs.mu.Unlock()
+		if cmd == "" {
+			cmd = "none"
+		}
+		prefix := strconv.FormatInt(cs.id, 10) + ":"
+		st = append(st,
+			Stat{prefix + "addr", cs.protocol + ":" + cs.addr},
+			Stat{prefix + "secs_since_last_cmd", fmt.Sprint(int64(idle.Seconds()))},
+			Stat{prefix + "last_cmd", cmd},
+		)
+	}
+	return st
+}
+
+// itemStats returns the items, bytes and items with a ttl held by each
+// shard of the database, followed by its totals.  Like memcached's
+// empty slab classes, empty shards are left out.  Each shard is locked
+// only while it is counted.
+func (db *database) itemStats() []Stat {
+	var st []Stat
+	var ttls int
+	for _, sh := range db.shards {
+		sh.Lock()
+		items, bytes, expiring := len(sh.Cache), sh.bytes, len(sh.expiring)
+		sh.Unlock()
+		ttls += expiring
+		if items == 0 {
+			continue
+		}
+
+		prefix := "items:" + strconv.Itoa(sh.idx) + ":"
+		st = append(st,
+			Stat{prefix + "number", strconv.Itoa(items)},
+			Stat{prefix + "bytes", strconv.Itoa(bytes)},
+			Stat{prefix + "number_ttl", strconv.Itoa(expiring)},
+		)
+	}
+	ds := db.stats.Load()
+	return append(st,
+		Stat{"items:number", fmt.Sprint(atomic.LoadInt64(&db.items))},
+		Stat{"items:number_ttl", strconv.Itoa(ttls)},
+		Stat{"items:evicted", fmt.Sprint(atomic.LoadInt64(&ds.evictions))},
+		Stat{"items:reclaimed", fmt.Sprint(atomic.LoadInt64(&ds.reclaimed))},
+		Stat{"items:expired_unfetched", fmt.Sprint(atomic.LoadInt64(&ds.expiredUnfetched))},
+	)
+}
+
+// sizeStats counts the items of the database in each sizeBucket of key
+// and value bytes.  Each stat is named by the largest size in its
+// bucket, and empty buckets are left out.  Like memcached, this walks
+// every item, one locked shard at a time.
+func (db *database) sizeStats() []Stat {
+	counts := make(map[int]int)
+	for _, sh := range db.shards {
+		sh.Lock()
+		for _, i := range sh.Cache {
+			counts[(i.size()+sizeBucket-1)/sizeBucket*sizeBucket]++
+		}
+		sh.Unlock()
+	}
+
+	sizes := make([]int, 0, len(counts))
+	for size := range counts {
+		sizes = append(sizes, size)
+	}
+	sort.Ints(sizes)
+	st := make([]Stat, len(sizes))
+	for n, size := range sizes {
+		st[n] = Stat{strconv.Itoa(size), strconv.Itoa(counts[size])}
+	}
+	return st
+}
+
+// ResetStats implements StatsResetter.  The counters are swapped for
+// zeroed ones all at once, so stats never shows some of them reset and
+// others not.  Gauges like curr_items are left alone.
+func (db *database) ResetStats() {
+	db.stats.Store(&dataStats{})
+}
+
+// cmdStats prints the current usage statistics for the connection's
+// database and the server.  It also takes the memcached subcommands:
+// items, sizes and conns print those stats instead, and reset zeroes
+// the counters.
+func cmdStats(c *Request) {
+	if len(c.Subcmd) > 1 {
+		c.WriteStr("ERROR stats takes at most one subcommand")
+		return
+	}
+	if len(c.Subcmd) == 0 {
+		writeStats(c, c.Storage.Stats())
+		if c.stats != nil {
+			writeStats(c, c.stats.Stats())
+		}
+		c.WriteStr("END")
+		return
+	}
+
+	switch sub := c.Subcmd[0]; sub {
+	case "items", "sizes":
+		if c.c == nil {
+			c.WriteStr("ERROR stats " + sub + " needs the built in storage")
+			return
+		}
+		if sub == "items" {
+			writeStats(c, c.db.itemStats())
+		} else {
+			writeStats(c, c.db.sizeStats())
+		}
+	case "conns":
+		if c.stats != nil {
+			writeStats(c, c.stats.connStats())
+		}
+	case "reset":
+		r, ok := c.Storage.(StatsResetter)
+		if !ok {
+			c.WriteStr("ERROR stats reset is not supported by the storage")
+			return
+		}
+		if c.c != nil {
+			// Every database, not only the one selected
+			for _, db := range c.c.dbs {
+				db.ResetStats()
+			}
+		} else {
+			r.ResetStats()
+		}
+		if c.stats != nil {
+			c.stats.reset()
+		}
+		c.WriteStr("RESET")
+		return
+	default:
+		c.WriteStr("ERROR unknown stats subcommand '" + sub + "'")
+		return
+	}
+	c.WriteStr("END")
+}
+
+// writeStats writes each stat as a "<name> <value>" line.
+func writeStats(c *Request, st []Stat) {
+	for _, s := range st {
+		c.WriteStr(s.Name + " " + s.Value)
+	}
+}
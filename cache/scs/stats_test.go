@@ -0,0 +1,138 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// skipServerStats reads the server stats that follow the storage's in
+// the stats reply, whose values change from run to run, and verifies
+// only their names.  sep is what separates the name from the value.
+func skipServerStats(t *testing.T, b *bufio.Reader, sep string) {
+	t.Helper()
+
+	for _, st := range newServerStats(newMetrics()).Stats() {
+		r, err := b.ReadString('\n')
+		if err != nil {
+			t.Errorf("server stats read error: %v", err)
+			return
+		}
+		if !strings.HasPrefix(r, st.Name+sep) {
+			t.Errorf("server stats expected '%v', got '%v'", st.Name, r)
+		}
+	}
+}
+
+// readStats sends cmd and returns the stats in the reply.
+func readStats(t *testing.T, n net.Conn, b *bufio.Reader, cmd string) map[string]string {
+	t.Helper()
+
+	n.Write([]byte(cmd))
+	stats := make(map[string]string)
+	for {
+		r, err := b.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%q read error: %v", cmd, err)
+		}
+		if r == "END\r\n" {
+			return stats
+		}
+		f := strings.Fields(r)
+		if len(f) != 2 {
+			t.Fatalf("%q got '%v'", cmd, r)
+		}
+		stats[f[0]] = f[1]
+	}
+}
+
+// TestStats verifies the server stats and the items, sizes, conns and
+// reset subcommands.
+func TestStats(t *testing.T) {
+	s, n, b := startServer(t, 65535)
+	defer s.Close()
+	n2, b2 := dial(t, s)
+
+	expect(t, n, b, "set sushi\r\ndelicious\r\n", "STORED")
+	expect(t, n, b, "set pizza 100\r\n"+strings.Repeat("x", 40)+"\r\n", "STORED")
+	expect(t, n, b, "get sushi\r\n", "VALUE sushi", "delicious", "END")
+	expect(t, n2, b2, "get tofu\r\n", "END")
+
+	stats := readStats(t, n, b, "stats\r\n")
+	for k, v := range map[string]string{
+		"cmd_get":           "2",
+		"cmd_set":           "2",
+		"curr_items":        "2",
+		"pid":               fmt.Sprint(os.Getpid()),
+		"version":           version,
+		"curr_connections":  "2",
+		"total_connections": "2",
+	} {
+		if stats[k] != v {
+			t.Errorf("stats %v = %v, want %v", k, stats[k], v)
+		}
+	}
+	if stats["bytes_read"] == "0" || stats["bytes_written"] == "0" {
+		t.Errorf("stats bytes_read %v and bytes_written %v, want more than 0", stats["bytes_read"], stats["bytes_written"])
+	}
+
+	// Both keys hash to the same shard
+	shard := "items:" + strconv.Itoa(s.c.dbs[0].shard("sushi").idx)
+	expect(t, n, b, "stats items\r\n", shard+":number 2", shard+":bytes 59", shard+":number_ttl 1",
+		"items:number 2", "items:number_ttl 1", "items:evicted 0", "items:reclaimed 0", "items:expired_unfetched 0", "END")
+	expect(t, n, b, "stats sizes\r\n", "32 1", "64 1", "END")
+	expect(t, n, b, "stats conns\r\n",
+		"1:addr text:"+n.LocalAddr().String(), "1:secs_since_last_cmd 0", "1:last_cmd stats",
+		"2:addr text:"+n2.LocalAddr().String(), "2:secs_since_last_cmd 0", "2:last_cmd get", "END")
+
+	atomic.StoreInt64(&s.stats.rejected, 3)
+	atomic.StoreInt64(&s.stats.throttled, 5)
+	expect(t, n, b, "stats reset\r\n", "RESET")
+	stats = readStats(t, n, b, "stats\r\n")
+	if stats["cmd_get"] != "0" || stats["cmd_set"] != "0" || stats["curr_items"] != "2" ||
+		stats["rejected_connections"] != "0" || stats["throttled_commands"] != "0" || stats["total_connections"] != "2" {
+		t.Errorf("stats after reset = %v", stats)
+	}
+
+	expect(t, n, b, "stats slabs\r\n", "ERROR unknown stats subcommand 'slabs'")
+	expect(t, n, b, "stats items sizes\r\n", "ERROR stats takes at most one subcommand")
+
+	// Closed connections are no longer listed once the server sees them
+	// close
+	n2.Close()
+	for end := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		conns := readStats(t, n, b, "stats conns\r\n")
+		if len(conns) == 3 && conns["1:last_cmd"] == "stats" {
+			break
+		}
+		if time.Now().After(end) {
+			t.Fatalf("stats conns after close = %v", conns)
+		}
+	}
+}
+
+// TestStatsStorage verifies the subcommands that need the built in
+// storage are refused with any other.
+func TestStatsStorage(t *testing.T) {
+	s, err := NewServer(testOptions(WithStorage(&mapStorage{m: make(map[string]Item)}))...)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer s.Close()
+	go s.Serve()
+	n, b := dial(t, s)
+
+	expect(t, n, b, "stats items\r\n", "ERROR stats items needs the built in storage")
+	expect(t, n, b, "stats sizes\r\n", "ERROR stats sizes needs the built in storage")
+	expect(t, n, b, "stats reset\r\n", "ERROR stats reset is not supported by the storage")
+}
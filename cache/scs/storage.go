@@ -0,0 +1,219 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Storage is the key value store commands read and change.  The server
+// uses its own sharded cache unless WithStorage gives it another one.
+// Every method must be safe to call from many connections at once, and
+// must happen atomically for its key.
+type Storage interface {
+	// Get returns the item at key for a client reading it, counting
+	// it as used for eviction and in the get stats.
+	Get(key string) (Item, bool)
+	// Peek returns the item at key without counting it as used.
+	Peek(key string) (Item, bool)
+	// Store stores value at key the way mode says to, and returns the
+	// version given to the new item.  A ttl of 0 never expires, and a
+	// negative ttl has already expired, so the value is stored and
+	// removed straight away.  A cas other than 0 only stores the value
+	// if the item at key still has that version.
+	Store(mode StoreMode, key string, value []byte, flags uint32, ttl time.Duration, cas uint64) (uint64, Result)
+	// Delete removes the item at key, only if it still has the version
+	// cas when that is not 0.
+	Delete(key string, cas uint64) Result
+	// Incr adds delta to the decimal number at key, or subtracts it
+	// when decr is set, and returns the new number and version.  A cas
+	// other than 0 must match the version of the item.
+	Incr(key string, delta uint64, decr bool, cas uint64) (uint64, uint64, Result)
+	// Touch changes when the item at key expires.  A ttl of 0 makes it
+	// never expire.
+	Touch(key string, ttl time.Duration) Result
+	// Stats lists the usage statistics in the order stats prints them.
+	Stats() []Stat
+}
+
+// MultiGetter is implemented by a Storage that fetches many keys faster
+// together than one at a time, such as one spread over other servers.
+// get and gets use it when the Storage has it.
+type MultiGetter interface {
+	// GetMulti returns the items found for keys, counted as Get would.
+	GetMulti(keys []string) map[string]Item
+}
+
+// StatsResetter is implemented by a Storage whose counters can be
+// zeroed by stats reset.
+type StatsResetter interface {
+	ResetStats()
+}
+
+// Item is a copy of a value stored in a Storage.
+type Item struct {
+	Key     string
+	Value   []byte    // shared with the storage, so it must not be changed
+	Flags   uint32    // opaque to the server, set by memcached clients
+	Expires time.Time // zero value means the item never expires
+	Cas     uint64    // version, changed every time the item is stored
+}
+
+// Stat is a single named statistic reported by the stats command.
+type Stat struct {
+	Name  string
+	Value string
+}
+
+// StoreMode is how Store combines a value with the item already at its
+// key.  The set family of commands all store data in the cache,
+// differing in whether the key must already exist and how the data is
+// combined with what is already there.
+type StoreMode int
+
+const (
+	StoreSet StoreMode = iota
+	StoreAdd
+	StoreReplace
+	StoreAppend
+	StorePrepend
+)
+
+// Result is the outcome of a change made to a Storage.
+type Result int
+
+const (
+	OK          Result = iota
+	NotFound           // there is no item at the key
+	NotStored          // the key did or did not exist as the store mode needs
+	Exists             // the item was stored again since the version given
+	TooLarge           // appending made the data too large
+	OverMemory         // the item is larger than the memory limit
+	CacheFull          // the eviction policy could not make room
+	NonNumeric         // incr or decr of a value that is not a number
+	ReadOnly           // the storage is a replica, which only its primary changes
+	Unavailable        // the storage could not be reached
+)
+
+// export copies the parts of an item a Storage user can see.
+func (i *item) export() Item {
+	return Item{Key: i.key, Value: i.value, Flags: i.flags, Expires: i.expires, Cas: i.cas}
+}
+
+// Get implements Storage.
+func (db *database) Get(key string) (Item, bool) {
+	atomic.AddInt64(&db.stats.Load().get, 1)
+	sh := db.lock(key)
+	defer sh.Unlock()
+
+	i, ok := sh.fetch(key, time.Now())
+	if !ok {
+		atomic.AddInt64(&db.stats.Load().getMisses, 1)
+		return Item{}, false
+	}
+	atomic.AddInt64(&db.stats.Load().getHits, 1)
+	return i.export(), true
+}
+
+// Peek implements Storage.
+func (db *database) Peek(key string) (Item, bool) {
+	sh := db.lock(key)
+	defer sh.Unlock()
+
+	i, ok := sh.lookup(key, time.Now())
+	if !ok {
+		return Item{}, false
+	}
+	return i.export(), true
+}
+
+// Store implements Storage.
+func (db *database) Store(mode StoreMode, key string, value []byte, flags uint32, ttl time.Duration, cas uint64) (uint64, Result) {
+	if db.c.link != nil {
+		return 0, ReadOnly
+	}
+	sh := db.lock(key)
+	defer sh.Unlock()
+
+	expired := ttl < 0
+	if expired {
+		ttl = 0
+	}
+	res := sh.storeData(mode, key, value, flags, ttl, expired, cas)
+	if res != OK {
+		return 0, res
+	}
+	i, ok := sh.Cache[key]
+	if !ok {
+		return 0, OK
+	}
+	return i.cas, OK
+}
+
+// Delete implements Storage.
+func (db *database) Delete(key string, cas uint64) Result {
+	if db.c.link != nil {
+		return ReadOnly
+	}
+	sh := db.lock(key)
+	defer sh.Unlock()
+
+	i, ok := sh.lookup(key, time.Now())
+	if !ok {
+		atomic.AddInt64(&db.stats.Load().delMisses, 1)
+		return NotFound
+	}
+	if cas != 0 && i.cas != cas {
+		return Exists
+	}
+
+	atomic.AddInt64(&db.stats.Load().delHits, 1)
+	sh.remove(key)
+	return OK
+}
+
+// Incr implements Storage.  The read, change and write all happen under
+// the shard lock, so counters shared between connections never lose an
+// update.
+func (db *database) Incr(key string, delta uint64, decr bool, cas uint64) (uint64, uint64, Result) {
+	if db.c.link != nil {
+		return 0, 0, ReadOnly
+	}
+	sh := db.lock(key)
+	defer sh.Unlock()
+
+	if cas != 0 {
+		i, ok := sh.lookup(key, time.Now())
+		if !ok {
+			return 0, 0, NotFound
+		}
+		if i.cas != cas {
+			return 0, 0, Exists
+		}
+	}
+
+	n, res := sh.incr(key, delta, decr)
+	if res != OK {
+		return 0, 0, res
+	}
+	return n, sh.Cache[key].cas, OK
+}
+
+// Touch implements Storage.
+func (db *database) Touch(key string, ttl time.Duration) Result {
+	if db.c.link != nil {
+		return ReadOnly
+	}
+	sh := db.lock(key)
+	defer sh.Unlock()
+
+	i, ok := sh.lookup(key, time.Now())
+	if !ok {
+		return NotFound
+	}
+	sh.setTTL(key, i, ttl)
+	return OK
+}
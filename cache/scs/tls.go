@@ -0,0 +1,89 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout is how long a client has to finish the TLS
+// handshake before it is disconnected.  A variable so tests can
+// shorten it.
+var tlsHandshakeTimeout = 10 * time.Second
+
+// loadTLS builds the server's TLS config from PEM files.  With caFile,
+// clients must present a certificate signed by one of the CAs in it.
+func loadTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// listen opens a TCP listener for protocol on addr:port, which serves
+// TLS if the server has a certificate.  Its connections are counted in
+// the metrics and get the server's write timeout.
+func (s *Server) listen(protocol, addr string, port int) (net.Listener, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf("%v:%v", addr, port))
+	if err != nil {
+		return nil, err
+	}
+	l = &meteredListener{l, s.metrics.listener(protocol)}
+	if s.timeouts.write > 0 {
+		l = &writeTimeoutListener{l, s.timeouts.write}
+	}
+	if s.tls != nil {
+		l = tls.NewListener(l, s.tls)
+	}
+	return l, nil
+}
+
+// identify finishes the TLS handshake of conn, if it is a TLS
+// connection, and returns the common name in the subject of the
+// client's certificate.  It is "" for clients without one.  Every
+// protocol calls it before reading, so no client can hold a connection
+// open by never finishing the handshake.
+func identify(conn net.Conn) (string, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := tc.Handshake()
+	if err != nil {
+		return "", err
+	}
+	tc.SetDeadline(time.Time{})
+
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", nil
+	}
+	return certs[0].Subject.CommonName, nil
+}
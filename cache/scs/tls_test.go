@@ -0,0 +1,163 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package scs
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	// Give up on clients that never finish the handshake quickly
+	tlsHandshakeTimeout = 100 * time.Millisecond
+}
+
+// testCert creates a certificate for cn signed by parent, or a self
+// signed CA when parent is nil, and writes it and its key to dir.
+func testCert(t *testing.T, dir, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+		DNSNames:     []string{"localhost"},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	ioutil.WriteFile(filepath.Join(dir, cn+".pem"), certPEM, 0600)
+	ioutil.WriteFile(filepath.Join(dir, cn+".key"), keyPEM, 0600)
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, pair
+}
+
+// TestTLS verifies every protocol is served over TLS, that a CA makes
+// client certificates required, and that handlers see the identity in
+// them.
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey, _ := testCert(t, dir, "ca", nil, nil)
+	testCert(t, dir, "server", ca, caKey)
+	_, _, alice := testCert(t, dir, "alice", ca, caKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	if _, err := NewServer(testOptions(WithTLS(path("server.pem"), path("missing.key"), ""))...); err == nil {
+		t.Errorf("NewServer with a missing key succeeded")
+	}
+	if _, err := NewServer(testOptions(WithTLS(path("server.pem"), path("server.key"), path("server.key")))...); err == nil {
+		t.Errorf("NewServer with a CA file holding no certificates succeeded")
+	}
+
+	s, err := NewServer(testOptions(WithTLS(path("server.pem"), path("server.key"), path("ca.pem")), WithBinaryPort(0), WithRESPPort(0))...)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer s.Close()
+	s.HandleFunc("whoami", func(c *Request) {
+		c.WriteStr("YOU ARE " + c.Identity)
+	})
+	go s.Serve()
+
+	config := &tls.Config{RootCAs: pool, ServerName: "localhost", Certificates: []tls.Certificate{alice}}
+	n, err := tls.Dial("tcp", s.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("unable to connect over TLS: %v", err)
+	}
+	defer n.Close()
+	n.SetDeadline(time.Now().Add(5 * time.Second))
+	b := bufio.NewReader(n)
+	expect(t, n, b, "set sushi\r\ndelicious\r\nget sushi\r\n", "STORED", "VALUE sushi", "delicious", "END")
+	expect(t, n, b, "whoami\r\n", "YOU ARE alice")
+
+	rn, err := tls.Dial("tcp", s.rl.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("unable to connect to RESP over TLS: %v", err)
+	}
+	defer rn.Close()
+	rn.SetDeadline(time.Now().Add(5 * time.Second))
+	expect(t, rn, bufio.NewReader(rn), respCmd("GET", "sushi"), "$9", "delicious")
+
+	// Without a certificate the server ends the handshake
+	n2, err := tls.Dial("tcp", s.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	if err == nil {
+		n2.SetDeadline(time.Now().Add(5 * time.Second))
+		n2.Write([]byte("get sushi\r\n"))
+		_, err = bufio.NewReader(n2).ReadString('\n')
+		n2.Close()
+	}
+	if err == nil {
+		t.Errorf("connection without a client certificate was served")
+	}
+
+	// Plain text is refused
+	pn, pb := dial(t, s)
+	pn.Write([]byte("get sushi\r\n"))
+	if r, err := pb.ReadString('\n'); err == nil {
+		t.Errorf("plain text connection got %q", r)
+	}
+
+	// Every listener disconnects clients that never start the handshake
+	for _, l := range []net.Listener{s.l, s.bl, s.rl} {
+		hn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("unable to connect: %v", err)
+		}
+		hn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = hn.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+			t.Errorf("connection to %v without a handshake was kept open: %v", l.Addr(), err)
+		}
+		hn.Close()
+	}
+}
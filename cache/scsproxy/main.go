@@ -0,0 +1,103 @@
+// Copyright 2014 James Wendel. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Proxy that spreads keys over several scs cache servers with a consistent
+hash ring, so clients can talk to one address instead of each sharding
+keys on their own.  It speaks the same protocols as scs.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"topcoder.com/kyrra/scs/proxy"
+	"topcoder.com/kyrra/scs/scs"
+)
+
+// main Entrypoint to the proxy.  Defines command line flags, creates
+// the proxy in front of the backends, and serves it with an scs server.
+func main() {
+	a := flag.String("addr", "", "IP address the proxy binds to")
+	p := flag.Int("port", 11213, "Port the proxy listens on")
+	bp := flag.Int("binaryport", 0, "Port the memcached binary protocol listens on, 0 to disable")
+	rp := flag.Int("respport", 0, "Port the Redis RESP protocol listens on, 0 to disable")
+	mc := flag.Bool("memcached", false, "Reply to get with memcached style 'VALUE <key> <flags> <bytes>' lines")
+	be := flag.String("backends", "localhost:11212", "Comma separated host:port list of the scs servers to spread keys over")
+	vn := flag.Int("vnodes", proxy.DefaultVirtualNodes, "Points each backend has on the hash ring")
+	t := flag.Duration("timeout", proxy.DefaultTimeout, "How long a call to a backend can take")
+	ej := flag.Int("ejectafter", proxy.DefaultEjectAfter, "Calls to a backend that fail in a row before it is ejected")
+	ci := flag.Duration("checkinterval", proxy.DefaultCheckInterval, "How often ejected backends are tried again")
+	st := flag.Duration("shutdowntimeout", 30*time.Second, "How long SIGINT and SIGTERM wait for running commands to finish before closing their connections")
+	flag.Parse()
+
+	px, err := proxy.New(strings.Split(*be, ","),
+		proxy.WithVirtualNodes(*vn),
+		proxy.WithTimeout(*t),
+		proxy.WithEjectAfter(*ej),
+		proxy.WithCheckInterval(*ci))
+	if err != nil {
+		fmt.Println("failed to create proxy: ", err)
+		return
+	}
+	defer px.Close()
+
+	opts := []scs.Option{
+		scs.WithAddr(*a),
+		scs.WithPort(*p),
+		scs.WithMemcached(*mc),
+		scs.WithStorage(px),
+	}
+	if *bp != 0 {
+		opts = append(opts, scs.WithBinaryPort(*bp))
+	}
+	if *rp != 0 {
+		opts = append(opts, scs.WithRESPPort(*rp))
+	}
+
+	s, err := scs.NewServer(opts...)
+	if err != nil {
+		fmt.Println("failed to create server: ", err)
+		return
+	}
+
+	handleSignals(s, *st)
+	fmt.Println("ready to proxy cache requests")
+	err = s.Serve()
+	if err != scs.ErrServerClosed {
+		fmt.Println("server stopped: ", err)
+	}
+}
+
+// handleSignals starts a goroutine that waits for SIGINT or SIGTERM and
+// shuts s down, giving running commands timeout to finish.  A second
+// signal exits straight away.
+func handleSignals(s *scs.Server, timeout time.Duration) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-c
+		fmt.Println("shutting down proxy")
+		go func() {
+			<-c
+			fmt.Println("forcing shutdown")
+			os.Exit(1)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		err := s.Shutdown(ctx)
+		if err != nil {
+			fmt.Println("closed connections still running commands: ", err)
+		}
+	}()
+}